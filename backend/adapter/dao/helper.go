@@ -2,6 +2,7 @@ package dao
 
 import (
 	"errors"
+	"pixiu/backend/business/stock"
 	"pixiu/backend/pkg/exception"
 
 	"gorm.io/gorm"
@@ -19,3 +20,31 @@ func WrapGormError(err error) exception.AppError {
 	}
 	return exception.WrapService(600, err.Error(), err)
 }
+
+// paginate 按分页参数设置排序、偏移和记录数，排序字段只允许 columns 中的字段
+func paginate(db *gorm.DB, p *stock.Page, columns map[string]string, defaultOrder string) (*gorm.DB, error) {
+	if p.OrderBy == "" {
+		db = db.Order(defaultOrder)
+	} else {
+		column, ok := columns[p.OrderBy]
+		if !ok {
+			return nil, exception.NewBusiness(400, "unsupported order field: "+p.OrderBy)
+		}
+		if p.Desc {
+			column += " desc"
+		}
+		db = db.Order(column + ", id")
+	}
+	return db.Offset((p.PageNo - 1) * p.PageSize).Limit(p.PageSize), nil
+}
+
+// inRange 按时间范围 [Start, End) 过滤，时刻以 UTC 存储和比较
+func inRange(db *gorm.DB, column string, r stock.TimeRange) *gorm.DB {
+	if !r.Start.IsZero() {
+		db = db.Where(column+" >= ?", r.Start.UTC())
+	}
+	if !r.End.IsZero() {
+		db = db.Where(column+" < ?", r.End.UTC())
+	}
+	return db
+}
@@ -4,8 +4,23 @@ import (
 	"context"
 	"pixiu/backend/business/stock"
 	"pixiu/backend/pkg/gormer"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// 数量以文本存储，按数值排序
+var investmentColumns = map[string]string{
+	"id": "id", "stockCode": "stock_code", "openTime": "open_at", "closeTime": "close_at",
+	"profitLoss": "profit_loss", "costPrice": "cost_price", "quantity": "CAST(quantity AS REAL)", "amount": "amount",
+}
+
+var transactionColumns = map[string]string{
+	"id": "id", "stockCode": "stock_code", "finishTime": "finish_at", "action": "action",
+	"price": "price", "quantity": "CAST(quantity AS REAL)", "amount": "amount", "taxFee": "tax_fee",
+}
+
 type StockDao struct {
 	ormer gormer.GormDS
 }
@@ -34,16 +49,16 @@ func (s StockDao) SaveStock(ctx context.Context, si *stock.StockInfo) error {
 }
 
 func (s StockDao) UpdateStock(ctx context.Context, si *stock.StockInfo) error {
-	return WrapGormError(s.ormer.GDB(ctx).Model(si).Where("code=?", si.Code).Updates(si).Error)
+	return WrapGormError(s.ormer.GDB(ctx).Model(si).Where("code=?", si.Code).Select("Name", "Market", "Type", "Currency", "QuantityPrecision", "LotSize", "Status", "UpdatedAt").Updates(si).Error)
 }
 
 func (s StockDao) DeleteStock(ctx context.Context, code string) error {
-	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.StockInfo{}).Where("code = ?", code).UpdateColumn("status", -1).Error)
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.StockInfo{}).Where("code = ?", code).UpdateColumns(map[string]any{"status": -1, "updated_at": time.Now()}).Error)
 }
 
 func (s StockDao) GetHolding(ctx context.Context, code string) (*stock.Investment, error) {
 	var investment stock.Investment
-	err := s.ormer.GDB(ctx).Where("stock_code = ? and status = 0", code).First(&investment).Error
+	err := s.realOnly(ctx, s.ormer.GDB(ctx).Where("stock_code = ? and status = 0", code)).Order("portfolio_id").First(&investment).Error
 	if err != nil {
 		return nil, WrapGormError(err)
 	}
@@ -55,7 +70,7 @@ func (s StockDao) CreateInvestment(ctx context.Context, invest *stock.Investment
 }
 
 func (s StockDao) UpdateInvestment(ctx context.Context, invest *stock.Investment) error {
-	return WrapGormError(s.ormer.GDB(ctx).Model(invest).Select("ProfitLoss", "TotalTaxFee", "CostPrice", "Quantity", "Amount", "OpenTime", "CloseTime", "Status").Updates(invest).Error)
+	return WrapGormError(s.ormer.GDB(ctx).Model(invest).Select("ProfitLoss", "GrossProfit", "TotalTaxFee", "CostPrice", "HoldingCost", "DilutedCost", "BreakEven", "Quantity", "Amount", "OpenTime", "CloseTime", "OpenAt", "CloseAt", "Status").Updates(invest).Error)
 }
 
 func (s StockDao) GetInvestment(ctx context.Context, id int64) (*stock.Investment, error) {
@@ -65,15 +80,23 @@ func (s StockDao) GetInvestment(ctx context.Context, id int64) (*stock.Investmen
 }
 
 func (s StockDao) DeleteInvestment(ctx context.Context, id int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.Investment{}).Where("id = ?", id).UpdateColumns(map[string]any{"status": -1, "updated_at": time.Now()}).Error)
+}
+
+func (s StockDao) RemoveInvestment(ctx context.Context, id int64) error {
 	return WrapGormError(s.ormer.GDB(ctx).Where("id = ?", id).Delete(&stock.Investment{}).Error)
 }
 
+func (s StockDao) RestoreInvestment(ctx context.Context, id int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.Investment{}).Where("id = ? and status = -1", id).UpdateColumns(map[string]any{"status": 0, "updated_at": time.Now()}).Error)
+}
+
 func (s StockDao) CreateTransaction(ctx context.Context, trans *stock.Transaction) error {
 	return WrapGormError(s.ormer.GDB(ctx).Create(trans).Error)
 }
 
 func (s StockDao) UpdateTransaction(ctx context.Context, trans *stock.Transaction) error {
-	return WrapGormError(s.ormer.GDB(ctx).Model(trans).Select("TaxFee", "Action", "Price", "Quantity", "Amount", "FinishTime", "UpdatedAt").Updates(trans).Error)
+	return WrapGormError(s.ormer.GDB(ctx).Model(trans).Select("TaxFee", "Action", "Price", "Quantity", "Amount", "FinishTime", "FinishAt", "SettleDate", "Converted", "Backtest", "UpdatedAt").Updates(trans).Error)
 }
 
 func (s StockDao) GetTransaction(ctx context.Context, id int64) (*stock.Transaction, error) {
@@ -83,44 +106,527 @@ func (s StockDao) GetTransaction(ctx context.Context, id int64) (*stock.Transact
 }
 
 func (s StockDao) DeleteTransaction(ctx context.Context, id int64) error {
-	return WrapGormError(s.ormer.GDB(ctx).Where("id = ?", id).Delete(stock.Transaction{}).Error)
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.Transaction{}).Where("id = ?", id).UpdateColumns(map[string]any{"status": -1, "updated_at": time.Now()}).Error)
+}
+
+func (s StockDao) RestoreTransaction(ctx context.Context, id int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.Transaction{}).Where("id = ? and status = -1", id).UpdateColumns(map[string]any{"status": 0, "updated_at": time.Now()}).Error)
 }
 
 func (s StockDao) GetTransactions(ctx context.Context, investId int64) (*[]stock.Transaction, error) {
 	var transactions []stock.Transaction
-	err := s.ormer.GDB(ctx).Where("invest_id = ?", investId).Order("finish_time").Find(&transactions).Error
+	err := s.ormer.GDB(ctx).Where("invest_id = ? and status = 0", investId).Order("finish_at, id").Find(&transactions).Error
 	return &transactions, WrapGormError(err)
 }
 
-func (s StockDao) GetClearList(ctx context.Context, stime string, ftime string) (*[]stock.ClearStats, error) {
-	subQuery := s.ormer.GDB(ctx).Model(stock.Investment{}).
-		Select("stock_code, Sum(profit_loss) profit_loss, COUNT(*) total_count, SUM(CASE WHEN profit_loss >= 0 THEN 1 ELSE 0 END) profit_count, SUM(CASE WHEN profit_loss < 0 THEN 1 ELSE 0 END) loss_count").
-		Where("status = ?", 1)
-	if stime != "" {
-		subQuery = subQuery.Where("open_time >= ?", stime)
+func (s StockDao) QueryInvestments(ctx context.Context, c *stock.Criteria, p *stock.Page) (*[]stock.Investment, int64, error) {
+	db := s.byPortfolio(ctx, s.ormer.GDB(ctx).Model(&stock.Investment{}).Where("status <> -1"), c.PortfolioID)
+	if c.StockCode != "" {
+		db = db.Where("stock_code = ?", c.StockCode)
+	}
+	if c.Status != nil {
+		db = db.Where("status = ?", *c.Status)
 	}
-	if ftime != "" {
-		subQuery = subQuery.Where("open_time <= ?", ftime)
+	db = inRange(db, "open_at", c.Range)
+	if c.MinPrice > 0 {
+		db = db.Where("cost_price >= ?", c.MinPrice)
+	}
+	if c.MaxPrice > 0 {
+		db = db.Where("cost_price <= ?", c.MaxPrice)
 	}
-	subQuery = subQuery.Group("stock_code")
 
-	var clears []stock.ClearStats
-	err := s.ormer.GDB(ctx).Model(&stock.StockInfo{}).
-		Select("code stock_code, name stock_name, i.profit_loss, i.total_count, i.profit_count, i.loss_count").
-		Joins("JOIN (?) i ON code = i.stock_code", subQuery).
-		Find(&clears).Error
-	return &clears, WrapGormError(err)
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, WrapGormError(err)
+	}
+	db, err := paginate(db, p, investmentColumns, "open_at desc, id desc")
+	if err != nil {
+		return nil, 0, err
+	}
+	var invests []stock.Investment
+	err = db.Find(&invests).Error
+	return &invests, total, WrapGormError(err)
 }
 
-func (s *StockDao) GetClearInvest(ctx context.Context, stockCode string, startTime string, finishTime string) (*[]stock.Investment, error) {
-	db := s.ormer.GDB(ctx).Model(&stock.Investment{}).Where("status=1 and stock_code = ?", stockCode)
-	if startTime != "" {
-		db = db.Where("open_time >= ?", startTime)
+func (s StockDao) QueryTransactions(ctx context.Context, c *stock.Criteria, p *stock.Page) (*[]stock.Transaction, int64, error) {
+	db := s.byPortfolio(ctx, s.ormer.GDB(ctx).Model(&stock.Transaction{}).Where("status = 0"), c.PortfolioID)
+	if c.StockCode != "" {
+		db = db.Where("stock_code = ?", c.StockCode)
+	}
+	if c.InvestID != 0 {
+		db = db.Where("invest_id = ?", c.InvestID)
+	}
+	if c.Action != 0 {
+		db = db.Where("action = ?", c.Action)
+	}
+	db = inRange(db, "finish_at", c.Range)
+	if c.MinPrice > 0 {
+		db = db.Where("price >= ?", c.MinPrice)
+	}
+	if c.MaxPrice > 0 {
+		db = db.Where("price <= ?", c.MaxPrice)
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, WrapGormError(err)
+	}
+	db, err := paginate(db, p, transactionColumns, "finish_at desc, id desc")
+	if err != nil {
+		return nil, 0, err
 	}
-	if finishTime != "" {
-		db = db.Where("open_time <= ?", finishTime)
+	var trans []stock.Transaction
+	err = db.Find(&trans).Error
+	return &trans, total, WrapGormError(err)
+}
+
+func (s StockDao) GetInvestments(ctx context.Context) (*[]stock.Investment, error) {
+	var invests []stock.Investment
+	err := s.ormer.GDB(ctx).Order("stock_code, open_at, id").Find(&invests).Error
+	return &invests, WrapGormError(err)
+}
+
+func (s StockDao) GetAllTransactions(ctx context.Context) (*[]stock.Transaction, error) {
+	var transactions []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("status = 0").Order("invest_id, finish_at, id").Find(&transactions).Error
+	return &transactions, WrapGormError(err)
+}
+
+func (s StockDao) UpdateTransactionInvest(ctx context.Context, id int64, investId int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.Transaction{}).Where("id = ?", id).UpdateColumn("invest_id", investId).Error)
+}
+
+func (s StockDao) SaveMigration(ctx context.Context, m *stock.Migration) error {
+	return WrapGormError(s.ormer.GDB(ctx).Save(m).Error)
+}
+
+func (s StockDao) GetMigration(ctx context.Context, name string) (*stock.Migration, error) {
+	var m stock.Migration
+	err := s.ormer.GDB(ctx).Where("name = ?", name).First(&m).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &m, nil
+}
+
+func (s StockDao) GetPendingMigrations(ctx context.Context) (*[]stock.Migration, error) {
+	var ms []stock.Migration
+	err := s.ormer.GDB(ctx).Where("pending = ?", true).Order("created_at, name").Find(&ms).Error
+	return &ms, WrapGormError(err)
+}
+
+func (s StockDao) GetUnstampedTransactions(ctx context.Context) (*[]stock.Transaction, error) {
+	var transactions []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("finish_at IS NULL").Order("id").Find(&transactions).Error
+	return &transactions, WrapGormError(err)
+}
+
+func (s StockDao) UpdateTransactionTime(ctx context.Context, tran *stock.Transaction) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(tran).UpdateColumns(map[string]any{"finish_time": tran.FinishTime, "finish_at": tran.FinishAt}).Error)
+}
+
+func (s StockDao) GetStockInvestments(ctx context.Context, portfolioId int64, stockCode string) (*[]stock.Investment, error) {
+	var invests []stock.Investment
+	err := s.ormer.GDB(ctx).Where("portfolio_id = ? and stock_code = ? and status <> -1", portfolioId, stockCode).Order("open_at, id").Find(&invests).Error
+	return &invests, WrapGormError(err)
+}
+
+func (s StockDao) GetStockTransactions(ctx context.Context, portfolioId int64, stockCode string) (*[]stock.Transaction, error) {
+	// 已删除投资下的交易随投资一起在回收站中，不参与重建
+	deleted := s.ormer.GDB(ctx).Model(&stock.Investment{}).Select("id").Where("status = -1")
+	var transactions []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("portfolio_id = ? and stock_code = ? and status = 0", portfolioId, stockCode).Where("invest_id NOT IN (?)", deleted).
+		Order("finish_at, id").Find(&transactions).Error
+	return &transactions, WrapGormError(err)
+}
+
+func (s *StockDao) GetClearInvest(ctx context.Context, stockCode string, r stock.TimeRange) (*[]stock.Investment, error) {
+	db := s.ormer.GDB(ctx).Model(&stock.Investment{}).Where("status=1")
+	if stockCode != "" {
+		db = db.Where("stock_code = ?", stockCode)
 	}
+	db = s.realOnly(ctx, db)
+	db = inRange(db, "open_at", r)
 	var invests []stock.Investment
 	err := db.Find(&invests).Error
 	return &invests, WrapGormError(err)
 }
+
+func (s StockDao) DeletedStocks(ctx context.Context, before time.Time) (*[]stock.StockInfo, error) {
+	var stocks []stock.StockInfo
+	err := s.ormer.GDB(ctx).Where("status = -1 and updated_at <= ?", before).Order("updated_at desc").Find(&stocks).Error
+	return &stocks, WrapGormError(err)
+}
+
+func (s StockDao) DeletedInvestments(ctx context.Context, before time.Time) (*[]stock.Investment, error) {
+	var invests []stock.Investment
+	err := s.ormer.GDB(ctx).Where("status = -1 and updated_at <= ?", before).Order("updated_at desc").Find(&invests).Error
+	return &invests, WrapGormError(err)
+}
+
+func (s StockDao) DeletedTransactions(ctx context.Context, before time.Time) (*[]stock.Transaction, error) {
+	var trans []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("status = -1 and updated_at <= ?", before).Order("updated_at desc").Find(&trans).Error
+	return &trans, WrapGormError(err)
+}
+
+func (s StockDao) PurgeStock(ctx context.Context, code string) (bool, error) {
+	// 仍有投资记录引用的股票不清除
+	refs := s.ormer.GDB(ctx).Model(&stock.Investment{}).Select("1").Where("stock_code = ?", code)
+	result := s.ormer.GDB(ctx).Where("code = ? and status = -1", code).Where("NOT EXISTS (?)", refs).Delete(&stock.StockInfo{})
+	return result.RowsAffected > 0, WrapGormError(result.Error)
+}
+
+func (s StockDao) PurgeInvestment(ctx context.Context, id int64) error {
+	err := s.ormer.GDB(ctx).Where("invest_id = ?", id).Delete(&stock.Transaction{}).Error
+	if err != nil {
+		return WrapGormError(err)
+	}
+	return WrapGormError(s.ormer.GDB(ctx).Where("id = ? and status = -1", id).Delete(&stock.Investment{}).Error)
+}
+
+func (s StockDao) PurgeTransaction(ctx context.Context, id int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Where("id = ? and status = -1", id).Delete(&stock.Transaction{}).Error)
+}
+
+func (s StockDao) CreateAuditLog(ctx context.Context, log *stock.AuditLog) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(log).Error)
+}
+
+func (s StockDao) GetAuditLog(ctx context.Context, id int64) (*stock.AuditLog, error) {
+	var log stock.AuditLog
+	err := s.ormer.GDB(ctx).Where("id = ?", id).First(&log).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &log, nil
+}
+
+func (s StockDao) RevertAuditLog(ctx context.Context, id int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.AuditLog{}).Where("id = ?", id).UpdateColumn("reverted", true).Error)
+}
+
+func (s StockDao) GetAuditLogs(ctx context.Context, entity string, entityKey string) (*[]stock.AuditLog, error) {
+	db := s.ormer.GDB(ctx).Model(&stock.AuditLog{}).Where("entity = ?", entity)
+	if entityKey != "" {
+		db = db.Where("entity_key = ?", entityKey)
+	}
+	var logs []stock.AuditLog
+	err := db.Order("id desc").Find(&logs).Error
+	return &logs, WrapGormError(err)
+}
+
+func (s StockDao) CreatePlannedOrder(ctx context.Context, plan *stock.PlannedOrder) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(plan).Error)
+}
+
+func (s StockDao) UpdatePlannedOrder(ctx context.Context, plan *stock.PlannedOrder) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(plan).Select("Action", "Price", "Quantity", "StopPrice", "Status", "ExpireDate", "Remark", "UpdatedAt").Updates(plan).Error)
+}
+
+func (s StockDao) GetPlannedOrder(ctx context.Context, id int64) (*stock.PlannedOrder, error) {
+	var plan stock.PlannedOrder
+	err := s.ormer.GDB(ctx).First(&plan, id).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &plan, nil
+}
+
+func (s StockDao) GetPlannedOrders(ctx context.Context) (*[]stock.PlannedOrder, error) {
+	var plans []stock.PlannedOrder
+	err := s.ormer.GDB(ctx).Order("id desc").Find(&plans).Error
+	return &plans, WrapGormError(err)
+}
+
+// GetCodeTransactions 返回股票编码的所有交易（包括已删除的交易）
+func (s StockDao) GetCodeTransactions(ctx context.Context, code string) (*[]stock.Transaction, error) {
+	var transactions []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("stock_code = ?", code).Order("finish_at, id").Find(&transactions).Error
+	return &transactions, WrapGormError(err)
+}
+
+func (s StockDao) UpdateTransactionCode(ctx context.Context, trans *stock.Transaction) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(trans).Select("StockCode", "Price", "Quantity", "Amount", "Converted", "UpdatedAt").Updates(trans).Error)
+}
+
+func (s StockDao) ChangeInvestmentCode(ctx context.Context, from string, to string) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.Investment{}).Where("stock_code = ?", from).UpdateColumns(map[string]any{"stock_code": to, "updated_at": time.Now()}).Error)
+}
+
+// ChangeStockRefs 将计划订单、网格计划、定投计划、现金分红和日线行情转到新编码
+func (s StockDao) ChangeStockRefs(ctx context.Context, from string, to string) error {
+	if err := s.changeCode(ctx, from, to, &stock.PlannedOrder{}, &stock.GridPlan{}, &stock.DcaPlan{}, &stock.Dividend{}); err != nil {
+		return err
+	}
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.PriceBar{}).Where("stock_code = ?", from).UpdateColumn("stock_code", to).Error)
+}
+
+// ChangeAmountRefs 将按金额计算、不需要按换股比例折算的定投计划和现金分红转到合并后的编码
+func (s StockDao) ChangeAmountRefs(ctx context.Context, from string, to string) error {
+	return s.changeCode(ctx, from, to, &stock.DcaPlan{}, &stock.Dividend{})
+}
+
+func (s StockDao) changeCode(ctx context.Context, from string, to string, models ...any) error {
+	for _, model := range models {
+		if err := s.ormer.GDB(ctx).Model(model).Where("stock_code = ?", from).UpdateColumns(map[string]any{"stock_code": to, "updated_at": time.Now()}).Error; err != nil {
+			return WrapGormError(err)
+		}
+	}
+	return nil
+}
+
+func (s StockDao) SaveStockAlias(ctx context.Context, alias *stock.StockAlias) error {
+	return WrapGormError(s.ormer.GDB(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(alias).Error)
+}
+
+func (s StockDao) GetStockAlias(ctx context.Context, code string) (*stock.StockAlias, error) {
+	var alias stock.StockAlias
+	err := s.ormer.GDB(ctx).Where("code = ?", code).First(&alias).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &alias, nil
+}
+
+func (s StockDao) GetStockAliases(ctx context.Context) (*[]stock.StockAlias, error) {
+	var aliases []stock.StockAlias
+	err := s.ormer.GDB(ctx).Order("created_at desc").Find(&aliases).Error
+	return &aliases, WrapGormError(err)
+}
+
+func (s StockDao) RetargetStockAliases(ctx context.Context, from string, to string) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(&stock.StockAlias{}).Where("stock_code = ?", from).UpdateColumn("stock_code", to).Error)
+}
+
+func (s StockDao) DeleteStockAlias(ctx context.Context, code string) error {
+	return WrapGormError(s.ormer.GDB(ctx).Where("code = ?", code).Delete(&stock.StockAlias{}).Error)
+}
+
+func (s StockDao) CreateGridPlan(ctx context.Context, plan *stock.GridPlan) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(plan).Error)
+}
+
+func (s StockDao) UpdateGridPlan(ctx context.Context, plan *stock.GridPlan) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(plan).Select("LowerPrice", "UpperPrice", "GridCount", "GridQuantity", "BasePosition", "StartTime", "Status", "Remark", "UpdatedAt").Updates(plan).Error)
+}
+
+func (s StockDao) GetGridPlan(ctx context.Context, id int64) (*stock.GridPlan, error) {
+	var plan stock.GridPlan
+	err := s.ormer.GDB(ctx).First(&plan, id).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &plan, nil
+}
+
+func (s StockDao) GetGridPlans(ctx context.Context) (*[]stock.GridPlan, error) {
+	var plans []stock.GridPlan
+	err := s.ormer.GDB(ctx).Order("id desc").Find(&plans).Error
+	return &plans, WrapGormError(err)
+}
+
+func (s StockDao) CreateDcaPlan(ctx context.Context, plan *stock.DcaPlan) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(plan).Error)
+}
+
+func (s StockDao) UpdateDcaPlan(ctx context.Context, plan *stock.DcaPlan) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(plan).Select("Amount", "Frequency", "Day", "HolidayRule", "EndDate", "ScheduleFrom", "Status", "Remark", "UpdatedAt").Updates(plan).Error)
+}
+
+func (s StockDao) GetDcaPlan(ctx context.Context, id int64) (*stock.DcaPlan, error) {
+	var plan stock.DcaPlan
+	err := s.ormer.GDB(ctx).First(&plan, id).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &plan, nil
+}
+
+func (s StockDao) GetDcaPlans(ctx context.Context) (*[]stock.DcaPlan, error) {
+	var plans []stock.DcaPlan
+	err := s.ormer.GDB(ctx).Order("id desc").Find(&plans).Error
+	return &plans, WrapGormError(err)
+}
+
+func (s StockDao) CreateDcaEntry(ctx context.Context, entry *stock.DcaEntry) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(entry).Error)
+}
+
+func (s StockDao) UpdateDcaEntry(ctx context.Context, entry *stock.DcaEntry) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(entry).Select("Status", "TranID", "UpdatedAt").Updates(entry).Error)
+}
+
+func (s StockDao) GetDcaEntry(ctx context.Context, id int64) (*stock.DcaEntry, error) {
+	var entry stock.DcaEntry
+	err := s.ormer.GDB(ctx).First(&entry, id).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &entry, nil
+}
+
+func (s StockDao) GetDcaEntries(ctx context.Context, planId int64) (*[]stock.DcaEntry, error) {
+	db := s.ormer.GDB(ctx)
+	if planId != 0 {
+		db = db.Where("plan_id = ?", planId)
+	}
+	var entries []stock.DcaEntry
+	err := db.Order("due_date, plan_id, id").Find(&entries).Error
+	return &entries, WrapGormError(err)
+}
+
+func (s StockDao) GetPlanTransactions(ctx context.Context, planId int64) (*[]stock.Transaction, error) {
+	var trans []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("plan_id = ? and status = 0", planId).Order("finish_at, id").Find(&trans).Error
+	return &trans, WrapGormError(err)
+}
+
+func (s StockDao) CreateDividend(ctx context.Context, d *stock.Dividend) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(d).Error)
+}
+
+func (s StockDao) UpdateDividend(ctx context.Context, d *stock.Dividend) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(d).Select("TranID", "UpdatedAt").Updates(d).Error)
+}
+
+func (s StockDao) GetDividend(ctx context.Context, id int64) (*stock.Dividend, error) {
+	var d stock.Dividend
+	err := s.ormer.GDB(ctx).First(&d, id).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &d, nil
+}
+
+func (s StockDao) DeleteDividend(ctx context.Context, id int64) error {
+	return WrapGormError(s.ormer.GDB(ctx).Delete(&stock.Dividend{}, id).Error)
+}
+
+func (s StockDao) GetDividends(ctx context.Context, stockCode string) (*[]stock.Dividend, error) {
+	db := s.ormer.GDB(ctx)
+	if stockCode != "" {
+		db = db.Where("stock_code = ?", stockCode)
+	}
+	var divs []stock.Dividend
+	err := db.Order("paid_at desc, id desc").Find(&divs).Error
+	return &divs, WrapGormError(err)
+}
+
+func (s StockDao) GetStockDividends(ctx context.Context, portfolioId int64, stockCode string) (*[]stock.Dividend, error) {
+	var divs []stock.Dividend
+	err := s.ormer.GDB(ctx).Where("portfolio_id = ? and stock_code = ?", portfolioId, stockCode).Order("paid_at, id").Find(&divs).Error
+	return &divs, WrapGormError(err)
+}
+
+func (s StockDao) GetPortfolioDividends(ctx context.Context, portfolioId int64) (*[]stock.Dividend, error) {
+	var divs []stock.Dividend
+	err := s.ormer.GDB(ctx).Where("portfolio_id = ?", portfolioId).Order("paid_at, id").Find(&divs).Error
+	return &divs, WrapGormError(err)
+}
+
+func (s StockDao) GetHolidays(ctx context.Context, calendar string) (*[]stock.Holiday, error) {
+	var holidays []stock.Holiday
+	err := s.ormer.GDB(ctx).Where("calendar = ?", calendar).Order("date").Find(&holidays).Error
+	return &holidays, WrapGormError(err)
+}
+
+func (s StockDao) DeleteHolidays(ctx context.Context, calendar string) error {
+	return WrapGormError(s.ormer.GDB(ctx).Where("calendar = ?", calendar).Delete(&stock.Holiday{}).Error)
+}
+
+func (s StockDao) SaveHolidays(ctx context.Context, holidays *[]stock.Holiday) error {
+	if len(*holidays) == 0 {
+		return nil
+	}
+	return WrapGormError(s.ormer.GDB(ctx).CreateInBatches(holidays, 100).Error)
+}
+
+// SavePriceBars 保存日线行情，同一股票同一日期的行情覆盖
+func (s StockDao) SavePriceBars(ctx context.Context, bars *[]stock.PriceBar) error {
+	if len(*bars) == 0 {
+		return nil
+	}
+	db := s.ormer.GDB(ctx).Clauses(clause.OnConflict{UpdateAll: true})
+	return WrapGormError(db.CreateInBatches(bars, 200).Error)
+}
+
+func (s StockDao) GetPriceBars(ctx context.Context, stockCode string, startDate string, endDate string) (*[]stock.PriceBar, error) {
+	var bars []stock.PriceBar
+	db := s.ormer.GDB(ctx).Where("stock_code = ?", stockCode)
+	if startDate != "" {
+		db = db.Where("date >= ?", startDate)
+	}
+	if endDate != "" {
+		db = db.Where("date <= ?", endDate)
+	}
+	err := db.Order("date").Find(&bars).Error
+	return &bars, WrapGormError(err)
+}
+
+func (s StockDao) GetLatestPriceBar(ctx context.Context, stockCode string) (*stock.PriceBar, error) {
+	var bar stock.PriceBar
+	err := s.ormer.GDB(ctx).Where("stock_code = ?", stockCode).Order("date desc").First(&bar).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &bar, nil
+}
+
+// realOnly 排除模拟组合的数据，只保留实盘
+func (s StockDao) realOnly(ctx context.Context, db *gorm.DB) *gorm.DB {
+	simulated := s.ormer.GDB(ctx).Model(&stock.Portfolio{}).Select("id").Where("simulated = ?", true)
+	return db.Where("portfolio_id NOT IN (?)", simulated)
+}
+
+// byPortfolio 按投资组合过滤，未指定组合时只保留实盘
+func (s StockDao) byPortfolio(ctx context.Context, db *gorm.DB, portfolioId *int64) *gorm.DB {
+	if portfolioId == nil {
+		return s.realOnly(ctx, db)
+	}
+	return db.Where("portfolio_id = ?", *portfolioId)
+}
+
+func (s StockDao) CreatePortfolio(ctx context.Context, p *stock.Portfolio) error {
+	return WrapGormError(s.ormer.GDB(ctx).Create(p).Error)
+}
+
+func (s StockDao) UpdatePortfolio(ctx context.Context, p *stock.Portfolio) error {
+	return WrapGormError(s.ormer.GDB(ctx).Model(p).Select("Name", "InitialCash", "Remark", "UpdatedAt").Updates(p).Error)
+}
+
+func (s StockDao) GetPortfolio(ctx context.Context, id int64) (*stock.Portfolio, error) {
+	var p stock.Portfolio
+	err := s.ormer.GDB(ctx).First(&p, id).Error
+	if err != nil {
+		return nil, WrapGormError(err)
+	}
+	return &p, nil
+}
+
+func (s StockDao) GetPortfolios(ctx context.Context) (*[]stock.Portfolio, error) {
+	var ps []stock.Portfolio
+	err := s.ormer.GDB(ctx).Order("id").Find(&ps).Error
+	return &ps, WrapGormError(err)
+}
+
+func (s StockDao) GetPortfolioTransactions(ctx context.Context, portfolioId int64) (*[]stock.Transaction, error) {
+	var trans []stock.Transaction
+	err := s.ormer.GDB(ctx).Where("portfolio_id = ? and status = 0", portfolioId).Order("finish_at, id").Find(&trans).Error
+	return &trans, WrapGormError(err)
+}
+
+func (s StockDao) GetPortfolioInvestments(ctx context.Context, portfolioId int64, r stock.TimeRange) (*[]stock.Investment, error) {
+	db := s.ormer.GDB(ctx).Where("portfolio_id = ? and status <> -1", portfolioId)
+	db = inRange(db, "open_at", r)
+	var invests []stock.Investment
+	err := db.Order("open_at, id").Find(&invests).Error
+	return &invests, WrapGormError(err)
+}
+
+func (s StockDao) GetStockPortfolios(ctx context.Context, stockCode string) ([]int64, error) {
+	var ids []int64
+	err := s.ormer.GDB(ctx).Model(&stock.Transaction{}).Where("stock_code = ? and status = 0", stockCode).
+		Distinct().Order("portfolio_id").Pluck("portfolio_id", &ids).Error
+	return ids, WrapGormError(err)
+}
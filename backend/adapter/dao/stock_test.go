@@ -0,0 +1,140 @@
+package dao
+
+import (
+	"context"
+	"path/filepath"
+	"pixiu/backend/business/stock"
+	"pixiu/backend/pkg/gormer"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// newTestDB 在临时目录创建与应用相同命名策略的 sqlite 数据库
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	gdb, err := NewGormDB(&SqliteConfig{Dsn: filepath.Join(t.TempDir(), "pixiu.db"), LogMode: "silent",
+		Prefix: "t_", Singular: true, MaxIdleConns: 1, MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db, err := gdb.DB(); err == nil {
+			db.Close()
+		}
+	})
+	return gdb
+}
+
+func TestDecimalRoundTrip(t *testing.T) {
+	gdb := newTestDB(t)
+	if err := gdb.AutoMigrate(stock.Investment{}, stock.Transaction{}, stock.StockAlias{}); err != nil {
+		t.Fatal(err)
+	}
+	dao := NewStockDao(gormer.NewGormer(gdb))
+	ctx := context.Background()
+
+	for _, value := range []string{"1234.5678", "0.0001", "100.0000", "1234567890123.4567"} {
+		want := decimal.RequireFromString(value)
+
+		tran := &stock.Transaction{StockCode: "000001", Action: 1, Price: 1.0235, Quantity: want}
+		if err := dao.CreateTransaction(ctx, tran); err != nil {
+			t.Fatal(err)
+		}
+		gotTran, err := dao.GetTransaction(ctx, tran.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gotTran.Quantity.Equal(want) {
+			t.Errorf("transaction quantity: got %s, want %s", gotTran.Quantity, value)
+		}
+
+		invest := &stock.Investment{StockCode: "000001", Quantity: want}
+		if err := dao.CreateInvestment(ctx, invest); err != nil {
+			t.Fatal(err)
+		}
+		gotInvest, err := dao.GetInvestment(ctx, invest.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gotInvest.Quantity.Equal(want) {
+			t.Errorf("investment quantity: got %s, want %s", gotInvest.Quantity, value)
+		}
+
+		alias := &stock.StockAlias{Code: "old" + value, StockCode: "000001", Kind: "merge", Ratio: want}
+		if err := dao.SaveStockAlias(ctx, alias); err != nil {
+			t.Fatal(err)
+		}
+		gotAlias, err := dao.GetStockAlias(ctx, alias.Code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gotAlias.Ratio.Equal(want) {
+			t.Errorf("alias ratio: got %s, want %s", gotAlias.Ratio, value)
+		}
+	}
+}
+
+func TestMigrateNumericQuantity(t *testing.T) {
+	gdb := newTestDB(t)
+	// 旧版本按 numeric 建表，sqlite 把数量存为 REAL 或 INTEGER
+	if err := gdb.Exec("CREATE TABLE t_transaction (id integer PRIMARY KEY, stock_code text, quantity numeric)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Exec("INSERT INTO t_transaction (id, stock_code, quantity) VALUES (1, '000001', '1234.5678'), (2, '000001', '100')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(stock.Transaction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	if err := gdb.Raw("SELECT typeof(quantity) FROM t_transaction ORDER BY id").Scan(&kinds).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, kind := range kinds {
+		if kind != "text" {
+			t.Errorf("row %d: quantity stored as %s, want text", i+1, kind)
+		}
+	}
+
+	dao := NewStockDao(gormer.NewGormer(gdb))
+	for id, want := range map[int64]string{1: "1234.5678", 2: "100"} {
+		tran, err := dao.GetTransaction(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tran.Quantity.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("transaction %d: got quantity %s, want %s", id, tran.Quantity, want)
+		}
+	}
+}
+
+func TestOrderByQuantity(t *testing.T) {
+	gdb := newTestDB(t)
+	if err := gdb.AutoMigrate(stock.Transaction{}, stock.Portfolio{}); err != nil {
+		t.Fatal(err)
+	}
+	dao := NewStockDao(gormer.NewGormer(gdb))
+	ctx := context.Background()
+	for _, value := range []string{"20", "100", "3.5"} {
+		tran := &stock.Transaction{StockCode: "000001", Action: 1, Price: 1, Quantity: decimal.RequireFromString(value)}
+		if err := dao.CreateTransaction(ctx, tran); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trans, _, err := dao.QueryTransactions(ctx, &stock.Criteria{}, &stock.Page{PageNo: 1, PageSize: 10, OrderBy: "quantity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tran := range *trans {
+		got = append(got, tran.Quantity.String())
+	}
+	if strings.Join(got, " ") != "3.5 20 100" {
+		t.Fatalf("got quantities %v, want 3.5 20 100", got)
+	}
+}
@@ -11,9 +11,10 @@ type LifeCycle interface {
 }
 
 type Result struct {
-	Code int    `json:"code"`
-	Mesg string `json:"mesg"`
-	Data any    `json:"data,omitempty"`
+	Code  int    `json:"code"`
+	Mesg  string `json:"mesg"`
+	Data  any    `json:"data,omitempty"`
+	Total int64  `json:"total"`
 }
 
 func Failure(err error) *Result {
@@ -40,3 +41,12 @@ func Success(data any) *Result {
 		Data: data,
 	}
 }
+
+func SuccessPage(data any, total int64) *Result {
+	return &Result{
+		Code:  0,
+		Mesg:  "ok",
+		Data:  data,
+		Total: total,
+	}
+}
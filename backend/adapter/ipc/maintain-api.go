@@ -0,0 +1,57 @@
+package ipc
+
+import (
+	"pixiu/backend/adapter/container"
+	"pixiu/backend/business/stock"
+)
+
+type MaintainApi struct {
+	ac container.Container
+	ms *stock.MaintainService
+}
+
+func NewMaintainApi(c container.Container) *MaintainApi {
+	return &MaintainApi{ac: c}
+}
+
+func (m *MaintainApi) Start() {
+	m.ms = m.ac.GetComponent("MaintainService").(*stock.MaintainService)
+}
+
+func (m *MaintainApi) Close() {
+
+}
+
+func (m *MaintainApi) CheckIntegrity() *Result {
+	report, err := m.ms.CheckIntegrity()
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(report)
+}
+
+func (m *MaintainApi) RepairIntegrity(token string) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	report, err := m.ms.RepairIntegrity(claims.Username)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(report)
+}
+
+func (m *MaintainApi) RecomputeAll(token string) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	report, err := m.ms.RecomputeAll(claims.Username)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(report)
+}
@@ -2,22 +2,28 @@ package ipc
 
 import (
 	"context"
+	"os"
 	"pixiu/backend/adapter/container"
 	"pixiu/backend/business/stock"
+	"pixiu/backend/business/system"
+	"pixiu/backend/pkg/slf4g"
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 type StockApi struct {
 	ac     container.Container
 	ss     *stock.StockService
+	ps     *system.SystemService
 	cancel context.CancelFunc
 }
 
 type ClearQuery struct {
 	StartTime  string `json:"startTime"`
 	FinishTime string `json:"finishTime"`
+	Gross      bool   `json:"gross"` // 按毛盈亏（不扣除税费）统计
 }
 
 func NewStockApi(ac container.Container) *StockApi {
@@ -28,11 +34,13 @@ func NewStockApi(ac container.Container) *StockApi {
 
 func (s *StockApi) Start() {
 	s.ss = s.ac.GetComponent("StockService").(*stock.StockService)
+	s.ps = s.ac.GetComponent("SystemService").(*system.SystemService)
 
 	var cctx context.Context
 	cctx, s.cancel = context.WithCancel(context.Background())
 
 	go loopWindowEvent(s.ac.WailsContext(), cctx)
+	go loopDcaSchedule(s.ac.WailsContext(), cctx, s.ss)
 }
 
 func (s *StockApi) Close() {
@@ -97,6 +105,25 @@ func loopWindowEvent(wctx context.Context, cctx context.Context) {
 	}
 }
 
+// loopDcaSchedule 启动时和每小时为定投计划生成到期的定投，有新生成的定投时通知前端
+func loopDcaSchedule(wctx context.Context, cctx context.Context, ss *stock.StockService) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if count, err := ss.ScheduleDcaPlans(); err != nil {
+			slf4g.R().Warn("schedule dca plans failed, %s", err)
+		} else if count > 0 && wctx != nil {
+			runtime.EventsEmit(wctx, "dca_scheduled", map[string]any{"count": count})
+		}
+
+		select {
+		case <-cctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (s *StockApi) GetStockList() *Result {
 	sis, err := s.ss.GetStockList()
 	if err != nil {
@@ -113,30 +140,143 @@ func (s *StockApi) GetStock(code string) *Result {
 	return Success(si)
 }
 
-func (s *StockApi) AddStock(si *stock.StockInfo) *Result {
-	err := s.ss.SaveStock(si)
+func (s *StockApi) AddStock(token string, si *stock.StockInfo) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.SaveStock(claims.Username, si)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) UpdateStock(token string, si *stock.StockInfo) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.UpdateStock(claims.Username, si)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) DeleteStock(token string, code string) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.DeleteStock(claims.Username, code)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(true)
 }
 
-func (s *StockApi) UpdateStock(si *stock.StockInfo) *Result {
-	err := s.ss.UpdateStock(si)
+// RenameStock 更改股票编码，原编码保留为别名
+func (s *StockApi) RenameStock(token string, from string, to string) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.RenameStock(claims.Username, from, to)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(true)
 }
 
-func (s *StockApi) DeleteStock(code string) *Result {
-	err := s.ss.DeleteStock(code)
+// MergeStock 按换股比例将股票合并到另一只股票
+func (s *StockApi) MergeStock(token string, from string, to string, ratio decimal.Decimal) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.MergeStock(claims.Username, from, to, ratio)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(true)
 }
 
+func (s *StockApi) GetStockAliases() *Result {
+	aliases, err := s.ss.GetStockAliases()
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(aliases)
+}
+
+func (s *StockApi) GetInstrumentSpecs() *Result {
+	return Success(stock.InstrumentSpecs())
+}
+
+func (s *StockApi) GetMarketRules() *Result {
+	return Success(stock.MarketRules())
+}
+
+func (s *StockApi) GetHolidays(calendar string) *Result {
+	holidays, err := s.ss.GetHolidays(calendar)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(holidays)
+}
+
+// ImportHolidays 选择休市日文件（每行“日期[,名称]”）导入交易日历
+func (s *StockApi) ImportHolidays(token string, calendar string) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	file, err := runtime.OpenFileDialog(s.ac.WailsContext(), runtime.OpenDialogOptions{
+		Title: "选择休市日文件",
+		Filters: []runtime.FileFilter{{
+			DisplayName: "Holidays (*.csv;*.txt)",
+			Pattern:     "*.csv;*.txt",
+		}},
+	})
+	if err != nil {
+		return Failure(err)
+	}
+	if file == "" {
+		return Success(0)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Failure(err)
+	}
+	count, err := s.ss.ImportHolidays(calendar, data)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(count)
+}
+
+func (s *StockApi) NextTradingDay(calendar string, date string) *Result {
+	day, err := s.ss.NextTradingDay(calendar, date)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(day)
+}
+
+func (s *StockApi) PrevTradingDay(calendar string, date string) *Result {
+	day, err := s.ss.PrevTradingDay(calendar, date)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(day)
+}
+
 func (s *StockApi) GetHolding(code string) *Result {
 	invest, err := s.ss.GetHolding(code)
 	if err != nil {
@@ -145,24 +285,52 @@ func (s *StockApi) GetHolding(code string) *Result {
 	return Success(invest)
 }
 
-func (s *StockApi) AddTransaction(tran *stock.Transaction) *Result {
-	err := s.ss.AddTransaction(tran)
+func (s *StockApi) AddTransaction(token string, tran *stock.Transaction) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.AddTransaction(claims.Username, tran)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(true)
 }
 
-func (s *StockApi) UpdateTransaction(tran *stock.Transaction) *Result {
-	err := s.ss.UpdateTransaction(tran)
+func (s *StockApi) AddTransactions(token string, trans []stock.Transaction) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	batch, err := s.ss.AddTransactions(claims.Username, trans)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(batch)
+}
+
+func (s *StockApi) UpdateTransaction(token string, tran *stock.Transaction) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.UpdateTransaction(claims.Username, tran)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(true)
 }
 
-func (s *StockApi) DeleteTransaction(tranId int64) *Result {
-	err := s.ss.DeleteTransaction(tranId)
+func (s *StockApi) DeleteTransaction(token string, tranId int64) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.DeleteTransaction(claims.Username, tranId)
 	if err != nil {
 		return Failure(err)
 	}
@@ -177,18 +345,495 @@ func (s *StockApi) GetTransactions(investId int64) *Result {
 	return Success(tranArray)
 }
 
+func (s *StockApi) QueryTransactions(c *stock.Criteria, p *stock.Page) *Result {
+	trans, total, err := s.ss.QueryTransactions(c, p)
+	if err != nil {
+		return Failure(err)
+	}
+	return SuccessPage(trans, total)
+}
+
+func (s *StockApi) QueryInvestments(c *stock.Criteria, p *stock.Page) *Result {
+	invests, total, err := s.ss.QueryInvestments(c, p)
+	if err != nil {
+		return Failure(err)
+	}
+	return SuccessPage(invests, total)
+}
+
 func (s *StockApi) GetClearList(cq ClearQuery) *Result {
-	clearList, err := s.ss.GetClearList(cq.StartTime, cq.FinishTime)
+	clearList, err := s.ss.GetClearList(cq.StartTime, cq.FinishTime, cq.Gross)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(clearList)
 }
 
-func (s *StockApi) GetStockClear(stockCode string, startTime string, finishTime string) *Result {
-	cstats, err := s.ss.GetStockClear(stockCode, startTime, finishTime)
+func (s *StockApi) GetStockClear(stockCode string, startTime string, finishTime string, gross bool) *Result {
+	cstats, err := s.ss.GetStockClear(stockCode, startTime, finishTime, gross)
 	if err != nil {
 		return Failure(err)
 	}
 	return Success(cstats)
 }
+
+func (s *StockApi) DeleteInvestment(token string, investId int64) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.DeleteInvestment(claims.Username, investId)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) GetRecycleBin() *Result {
+	bin, err := s.ss.GetRecycleBin()
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(bin)
+}
+
+func (s *StockApi) RestoreDeleted(token string, entity string, entityKey string) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.RestoreDeleted(claims.Username, entity, entityKey)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) PurgeRecycleBin(token string) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	count, err := s.ss.PurgeDeleted(claims.Username, s.ps.GetPreferences().Recycle.RetentionDays)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(count)
+}
+
+func (s *StockApi) GetAuditLogs(entity string, entityKey string) *Result {
+	logs, err := s.ss.GetAuditLogs(entity, entityKey)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(logs)
+}
+
+func (s *StockApi) UndoChange(token string, logId int64) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	err = s.ss.UndoChange(claims.Username, logId)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) GetPlannedOrders(status string) *Result {
+	plans, err := s.ss.GetPlannedOrders(status)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(plans)
+}
+
+func (s *StockApi) AddPlannedOrder(token string, plan *stock.PlannedOrder) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.SavePlannedOrder(plan); err != nil {
+		return Failure(err)
+	}
+	return Success(plan)
+}
+
+func (s *StockApi) UpdatePlannedOrder(token string, plan *stock.PlannedOrder) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.UpdatePlannedOrder(plan); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) ActivatePlannedOrder(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.ActivatePlannedOrder(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) CancelPlannedOrder(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.CancelPlannedOrder(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+// ExecutePlannedOrder 将计划订单转换为一笔或多笔交易
+func (s *StockApi) ExecutePlannedOrder(token string, planId int64, fills []stock.Transaction) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	trans, err := s.ss.ExecutePlannedOrder(claims.Username, planId, fills)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(trans)
+}
+
+func (s *StockApi) GetSlippageReport(planId int64) *Result {
+	report, err := s.ss.GetSlippageReport(planId)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(report)
+}
+
+func (s *StockApi) GetGridPlans(status string) *Result {
+	plans, err := s.ss.GetGridPlans(status)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(plans)
+}
+
+func (s *StockApi) AddGridPlan(token string, plan *stock.GridPlan) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.SaveGridPlan(plan); err != nil {
+		return Failure(err)
+	}
+	return Success(plan)
+}
+
+func (s *StockApi) UpdateGridPlan(token string, plan *stock.GridPlan) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.UpdateGridPlan(plan); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) CloseGridPlan(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.CloseGridPlan(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+// GetGridStatus 网格的持有情况、建议买卖价格和网格收益
+func (s *StockApi) GetGridStatus(id int64) *Result {
+	status, err := s.ss.GetGridStatus(id)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(status)
+}
+
+func (s *StockApi) GetDcaPlans(status string) *Result {
+	plans, err := s.ss.GetDcaPlans(status)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(plans)
+}
+
+func (s *StockApi) AddDcaPlan(token string, plan *stock.DcaPlan) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.SaveDcaPlan(plan); err != nil {
+		return Failure(err)
+	}
+	return Success(plan)
+}
+
+func (s *StockApi) UpdateDcaPlan(token string, plan *stock.DcaPlan) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.UpdateDcaPlan(plan); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) PauseDcaPlan(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.PauseDcaPlan(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) ResumeDcaPlan(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.ResumeDcaPlan(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) EndDcaPlan(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.EndDcaPlan(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+// ScheduleDcaPlans 立即为定投计划生成到期的定投，返回生成的定投数
+func (s *StockApi) ScheduleDcaPlans(token string) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	count, err := s.ss.ScheduleDcaPlans()
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(count)
+}
+
+func (s *StockApi) GetDcaEntries(planId int64, status string) *Result {
+	entries, err := s.ss.GetDcaEntries(planId, status)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(entries)
+}
+
+// ConfirmDcaEntry 按实际成交价格确认定投，生成买入交易
+func (s *StockApi) ConfirmDcaEntry(token string, id int64, fill *stock.Transaction) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	tran, err := s.ss.ConfirmDcaEntry(claims.Username, id, fill)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(tran)
+}
+
+func (s *StockApi) SkipDcaEntry(token string, id int64) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.SkipDcaEntry(id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+// GetDcaStatus 定投计划的投入、数量和收益
+func (s *StockApi) GetDcaStatus(id int64) *Result {
+	status, err := s.ss.GetDcaStatus(id)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(status)
+}
+
+func (s *StockApi) GetDividends(stockCode string) *Result {
+	divs, err := s.ss.GetDividends(stockCode)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(divs)
+}
+
+// RecordDividend 登记现金分红，再投资价格大于 0 时同时生成再投资的买入交易
+func (s *StockApi) RecordDividend(token string, d *stock.Dividend) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.RecordDividend(claims.Username, d); err != nil {
+		return Failure(err)
+	}
+	return Success(d)
+}
+
+func (s *StockApi) DeleteDividend(token string, id int64) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.DeleteDividend(claims.Username, id); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+func (s *StockApi) GetPortfolios() *Result {
+	ps, err := s.ss.GetPortfolios()
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(ps)
+}
+
+func (s *StockApi) AddPortfolio(token string, p *stock.Portfolio) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.SavePortfolio(p); err != nil {
+		return Failure(err)
+	}
+	return Success(p)
+}
+
+func (s *StockApi) UpdatePortfolio(token string, p *stock.Portfolio) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	if err := s.ss.UpdatePortfolio(p); err != nil {
+		return Failure(err)
+	}
+	return Success(true)
+}
+
+// ComparePortfolios 对比同一期间实盘和模拟组合的表现
+func (s *StockApi) ComparePortfolios(startTime string, finishTime string, gross bool) *Result {
+	stats, err := s.ss.ComparePortfolios(startTime, finishTime, gross)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(stats)
+}
+
+// ImportPrices 选择行情文件（CSV，首行为表头）导入股票的日线行情
+func (s *StockApi) ImportPrices(token string, stockCode string) *Result {
+	if _, err := checkToken(token); err != nil {
+		return Failure(err)
+	}
+
+	file, err := runtime.OpenFileDialog(s.ac.WailsContext(), runtime.OpenDialogOptions{
+		Title: "选择行情文件",
+		Filters: []runtime.FileFilter{{
+			DisplayName: "Prices (*.csv)",
+			Pattern:     "*.csv",
+		}},
+	})
+	if err != nil {
+		return Failure(err)
+	}
+	if file == "" {
+		return Success(0)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Failure(err)
+	}
+	count, err := s.ss.ImportPrices(stockCode, data)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(count)
+}
+
+// GetPriceChart 查询日线行情及交易标记，adjust 为复权方式（空、forward、backward）
+func (s *StockApi) GetPriceChart(stockCode string, startDate string, endDate string, adjust string) *Result {
+	chart, err := s.ss.GetPriceChart(stockCode, startDate, endDate, adjust)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(chart)
+}
+
+// GetIndicators 计算技术指标（ma、ema、macd、rsi、boll、atr、vma），参数为空时使用默认参数
+func (s *StockApi) GetIndicators(stockCode string, startDate string, endDate string, adjust string, specs []stock.IndicatorSpec) *Result {
+	result, err := s.ss.GetIndicators(stockCode, startDate, endDate, adjust, specs)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(result)
+}
+
+// RunBacktest 按日线行情回测策略，指定模拟组合时保存回测交易
+func (s *StockApi) RunBacktest(token string, cfg *stock.BacktestConfig) *Result {
+	claims, err := checkToken(token)
+	if err != nil {
+		return Failure(err)
+	}
+
+	result, err := s.ss.RunBacktest(claims.Username, cfg)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(result)
+}
+
+// GetRoundTrips 识别投资中的做T，window 为配对的最大间隔交易日数
+func (s *StockApi) GetRoundTrips(investId int64, window int) *Result {
+	stats, err := s.ss.GetRoundTrips(investId, window)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(stats)
+}
+
+func (s *StockApi) GetRoundTripReport(portfolioId int64, startTime string, finishTime string, window int) *Result {
+	report, err := s.ss.GetRoundTripReport(portfolioId, startTime, finishTime, window)
+	if err != nil {
+		return Failure(err)
+	}
+	return Success(report)
+}
@@ -0,0 +1,188 @@
+package stock
+
+import (
+	"context"
+	"encoding/json"
+	"pixiu/backend/pkg/exception"
+	"strconv"
+	"time"
+)
+
+const (
+	EntityStock       = "stock"
+	EntityInvestment  = "investment"
+	EntityTransaction = "transaction"
+	EntityDividend    = "dividend"
+
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+	ActionRecode  = "recode" // 股票改名或合并
+)
+
+func idKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// audit 追加一条审计日志，before/after 为 nil 表示实体不存在
+func (ss StockService) audit(ctx context.Context, operator string, entity string, key string, action string, before any, after any) error {
+	return ss.appendAudit(ctx, &AuditLog{Entity: entity, EntityKey: key, Action: action, Operator: operator}, before, after)
+}
+
+// auditDerived 追加一条重建持仓产生的投资变更日志，operator 为引起重建的操作人
+func (ss StockService) auditDerived(ctx context.Context, operator string, investId int64, action string, before any, after any) error {
+	return ss.appendAudit(ctx, &AuditLog{Entity: EntityInvestment, EntityKey: idKey(investId), Action: action, Operator: operator, Derived: true}, before, after)
+}
+
+func (ss StockService) appendAudit(ctx context.Context, log *AuditLog, before any, after any) error {
+	log.CreatedAt = time.Now()
+	if before != nil {
+		b, err := json.Marshal(before)
+		if err != nil {
+			return exception.WrapService(500, "audit marshal error", err)
+		}
+		log.Before = string(b)
+	}
+	if after != nil {
+		b, err := json.Marshal(after)
+		if err != nil {
+			return exception.WrapService(500, "audit marshal error", err)
+		}
+		log.After = string(b)
+	}
+	if err := ss.sr.CreateAuditLog(ctx, log); err != nil {
+		return exception.WrapService(500, "create audit log error", err)
+	}
+	return nil
+}
+
+func (ss StockService) GetAuditLogs(entity string, entityKey string) (*[]AuditLog, error) {
+	if entity == "" {
+		return nil, exception.NewBusiness(400, "entity is required")
+	}
+	return ss.sr.GetAuditLogs(ss.gtm.Context(), entity, entityKey)
+}
+
+// UndoChange 撤销一次变更，只允许撤销实体的最近一次变更，撤销本身也会记录审计日志
+func (ss StockService) UndoChange(operator string, logId int64) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		log, err := ss.sr.GetAuditLog(ctx, logId)
+		if err != nil {
+			return err
+		}
+		if log.Reverted {
+			return exception.NewBusiness(400, "change is already reverted")
+		}
+		if log.Derived {
+			return exception.NewBusiness(400, "investment is computed from transactions, undo the transaction instead")
+		}
+		if log.Action == ActionPurge {
+			return exception.NewBusiness(400, "purged data can not be restored")
+		}
+		if log.Action == ActionRecode {
+			return exception.NewBusiness(400, "stock code change can not be undone")
+		}
+
+		// 重建持仓产生的变更不影响撤销实体最近一次的变更
+		logs, err := ss.sr.GetAuditLogs(ctx, log.Entity, log.EntityKey)
+		if err != nil {
+			return err
+		}
+		for _, l := range *logs {
+			if l.Derived {
+				continue
+			}
+			if l.ID != log.ID {
+				return exception.NewBusiness(400, "only the latest change can be undone")
+			}
+			break
+		}
+
+		switch log.Entity {
+		case EntityStock:
+			err = ss.undoStock(ctx, operator, log)
+		case EntityTransaction:
+			err = ss.undoTransaction(ctx, operator, log)
+		case EntityInvestment:
+			err = ss.undoInvestment(ctx, operator, log)
+		case EntityDividend:
+			err = exception.NewBusiness(400, "dividend changes can not be undone, record or delete the dividend instead")
+		default:
+			err = exception.NewBusiness(400, "unknown audit entity: "+log.Entity)
+		}
+		if err != nil {
+			return err
+		}
+
+		return ss.sr.RevertAuditLog(ctx, log.ID)
+	})
+}
+
+func (ss StockService) undoStock(ctx context.Context, operator string, log *AuditLog) error {
+	current, err := ss.sr.GetStock(ctx, log.EntityKey)
+	if err != nil {
+		return err
+	}
+	before := *current
+
+	if log.Action == ActionCreate {
+		// 撤销新增：软删除
+		if err := ss.sr.DeleteStock(ctx, current.Code); err != nil {
+			return err
+		}
+		current.Status = -1
+		return ss.audit(ctx, operator, EntityStock, current.Code, ActionDelete, &before, current)
+	}
+
+	var target StockInfo
+	if err := json.Unmarshal([]byte(log.Before), &target); err != nil {
+		return exception.WrapService(500, "audit unmarshal error", err)
+	}
+	target.UpdatedAt = time.Now()
+	if err := ss.sr.UpdateStock(ctx, &target); err != nil {
+		return err
+	}
+	if err := ss.audit(ctx, operator, EntityStock, target.Code, ActionUpdate, &before, &target); err != nil {
+		return err
+	}
+	if before.Type != target.Type || before.Market != target.Market {
+		return ss.rebuildStock(ctx, operator, target.Code)
+	}
+	return nil
+}
+
+func (ss StockService) undoInvestment(ctx context.Context, operator string, log *AuditLog) error {
+	id, err := strconv.ParseInt(log.EntityKey, 10, 64)
+	if err != nil {
+		return exception.WrapService(500, "invalid audit entity key", err)
+	}
+	switch log.Action {
+	case ActionDelete:
+		return ss.restoreInvestment(ctx, operator, id)
+	case ActionRestore:
+		return ss.deleteInvestment(ctx, operator, id)
+	}
+	return exception.NewBusiness(400, "investment is computed from transactions, undo the transaction instead")
+}
+
+func (ss StockService) undoTransaction(ctx context.Context, operator string, log *AuditLog) error {
+	id, err := strconv.ParseInt(log.EntityKey, 10, 64)
+	if err != nil {
+		return exception.WrapService(500, "invalid audit entity key", err)
+	}
+	switch log.Action {
+	case ActionCreate, ActionRestore:
+		return ss.deleteTransaction(ctx, operator, id)
+	case ActionDelete:
+		return ss.restoreTransaction(ctx, operator, id)
+	case ActionUpdate:
+		var target Transaction
+		if err := json.Unmarshal([]byte(log.Before), &target); err != nil {
+			return exception.WrapService(500, "audit unmarshal error", err)
+		}
+		return ss.updateTransaction(ctx, operator, &target)
+	}
+	return exception.NewBusiness(400, "unknown audit action: "+log.Action)
+}
@@ -0,0 +1,84 @@
+package stock
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestUndoAfterRebuild(t *testing.T) {
+	ss, repo := newTestService(t, "600000")
+	steps := []Transaction{
+		{StockCode: "600000", Action: 1, Price: 10, Quantity: qty("100"), FinishTime: "2025-06-03 10:00:00"},
+		{StockCode: "600000", Action: -1, Price: 11, Quantity: qty("100"), FinishTime: "2025-06-05 10:00:00"},
+		{StockCode: "600000", Action: 1, Price: 9, Quantity: qty("200"), FinishTime: "2025-06-09 10:00:00"},
+		// 插入到清仓之前，两笔投资合并，第 3 笔交易改归第一笔投资
+		{StockCode: "600000", Action: 1, Price: 12, Quantity: qty("100"), FinishTime: "2025-06-04 10:00:00"},
+	}
+	for i := range steps {
+		if err := ss.AddTransaction("test", &steps[i]); err != nil {
+			t.Fatalf("step %d: %v", i+1, err)
+		}
+	}
+	// 交易只有新增的日志，投资的变更都是派生的日志
+	derived := 0
+	for _, log := range repo.logs {
+		if log.Entity == EntityInvestment && log.Derived {
+			derived++
+		} else if log.Entity != EntityTransaction || log.Action != ActionCreate || log.Derived {
+			t.Errorf("got %s %s log for %s, want only transaction creates and derived investment changes", log.Entity, log.Action, log.EntityKey)
+		}
+	}
+	if derived == 0 {
+		t.Fatal("got no derived investment logs")
+	}
+	last := repo.logs[len(repo.logs)-1]
+	if err := ss.UndoChange("test", last.ID); err == nil || !strings.Contains(err.Error(), "undo the transaction instead") {
+		t.Fatalf("got error %v undoing a derived log, want it rejected", err)
+	}
+
+	// 撤销被重建改变了投资归属的交易
+	logs, err := repo.GetAuditLogs(context.Background(), EntityTransaction, idKey(steps[2].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*logs) != 1 {
+		t.Fatalf("got %d logs for transaction %d, want 1", len(*logs), steps[2].ID)
+	}
+	if err := ss.UndoChange("test", (*logs)[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	invests := openInvestments(t, repo, "600000")
+	if len(invests) != 1 || !invests[0].Quantity.Equal(qty("100")) {
+		t.Fatalf("got investments %+v, want one holding 100", invests)
+	}
+}
+
+func TestUndoStockRebuild(t *testing.T) {
+	ss, repo := newTestService(t)
+	repo.stocks["600000"] = StockInfo{Code: "600000", Name: "浦发银行", Market: MarketA, Type: InstrumentStock}
+	tran := &Transaction{StockCode: "600000", Action: 1, Price: 10, Quantity: qty("1000"), FinishTime: "2025-06-03 10:00:00"}
+	if err := ss.AddTransaction("test", tran); err != nil {
+		t.Fatal(err)
+	}
+	breakEven := openInvestments(t, repo, "600000")[0].BreakEven
+
+	// 改为 ETF 后卖出不收印花税，保本价降低；撤销后按股票的规则重建
+	if err := ss.UpdateStock("test", &StockInfo{Code: "600000", Name: "浦发银行", Market: MarketA, Type: InstrumentETF}); err != nil {
+		t.Fatal(err)
+	}
+	if got := openInvestments(t, repo, "600000")[0].BreakEven; got >= breakEven {
+		t.Fatalf("got break even %v as etf, want below %v", got, breakEven)
+	}
+	logs, err := repo.GetAuditLogs(context.Background(), EntityStock, "600000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.UndoChange("test", (*logs)[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := openInvestments(t, repo, "600000")[0].BreakEven; got != breakEven {
+		t.Fatalf("got break even %v after undo, want %v", got, breakEven)
+	}
+}
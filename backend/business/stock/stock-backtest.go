@@ -0,0 +1,359 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"pixiu/backend/pkg/exception"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	RuleCrossAbove = "cross_above" // 收盘价上穿指标线
+	RuleCrossBelow = "cross_below" // 收盘价下穿指标线
+	RuleStopLoss   = "stop_loss"   // 收盘价较买入价下跌达到比例（%）
+	RuleTakeProfit = "take_profit" // 收盘价较买入价上涨达到比例（%）
+)
+
+// 回测规则，穿越规则使用指标的第一条线（如 MA20）
+type BacktestRule struct {
+	Kind      string        `json:"kind"`      // 规则类型
+	Indicator IndicatorSpec `json:"indicator"` // 指标（穿越规则）
+	Value     float64       `json:"value"`     // 比例（%，止损、止盈规则）
+}
+
+// 回测配置：每个交易日按收盘价判断规则并成交，空仓时任一买入规则触发即买入，持仓时任一卖出规则触发即卖出全部持仓
+type BacktestConfig struct {
+	StockCode   string         `json:"stockCode"`   // 股票编码
+	StartDate   string         `json:"startDate"`   // 开始日期（yyyy-MM-dd）
+	EndDate     string         `json:"endDate"`     // 结束日期
+	Adjust      string         `json:"adjust"`      // 复权方式
+	InitialCash float64        `json:"initialCash"` // 初始资金
+	PositionPct float64        `json:"positionPct"` // 每次买入使用资金的比例（%），默认 100
+	BuyRules    []BacktestRule `json:"buyRules"`    // 买入规则
+	SellRules   []BacktestRule `json:"sellRules"`   // 卖出规则
+	PortfolioID int64          `json:"portfolioId"` // 保存回测交易的模拟组合，0 表示不保存
+	Gross       bool           `json:"gross"`       // 清仓统计是否按毛盈亏计算
+}
+
+// 资金曲线上的一天
+type EquityPoint struct {
+	Date     string          `json:"date"`
+	Close    float64         `json:"close"`    // 收盘价
+	Cash     float64         `json:"cash"`     // 资金余额
+	Quantity decimal.Decimal `json:"quantity"` // 持仓数量
+	Equity   float64         `json:"equity"`   // 总资产（资金余额加持仓市值）
+	Drawdown float64         `json:"drawdown"` // 较此前最高总资产的回撤（%）
+}
+
+type BacktestResult struct {
+	Config          BacktestConfig `json:"config"`
+	Transactions    []Transaction  `json:"transactions"`    // 模拟交易
+	Investments     []Investment   `json:"investments"`     // 按模拟交易计算的投资
+	Equity          []EquityPoint  `json:"equity"`          // 资金曲线
+	Stats           ClearStats     `json:"stats"`           // 清仓统计（与实盘清仓统计口径相同）
+	FinalEquity     float64        `json:"finalEquity"`     // 期末总资产
+	TotalReturn     float64        `json:"totalReturn"`     // 总收益率（%）
+	MaxDrawdown     float64        `json:"maxDrawdown"`     // 最大回撤（%）
+	BenchmarkReturn float64        `json:"benchmarkReturn"` // 同期持有不动的收益率（%）
+}
+
+// RunBacktest 按日线行情回放策略，成交使用与实盘相同的品种费用规则和市场每手数量规则；
+// 指定了模拟组合时，模拟交易作为回测交易通过新增交易的逻辑保存到组合中（按行情价格成交，不校验价位和成交日期）
+func (ss StockService) RunBacktest(operator string, cfg *BacktestConfig) (*BacktestResult, error) {
+	if err := validateBacktest(cfg); err != nil {
+		return nil, err
+	}
+	result, err := ss.backtest(ss.gtm.Context(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PortfolioID == 0 {
+		return result, nil
+	}
+
+	err = ss.gtm.Execute(func(ctx context.Context) error {
+		p, err := ss.sr.GetPortfolio(ctx, cfg.PortfolioID)
+		if err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "portfolio not found", err)
+			}
+			return err
+		}
+		if !p.Simulated {
+			return exception.NewBusiness(400, "backtest can only be saved to a simulated portfolio")
+		}
+		for i := range result.Transactions {
+			if err := ss.addTransaction(ctx, operator, &result.Transactions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func validateBacktest(cfg *BacktestConfig) error {
+	if cfg.StockCode == "" {
+		return exception.NewBusiness(400, "stock code is empty")
+	}
+	if cfg.InitialCash <= 0 {
+		return exception.NewBusiness(400, "initial cash must be positive")
+	}
+	if cfg.PositionPct == 0 {
+		cfg.PositionPct = 100
+	}
+	if cfg.PositionPct < 0 || cfg.PositionPct > 100 {
+		return exception.NewBusiness(400, "position percent must be between 0 and 100")
+	}
+	if len(cfg.BuyRules) == 0 || len(cfg.SellRules) == 0 {
+		return exception.NewBusiness(400, "buy rules and sell rules are required")
+	}
+	for _, rule := range append(append([]BacktestRule{}, cfg.BuyRules...), cfg.SellRules...) {
+		switch rule.Kind {
+		case RuleCrossAbove, RuleCrossBelow:
+		case RuleStopLoss, RuleTakeProfit:
+			if rule.Value <= 0 {
+				return exception.NewBusiness(400, fmt.Sprintf("%s percent must be positive", rule.Kind))
+			}
+		default:
+			return exception.NewBusiness(400, "unknown backtest rule: "+rule.Kind)
+		}
+	}
+	for _, rule := range cfg.BuyRules {
+		if rule.Kind == RuleStopLoss || rule.Kind == RuleTakeProfit {
+			return exception.NewBusiness(400, rule.Kind+" can only be a sell rule")
+		}
+	}
+	return nil
+}
+
+// 回测过程中的规则判断
+type backtestSignal struct {
+	rule BacktestRule
+	line []float64 // 穿越规则的指标线
+}
+
+func (bs *backtestSignal) triggered(closes []float64, i int, entry float64) bool {
+	switch bs.rule.Kind {
+	case RuleCrossAbove:
+		return i > 0 && !math.IsNaN(bs.line[i-1]) && !math.IsNaN(bs.line[i]) && closes[i-1] <= bs.line[i-1] && closes[i] > bs.line[i]
+	case RuleCrossBelow:
+		return i > 0 && !math.IsNaN(bs.line[i-1]) && !math.IsNaN(bs.line[i]) && closes[i-1] >= bs.line[i-1] && closes[i] < bs.line[i]
+	case RuleStopLoss:
+		return closes[i] <= entry*(1-bs.rule.Value/100)
+	case RuleTakeProfit:
+		return closes[i] >= entry*(1+bs.rule.Value/100)
+	}
+	return false
+}
+
+func (ss StockService) backtest(ctx context.Context, cfg *BacktestConfig) (*BacktestResult, error) {
+	si, err := ss.sr.GetStock(ctx, cfg.StockCode)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, exception.WrapBusiness(404, "stock not found", err)
+		}
+		return nil, err
+	}
+	spec, err := stockSpec(si)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return nil, err
+	}
+	// 包含开始日期之前的行情，开始日期的指标值不受回测范围影响
+	bars, err := ss.priceBars(ctx, cfg.StockCode, "", cfg.EndDate, cfg.Adjust)
+	if err != nil {
+		return nil, err
+	}
+	from := 0
+	for from < len(bars.adjusted) && bars.adjusted[from].Date < cfg.StartDate {
+		from++
+	}
+	if from == len(bars.adjusted) {
+		return nil, exception.NewBusiness(400, "no prices in the backtest period")
+	}
+
+	closes := make([]float64, len(bars.adjusted))
+	for i, bar := range bars.adjusted {
+		closes[i] = bar.Close
+	}
+	signals := func(rules []BacktestRule) ([]backtestSignal, error) {
+		result := make([]backtestSignal, len(rules))
+		for i, rule := range rules {
+			result[i].rule = rule
+			if rule.Kind == RuleCrossAbove || rule.Kind == RuleCrossBelow {
+				lines, err := CalcIndicator(bars.adjusted, rule.Indicator)
+				if err != nil {
+					return nil, err
+				}
+				result[i].line = lines[0].Values
+			}
+		}
+		return result, nil
+	}
+	buySignals, err := signals(cfg.BuyRules)
+	if err != nil {
+		return nil, err
+	}
+	sellSignals, err := signals(cfg.SellRules)
+	if err != nil {
+		return nil, err
+	}
+
+	bt := &backtester{cfg: cfg, si: si, spec: spec, rule: GetMarketRule(si.Market), tc: tc, cash: decimal.NewFromFloat(cfg.InitialCash)}
+	peak := cfg.InitialCash
+	result := &BacktestResult{Config: *cfg, Transactions: []Transaction{}, Equity: make([]EquityPoint, 0, len(closes)-from)}
+	for i := from; i < len(closes); i++ {
+		date := bars.adjusted[i].Date
+		price := decimal.NewFromFloat(closes[i]).Round(int32(spec.PricePrecision)).InexactFloat64()
+		// 每天只判断一次，买入当天不会卖出（满足 T+1）
+		if bt.quantity.IsZero() {
+			for j := range buySignals {
+				if buySignals[j].triggered(closes, i, bt.entry) {
+					if tran := bt.buy(date, price); tran != nil {
+						result.Transactions = append(result.Transactions, *tran)
+					}
+					break
+				}
+			}
+		} else {
+			for j := range sellSignals {
+				if sellSignals[j].triggered(closes, i, bt.entry) {
+					result.Transactions = append(result.Transactions, *bt.sell(date, price))
+					break
+				}
+			}
+		}
+
+		equity := bt.cash.Add(decimal.NewFromFloat(closes[i]).Mul(bt.quantity)).RoundBank(2).InexactFloat64()
+		peak = max(peak, equity)
+		result.Equity = append(result.Equity, EquityPoint{
+			Date:     date,
+			Close:    closes[i],
+			Cash:     bt.cash.RoundBank(2).InexactFloat64(),
+			Quantity: bt.quantity,
+			Equity:   equity,
+			Drawdown: round2Decimal((peak - equity) / peak * 100),
+		})
+		result.MaxDrawdown = max(result.MaxDrawdown, result.Equity[len(result.Equity)-1].Drawdown)
+	}
+
+	last := result.Equity[len(result.Equity)-1]
+	result.FinalEquity = last.Equity
+	result.TotalReturn = round2Decimal((last.Equity - cfg.InitialCash) / cfg.InitialCash * 100)
+	result.BenchmarkReturn = round2Decimal((closes[len(closes)-1] - closes[from]) / closes[from] * 100)
+	if err := bt.summarize(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 回测的资金和持仓
+type backtester struct {
+	cfg      *BacktestConfig
+	si       *StockInfo
+	spec     *InstrumentSpec
+	rule     *MarketRule
+	tc       *TradingCalendar
+	cash     decimal.Decimal
+	quantity decimal.Decimal
+	entry    float64 // 买入价
+}
+
+// buy 按资金比例买入，数量符合品种数量精度、数量单位和市场每手数量，资金不足以支付金额和税费时减少数量
+func (bt *backtester) buy(date string, price float64) *Transaction {
+	budget := bt.cash.Mul(decimal.NewFromFloat(bt.cfg.PositionPct / 100))
+	perUnit := decimal.NewFromFloat(price).Mul(decimal.NewFromFloat(1 + bt.spec.Fee.Rate))
+	quantity := budget.Div(perUnit).Truncate(int32(bt.spec.QuantityPrecision))
+
+	step := decimal.New(1, -int32(bt.spec.QuantityPrecision))
+	minimum := decimal.Zero
+	if bt.spec.QuantityUnit > 1 {
+		step = decimal.NewFromInt(int64(bt.spec.QuantityUnit))
+	}
+	if bt.rule != nil && bt.rule.applies(bt.spec) {
+		if lotMin, lotStep, _ := bt.rule.LotRule(bt.si); lotMin > 0 && lotStep > 0 {
+			minimum = decimal.NewFromInt(int64(lotMin))
+			step = decimal.NewFromInt(int64(lotStep))
+		}
+	}
+	if quantity.LessThan(minimum) {
+		return nil
+	}
+	quantity = quantity.Sub(quantity.Sub(minimum).Mod(step))
+
+	for !quantity.LessThan(minimum) && quantity.IsPositive() {
+		amount := floatMulDecimal(price, quantity)
+		fee := bt.spec.Fee.EstimateFee(1, amount)
+		cost := decimal.NewFromFloat(amount).Add(decimal.NewFromFloat(fee))
+		if !cost.GreaterThan(bt.cash) {
+			bt.cash = bt.cash.Sub(cost)
+			bt.quantity = quantity
+			bt.entry = price
+			return bt.transaction(1, date, price, quantity, amount, fee)
+		}
+		quantity = quantity.Sub(step)
+	}
+	return nil
+}
+
+// sell 卖出全部持仓
+func (bt *backtester) sell(date string, price float64) *Transaction {
+	quantity := bt.quantity
+	amount := floatMulDecimal(price, quantity)
+	fee := bt.spec.Fee.EstimateFee(-1, amount)
+	bt.cash = bt.cash.Add(decimal.NewFromFloat(amount)).Sub(decimal.NewFromFloat(fee))
+	bt.quantity = decimal.Zero
+	bt.entry = 0
+	return bt.transaction(-1, date, price, quantity, amount, fee)
+}
+
+func (bt *backtester) transaction(action int8, date string, price float64, quantity decimal.Decimal, amount float64, fee float64) *Transaction {
+	// 按收盘价成交，成交时间为市场的收盘时间
+	finishTime := date + marketCloseTime(bt.si)
+	finishAt, _ := time.ParseInLocation(DateTimeLayout, finishTime, bt.tc.Location())
+	return &Transaction{
+		PortfolioID: bt.cfg.PortfolioID,
+		StockCode:   bt.si.Code,
+		Action:      action,
+		Price:       price,
+		Quantity:    quantity,
+		Amount:      amount,
+		TaxFee:      fee,
+		FinishTime:  finishTime,
+		FinishAt:    finishAt.UTC(),
+		SettleDate:  bt.spec.settleDate(finishTime, bt.tc),
+		Backtest:    true,
+	}
+}
+
+// summarize 按模拟交易计算投资和清仓统计
+func (bt *backtester) summarize(result *BacktestResult) error {
+	positions, err := splitPositions(result.Transactions)
+	if err != nil {
+		return err
+	}
+	result.Investments = make([]Investment, 0, len(positions))
+	stats := ClearStats{StockCode: bt.si.Code, StockName: bt.si.Name, Gross: bt.cfg.Gross, StartTime: bt.cfg.StartDate, FinishTime: bt.cfg.EndDate}
+	for _, position := range positions {
+		invest := Investment{PortfolioID: bt.cfg.PortfolioID, StockCode: bt.si.Code}
+		calcHolding(&invest, position, bt.spec)
+		fillHoldingDays(&invest, bt.tc)
+		result.Investments = append(result.Investments, invest)
+		if invest.Status == 1 {
+			stats.add(&invest)
+		}
+	}
+	stats.round()
+	result.Stats = stats
+	return nil
+}
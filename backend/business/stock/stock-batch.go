@@ -0,0 +1,209 @@
+package stock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+const maxBatchSize = 1000
+
+// 批量中存在无效行，回滚已保存的交易
+var errInvalidBatch = errors.New("batch has invalid transactions")
+
+// AddTransactions 在一个数据库事务中批量新增交易：按成交时间逐行校验并保存，全部行保存后再按持仓和组合校验整批，
+// 错误报告在导致错误的行上；任意一行无效时整批不保存，返回每一行的结果以便修正后重新提交
+func (ss StockService) AddTransactions(operator string, trans []Transaction) (*TransactionBatch, error) {
+	if len(trans) == 0 {
+		return nil, exception.NewBusiness(400, "no transactions to add")
+	}
+	if len(trans) > maxBatchSize {
+		return nil, exception.NewBusiness(400, fmt.Sprintf("batch size can not exceed %d", maxBatchSize))
+	}
+	batch := &TransactionBatch{Total: len(trans), Results: make([]TransactionResult, len(trans))}
+	err := ss.gtm.Execute(func(ctx context.Context) error {
+		return ss.addTransactions(ctx, operator, trans, batch)
+	})
+	if err != nil {
+		// 已回滚，清除保存时生成的标识
+		for i := range trans {
+			trans[i].ID, trans[i].InvestID = 0, 0
+		}
+	}
+	if errors.Is(err, errInvalidBatch) {
+		return batch, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	batch.Saved = true
+	return batch, nil
+}
+
+func (ss StockService) addTransactions(ctx context.Context, operator string, trans []Transaction, batch *TransactionBatch) error {
+	// 按成交时间保存，每一行都按成交时间在它之前的行校验持仓和 T+1，未填成交时间（当前时间）的行最后保存
+	order := make([]int, len(trans))
+	for i := range trans {
+		order[i] = i
+		trans[i].Backtest = false
+		batch.Results[i] = TransactionResult{Index: i, Transaction: &trans[i]}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ta, tb := trans[order[a]].FinishTime, trans[order[b]].FinishTime
+		return ta != "" && (tb == "" || ta < tb)
+	})
+
+	var keys []holdingKey
+	var portfolioIds []int64
+	holdings := make(map[holdingKey]bool)
+	portfolios := make(map[int64]bool)
+	rows := make(map[int64]int) // 交易标识对应的行号
+	for _, i := range order {
+		tran := &trans[i]
+		if err := ss.insertTransaction(ctx, operator, tran); err != nil {
+			if !isBusiness(err) {
+				return err
+			}
+			batch.fail([]int{i}, err)
+			continue
+		}
+		rows[tran.ID] = i
+		key := holdingKey{tran.PortfolioID, tran.StockCode}
+		if !holdings[key] {
+			holdings[key] = true
+			keys = append(keys, key)
+		}
+		if !portfolios[tran.PortfolioID] {
+			portfolios[tran.PortfolioID] = true
+			portfolioIds = append(portfolioIds, tran.PortfolioID)
+		}
+	}
+
+	// 重建持仓之前校验整批：卖出数量不能超过持仓，模拟组合的资金余额不能为负
+	for _, key := range keys {
+		if err := ss.checkBatchHolding(ctx, key, rows, batch); err != nil {
+			return err
+		}
+	}
+	for _, portfolioId := range portfolioIds {
+		if err := ss.checkBatchCash(ctx, portfolioId, rows, batch); err != nil {
+			return err
+		}
+	}
+	if batch.Failed > 0 {
+		return errInvalidBatch
+	}
+
+	// 每个持仓只重建一次
+	for _, key := range keys {
+		if err := ss.rebuildHolding(ctx, operator, key.portfolioId, key.stockCode); err != nil {
+			return err
+		}
+	}
+	for i := range trans {
+		created, err := ss.sr.GetTransaction(ctx, trans[i].ID)
+		if err != nil {
+			return err
+		}
+		trans[i].InvestID = created.InvestID
+	}
+	return nil
+}
+
+// checkBatchHolding 按成交时间累计持仓数量，卖出超过持仓时报告导致超出的行：批量中的卖出报告该行，
+// 已有的卖出报告批量中在它之前最近的卖出。无效的行不计入持仓，继续校验后面的交易
+func (ss StockService) checkBatchHolding(ctx context.Context, key holdingKey, rows map[int64]int, batch *TransactionBatch) error {
+	trans, err := ss.sr.GetStockTransactions(ctx, key.portfolioId, key.stockCode)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	running := decimal.Zero
+	var sells []Transaction // 已计入持仓的批量卖出
+	for _, t := range *trans {
+		row, ok := rows[t.ID]
+		if ok && batch.Results[row].Error != "" {
+			continue
+		}
+		running = running.Add(signedQuantity(t))
+		if !running.IsNegative() {
+			if ok && t.Action == -1 {
+				sells = append(sells, t)
+			}
+			continue
+		}
+		err := exception.NewBusiness(400, fmt.Sprintf("sell quantity exceeds holding at %s", t.FinishTime))
+		if ok {
+			batch.fail([]int{row}, err)
+			running = running.Sub(signedQuantity(t))
+			continue
+		}
+		for running.IsNegative() && len(sells) > 0 {
+			last := sells[len(sells)-1]
+			sells = sells[:len(sells)-1]
+			batch.fail([]int{rows[last.ID]}, err)
+			running = running.Sub(signedQuantity(last))
+		}
+	}
+	return nil
+}
+
+// checkBatchCash 模拟组合按时间累计的资金余额不能为负，余额为负时报告导致不足的行：批量中的交易报告该行，
+// 已有的交易或分红报告批量中在它之前最近的支出。无效的行不计入余额
+func (ss StockService) checkBatchCash(ctx context.Context, portfolioId int64, rows map[int64]int, batch *TransactionBatch) error {
+	if portfolioId == 0 {
+		return nil
+	}
+	p, err := ss.sr.GetPortfolio(ctx, portfolioId)
+	if err != nil {
+		return err
+	}
+	if !p.Simulated {
+		return nil
+	}
+	events, err := ss.cashEvents(ctx, portfolioId)
+	if err != nil {
+		return err
+	}
+	cash := decimal.NewFromFloat(p.InitialCash)
+	var spends []cashEvent // 已计入余额的批量支出
+	for _, e := range events {
+		row, ok := rows[e.tranId]
+		if ok && batch.Results[row].Error != "" {
+			continue
+		}
+		cash = cash.Add(e.flow)
+		if !cash.IsNegative() {
+			if ok && e.flow.IsNegative() {
+				spends = append(spends, e)
+			}
+			continue
+		}
+		err := exception.NewBusiness(400, fmt.Sprintf("insufficient cash in portfolio %s at %s, short of %s", p.Name, e.time, cash.Neg().StringFixed(2)))
+		if ok {
+			batch.fail([]int{row}, err)
+			cash = cash.Sub(e.flow)
+			continue
+		}
+		for cash.IsNegative() && len(spends) > 0 {
+			last := spends[len(spends)-1]
+			spends = spends[:len(spends)-1]
+			batch.fail([]int{rows[last.tranId]}, err)
+			cash = cash.Sub(last.flow)
+		}
+	}
+	return nil
+}
+
+// fail 将行标记为无效，已无效的行保留最先发现的原因
+func (tb *TransactionBatch) fail(indexes []int, err error) {
+	for _, i := range indexes {
+		if tb.Results[i].Error == "" {
+			tb.Failed++
+			tb.Results[i].Error = err.Error()
+		}
+	}
+}
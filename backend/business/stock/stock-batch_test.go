@@ -0,0 +1,138 @@
+package stock
+
+import (
+	"strings"
+	"testing"
+)
+
+// 批量中的一行交易：买入（1）或卖出（-1）
+type batchRow struct {
+	action   int8
+	quantity string
+	price    float64
+	time     string
+}
+
+func (r batchRow) transaction(portfolioId int64) Transaction {
+	return Transaction{PortfolioID: portfolioId, StockCode: "600000", Action: r.action, Price: r.price, Quantity: qty(r.quantity), FinishTime: r.time}
+}
+
+func TestAddTransactions(t *testing.T) {
+	cases := []struct {
+		name     string
+		cash     float64 // 大于 0 时交易属于该初始资金的模拟组合
+		existing []batchRow
+		rows     []batchRow
+		errs     map[int]string // 无效的行和错误，为空时整批保存
+	}{
+		{
+			name: "rows out of order are saved by finish time",
+			rows: []batchRow{
+				{-1, "100", 11, "2025-06-04 10:00:00"},
+				{1, "100", 10, "2025-06-03 10:00:00"},
+				{1, "200", 12, "2025-06-05 10:00:00"},
+			},
+		},
+		{
+			name: "mixed valid and invalid rows",
+			rows: []batchRow{
+				{1, "100", 10, "2025-06-03 10:00:00"},
+				{1, "100", 0, "2025-06-03 11:00:00"},
+				{-1, "300", 11, "2025-06-05 10:00:00"},
+				{1, "100", 11, "2025-06-04 10:00:00"},
+				{-1, "100", 12, "2025-06-06 10:00:00"},
+			},
+			errs: map[int]string{1: "price must be positive", 2: "sell quantity exceeds holding at 2025-06-05 10:00:00"},
+		},
+		{
+			name:     "sell before an existing sell",
+			existing: []batchRow{{1, "100", 10, "2025-06-03 10:00:00"}, {-1, "100", 11, "2025-06-06 10:00:00"}},
+			rows: []batchRow{
+				{-1, "100", 11, "2025-06-05 10:00:00"},
+				{1, "100", 10, "2025-06-09 10:00:00"},
+			},
+			errs: map[int]string{0: "sell quantity exceeds holding at 2025-06-06 10:00:00"},
+		},
+		{
+			name: "sell the same day as a buy listed later",
+			rows: []batchRow{
+				{-1, "100", 11, "2025-06-04 14:00:00"},
+				{1, "100", 10, "2025-06-04 10:00:00"},
+				{1, "100", 10, "2025-06-05 10:00:00"},
+			},
+			errs: map[int]string{0: "T+1"},
+		},
+		{
+			name: "buy exceeds the cash",
+			cash: 2000,
+			rows: []batchRow{
+				{1, "100", 10, "2025-06-03 10:00:00"},
+				{1, "100", 15, "2025-06-04 10:00:00"},
+			},
+			errs: map[int]string{1: "insufficient cash in portfolio test at 2025-06-04 10:00:00"},
+		},
+		{
+			name:     "buy before an existing buy exceeds the cash",
+			cash:     2000,
+			existing: []batchRow{{1, "100", 9, "2025-06-05 10:00:00"}},
+			rows: []batchRow{
+				{1, "100", 12, "2025-06-04 10:00:00"},
+			},
+			errs: map[int]string{0: "insufficient cash in portfolio test at 2025-06-05 10:00:00"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ss, repo := newTestService(t)
+			repo.stocks["600000"] = StockInfo{Code: "600000", Name: "浦发银行", Market: MarketA, Type: InstrumentStock}
+			var portfolioId int64
+			if c.cash > 0 {
+				portfolioId = repo.id()
+				repo.portfolios[portfolioId] = Portfolio{ID: portfolioId, Name: "test", Simulated: true, InitialCash: c.cash}
+			}
+			for _, row := range c.existing {
+				tran := row.transaction(portfolioId)
+				if err := ss.AddTransaction("test", &tran); err != nil {
+					t.Fatal(err)
+				}
+			}
+			savedTrans, savedLogs := len(repo.trans), len(repo.logs)
+
+			trans := make([]Transaction, len(c.rows))
+			for i, row := range c.rows {
+				trans[i] = row.transaction(portfolioId)
+			}
+			batch, err := ss.AddTransactions("test", trans)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if batch.Saved != (len(c.errs) == 0) || batch.Failed != len(c.errs) {
+				t.Fatalf("got saved %v with %d failed rows, want %d failed rows", batch.Saved, batch.Failed, len(c.errs))
+			}
+			for i, result := range batch.Results {
+				want, invalid := c.errs[i]
+				if invalid && !strings.Contains(result.Error, want) || !invalid && result.Error != "" {
+					t.Errorf("row %d: got error %q, want %q", i, result.Error, want)
+				}
+			}
+
+			if batch.Saved {
+				for i, tran := range trans {
+					if tran.ID == 0 || tran.InvestID == 0 {
+						t.Errorf("row %d: got id %d and invest id %d after saving", i, tran.ID, tran.InvestID)
+					}
+				}
+				return
+			}
+			// 整批回滚：没有保存交易和审计日志，行上不保留保存时生成的标识
+			for i, tran := range trans {
+				if tran.ID != 0 || tran.InvestID != 0 {
+					t.Errorf("row %d: got id %d and invest id %d after rollback", i, tran.ID, tran.InvestID)
+				}
+			}
+			if len(repo.trans) != savedTrans || len(repo.logs) != savedLogs {
+				t.Errorf("got %d transactions and %d logs after rollback, want %d and %d", len(repo.trans), len(repo.logs), savedTrans, savedLogs)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package stock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CalendarSSE  = "SSE"  // 上交所、深交所
+	CalendarHKEX = "HKEX" // 港交所
+	CalendarNYSE = "NYSE" // 纽交所、纳斯达克
+
+	DateLayout = "2006-01-02"
+)
+
+// 内置休市日（不含周末），导入的休市日优先
+var builtinHolidays = map[string][]string{
+	CalendarSSE: {
+		"2024-01-01", "2024-02-09", "2024-02-12", "2024-02-13", "2024-02-14", "2024-02-15", "2024-02-16",
+		"2024-04-04", "2024-04-05", "2024-05-01", "2024-05-02", "2024-05-03", "2024-06-10",
+		"2024-09-16", "2024-09-17", "2024-10-01", "2024-10-02", "2024-10-03", "2024-10-04", "2024-10-07",
+		"2025-01-01", "2025-01-28", "2025-01-29", "2025-01-30", "2025-01-31", "2025-02-03", "2025-02-04",
+		"2025-04-04", "2025-05-01", "2025-05-02", "2025-05-05", "2025-06-02",
+		"2025-10-01", "2025-10-02", "2025-10-03", "2025-10-06", "2025-10-07", "2025-10-08",
+		"2026-01-01", "2026-01-02", "2026-02-16", "2026-02-17", "2026-02-18", "2026-02-19", "2026-02-20",
+		"2026-02-23", "2026-04-06", "2026-05-01", "2026-05-04", "2026-05-05", "2026-06-19", "2026-09-25",
+		"2026-10-01", "2026-10-02", "2026-10-05", "2026-10-06", "2026-10-07",
+	},
+	CalendarHKEX: {
+		"2024-01-01", "2024-02-12", "2024-02-13", "2024-03-29", "2024-04-01", "2024-04-04", "2024-05-01",
+		"2024-05-15", "2024-06-10", "2024-07-01", "2024-09-18", "2024-10-01", "2024-10-11", "2024-12-25", "2024-12-26",
+		"2025-01-01", "2025-01-29", "2025-01-30", "2025-01-31", "2025-04-04", "2025-04-18", "2025-04-21",
+		"2025-05-01", "2025-05-05", "2025-07-01", "2025-10-01", "2025-10-07", "2025-10-29", "2025-12-25", "2025-12-26",
+		"2026-01-01", "2026-02-17", "2026-02-18", "2026-02-19", "2026-04-03", "2026-04-06", "2026-04-07",
+		"2026-05-01", "2026-05-25", "2026-06-19", "2026-07-01", "2026-10-01", "2026-10-19", "2026-12-25",
+	},
+	CalendarNYSE: {
+		"2024-01-01", "2024-01-15", "2024-02-19", "2024-03-29", "2024-05-27", "2024-06-19", "2024-07-04",
+		"2024-09-02", "2024-11-28", "2024-12-25",
+		"2025-01-01", "2025-01-09", "2025-01-20", "2025-02-17", "2025-04-18", "2025-05-26", "2025-06-19",
+		"2025-07-04", "2025-09-01", "2025-11-27", "2025-12-25",
+		"2026-01-01", "2026-01-19", "2026-02-16", "2026-04-03", "2026-05-25", "2026-06-19", "2026-07-03",
+		"2026-09-07", "2026-11-26", "2026-12-25",
+	},
+}
+
+// 交易日历：周末和休市日以外的日期为交易日，未指定日历时只排除周末。
+// 有休市日的年份为日历的已知范围，范围之外的日期无法判断是否休市
+type TradingCalendar struct {
+	Code     string
+	holidays map[string]string
+	years    map[int]bool   // 有休市日的年份
+	location *time.Location // 市场时区
+}
+
+func NewTradingCalendar(code string, holidays []Holiday) *TradingCalendar {
+	tc := &TradingCalendar{Code: code, holidays: make(map[string]string, len(holidays)), years: make(map[int]bool)}
+	for _, h := range holidays {
+		tc.holidays[h.Date] = h.Name
+		if day, err := time.Parse(DateLayout, h.Date); err == nil {
+			tc.years[day.Year()] = true
+		}
+	}
+	return tc
+}
+
+// Covers 判断日期是否在日历的已知范围内，未指定日历时只排除周末，总是在范围内
+func (tc *TradingCalendar) Covers(day time.Time) bool {
+	return tc.Code == "" || tc.years[day.Year()]
+}
+
+// Location 返回日历所在市场的时区，未设置时为本地时区
+func (tc *TradingCalendar) Location() *time.Location {
+	if tc.location == nil {
+		return time.Local
+	}
+	return tc.location
+}
+
+// Now 返回市场时区的当前时间
+func (tc *TradingCalendar) Now() time.Time {
+	return time.Now().In(tc.Location())
+}
+
+// IsTradingDay 判断日期是否为交易日
+func (tc *TradingCalendar) IsTradingDay(day time.Time) bool {
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return false
+	}
+	_, ok := tc.holidays[day.Format(DateLayout)]
+	return !ok
+}
+
+// NextTradingDay 返回日期之后的第一个交易日
+func (tc *TradingCalendar) NextTradingDay(day time.Time) time.Time {
+	return tc.AddTradingDays(day, 1)
+}
+
+// PrevTradingDay 返回日期之前的第一个交易日
+func (tc *TradingCalendar) PrevTradingDay(day time.Time) time.Time {
+	return tc.AddTradingDays(day, -1)
+}
+
+// AddTradingDays 返回日期之后（n 为负数时之前）的第 n 个交易日，n 为 0 时返回日期本身
+func (tc *TradingCalendar) AddTradingDays(day time.Time, n int) time.Time {
+	step := 1
+	if n < 0 {
+		step, n = -1, -n
+	}
+	for n > 0 {
+		day = day.AddDate(0, 0, step)
+		if tc.IsTradingDay(day) {
+			n--
+		}
+	}
+	return day
+}
+
+// TradingDaysBetween 计算两个日期之间的交易日数（不含开始日期，含结束日期）
+func (tc *TradingCalendar) TradingDaysBetween(t1, t2 time.Time) int {
+	t1 = time.Date(t1.Year(), t1.Month(), t1.Day(), 0, 0, 0, 0, t1.Location())
+	t2 = time.Date(t2.Year(), t2.Month(), t2.Day(), 0, 0, 0, 0, t2.Location())
+	days := 0
+	for d := t1.AddDate(0, 0, 1); !d.After(t2); d = d.AddDate(0, 0, 1) {
+		if tc.IsTradingDay(d) {
+			days++
+		}
+	}
+	return days
+}
+
+// CheckDate 校验成交时间是否为交易日，日期超出日历的已知范围（没有当年的休市日）时只排除周末
+func (tc *TradingCalendar) CheckDate(finishTime string) error {
+	date := dateOf(finishTime)
+	day, err := time.Parse(DateLayout, date)
+	if err != nil {
+		return exception.WrapBusiness(400, "invalid finish time: "+finishTime, err)
+	}
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return exception.NewBusiness(400, fmt.Sprintf("%s is a weekend, %s is closed", date, tc.Code))
+	}
+	if !tc.Covers(day) {
+		return nil
+	}
+	if name, ok := tc.holidays[date]; ok {
+		if name != "" {
+			date += " (" + name + ")"
+		}
+		return exception.NewBusiness(400, fmt.Sprintf("%s is a holiday, %s is closed", date, tc.Code))
+	}
+	return nil
+}
+
+// GetHolidays 返回交易日历的休市日，没有导入时返回内置休市日
+func (ss StockService) GetHolidays(calendar string) (*[]Holiday, error) {
+	if calendar == "" {
+		return nil, exception.NewBusiness(400, "calendar is required")
+	}
+	return ss.holidays(ss.gtm.Context(), calendar)
+}
+
+func (ss StockService) holidays(ctx context.Context, calendar string) (*[]Holiday, error) {
+	holidays, err := ss.sr.GetHolidays(ctx, calendar)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	if len(*holidays) == 0 {
+		for _, date := range builtinHolidays[calendar] {
+			*holidays = append(*holidays, Holiday{Calendar: calendar, Date: date})
+		}
+	}
+	return holidays, nil
+}
+
+// tradingCalendar 加载交易日历，calendar 为空时返回只排除周末的日历
+func (ss StockService) tradingCalendar(ctx context.Context, calendar string) (*TradingCalendar, error) {
+	if calendar == "" {
+		return NewTradingCalendar("", nil), nil
+	}
+	holidays, err := ss.holidays(ctx, calendar)
+	if err != nil {
+		return nil, err
+	}
+	return NewTradingCalendar(calendar, *holidays), nil
+}
+
+// stockCalendar 加载股票所在市场的交易日历，日历使用市场的时区
+func (ss StockService) stockCalendar(ctx context.Context, si *StockInfo) (*TradingCalendar, error) {
+	rule := GetMarketRule(si.Market)
+	if rule == nil {
+		return ss.tradingCalendar(ctx, "")
+	}
+	tc, err := ss.tradingCalendar(ctx, rule.Calendar)
+	if err != nil {
+		return nil, err
+	}
+	tc.location = rule.Location()
+	return tc, nil
+}
+
+// NextTradingDay 返回日期（yyyy-MM-dd）之后的第一个交易日
+func (ss StockService) NextTradingDay(calendar string, date string) (string, error) {
+	return ss.shiftTradingDay(calendar, date, 1)
+}
+
+// PrevTradingDay 返回日期（yyyy-MM-dd）之前的第一个交易日
+func (ss StockService) PrevTradingDay(calendar string, date string) (string, error) {
+	return ss.shiftTradingDay(calendar, date, -1)
+}
+
+func (ss StockService) shiftTradingDay(calendar string, date string, n int) (string, error) {
+	day, err := time.Parse(DateLayout, dateOf(date))
+	if err != nil {
+		return "", exception.WrapBusiness(400, "invalid date: "+date, err)
+	}
+	tc, err := ss.tradingCalendar(ss.gtm.Context(), calendar)
+	if err != nil {
+		return "", err
+	}
+	return tc.AddTradingDays(day, n).Format(DateLayout), nil
+}
+
+// ImportHolidays 从文件内容导入休市日，每行为“日期[,名称]”，# 开头为注释；
+// 文件包含的年份整体替换，其他年份保留，返回导入的休市日数
+func (ss StockService) ImportHolidays(calendar string, data []byte) (int, error) {
+	if calendar == "" {
+		return 0, exception.NewBusiness(400, "calendar is required")
+	}
+	holidays, err := parseHolidays(calendar, data)
+	if err != nil {
+		return 0, err
+	}
+	if len(holidays) == 0 {
+		return 0, exception.NewBusiness(400, "no holidays found in the file")
+	}
+
+	err = ss.gtm.Execute(func(ctx context.Context) error {
+		existing, err := ss.holidays(ctx, calendar)
+		if err != nil {
+			return err
+		}
+		years := make(map[string]bool)
+		for _, h := range holidays {
+			years[h.Date[:4]] = true
+		}
+		// 保留文件中没有的年份（首次导入时包括内置休市日）
+		merged := holidays
+		for _, h := range *existing {
+			if !years[h.Date[:4]] {
+				merged = append(merged, h)
+			}
+		}
+		sort.Slice(merged, func(i, j int) bool { return merged[i].Date < merged[j].Date })
+
+		if err := ss.sr.DeleteHolidays(ctx, calendar); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		if err := ss.sr.SaveHolidays(ctx, &merged); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(holidays), nil
+}
+
+func parseHolidays(calendar string, data []byte) ([]Holiday, error) {
+	var holidays []Holiday
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, ",", 2)
+		date := strings.TrimSpace(fields[0])
+		day, err := time.Parse(DateLayout, date)
+		if err != nil {
+			return nil, exception.WrapBusiness(400, fmt.Sprintf("invalid date at line %d: %s", line, date), err)
+		}
+		if seen[date] || day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+		seen[date] = true
+		h := Holiday{Calendar: calendar, Date: date}
+		if len(fields) > 1 {
+			h.Name = strings.TrimSpace(fields[1])
+		}
+		holidays = append(holidays, h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, exception.WrapBusiness(400, "read holidays error", err)
+	}
+	return holidays, nil
+}
@@ -0,0 +1,102 @@
+package stock
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func builtinCalendar(code string) *TradingCalendar {
+	var holidays []Holiday
+	for _, date := range builtinHolidays[code] {
+		holidays = append(holidays, Holiday{Calendar: code, Date: date})
+	}
+	return NewTradingCalendar(code, holidays)
+}
+
+func TestBuiltinHolidays(t *testing.T) {
+	for code, dates := range builtinHolidays {
+		seen := make(map[string]bool)
+		for _, date := range dates {
+			day, err := time.Parse(DateLayout, date)
+			if err != nil {
+				t.Errorf("%s: invalid date %s", code, date)
+				continue
+			}
+			if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+				t.Errorf("%s: %s is a weekend", code, date)
+			}
+			if seen[date] {
+				t.Errorf("%s: duplicated %s", code, date)
+			}
+			seen[date] = true
+		}
+		for year := 2024; year <= 2026; year++ {
+			if !builtinCalendar(code).Covers(time.Date(year, 6, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("%s: no holidays for %d", code, year)
+			}
+		}
+	}
+}
+
+func TestCheckDate(t *testing.T) {
+	cases := []struct {
+		calendar string
+		time     string
+		wantErr  string
+	}{
+		{CalendarSSE, "2026-02-13 10:00:00", ""},
+		{CalendarSSE, "2026-02-16 10:00:00", "2026-02-16 is a holiday"},
+		{CalendarSSE, "2026-10-08 10:00:00", ""},
+		{CalendarSSE, "2026-10-10 10:00:00", "2026-10-10 is a weekend"},
+		// 没有当年的休市日时只排除周末
+		{CalendarSSE, "2027-01-04 10:00:00", ""},
+		{CalendarSSE, "2023-06-01 10:00:00", ""},
+		{CalendarSSE, "2027-01-02 10:00:00", "2027-01-02 is a weekend"},
+		{CalendarHKEX, "2026-10-19 10:00:00", "2026-10-19 is a holiday"},
+		{CalendarHKEX, "2026-04-07 10:00:00", "2026-04-07 is a holiday"},
+		{CalendarNYSE, "2026-07-03 10:00:00", "2026-07-03 is a holiday"},
+		{CalendarNYSE, "2026-11-27 10:00:00", ""},
+		{"", "2027-01-04 10:00:00", ""},
+	}
+	for _, c := range cases {
+		err := builtinCalendar(c.calendar).CheckDate(c.time)
+		if c.wantErr == "" && err != nil {
+			t.Errorf("%s %s: got error %v", c.calendar, c.time, err)
+		}
+		if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+			t.Errorf("%s %s: got error %v, want %q", c.calendar, c.time, err, c.wantErr)
+		}
+	}
+}
+
+func TestTradeDateOutsideCalendar(t *testing.T) {
+	ss, repo := newTestService(t)
+	repo.stocks["600000"] = StockInfo{Code: "600000", Name: "浦发银行", Market: MarketA, Type: InstrumentStock}
+
+	// 内置日历没有 2023 年的休市日，只排除周末
+	old := &Transaction{StockCode: "600000", Action: 1, Price: 10, Quantity: qty("100"), FinishTime: "2023-06-01 10:00:00"}
+	if err := ss.AddTransaction("test", old); err != nil {
+		t.Fatal(err)
+	}
+	weekend := &Transaction{StockCode: "600000", Action: 1, Price: 10, Quantity: qty("100"), FinishTime: "2023-06-03 10:00:00"}
+	if err := ss.AddTransaction("test", weekend); err == nil || !strings.Contains(err.Error(), "is a weekend") {
+		t.Fatalf("got error %v, want weekend rejected", err)
+	}
+
+	tran := &Transaction{StockCode: "600000", Action: 1, Price: 10, Quantity: qty("100"), FinishTime: "2025-06-03 10:00:00"}
+	if err := ss.AddTransaction("test", tran); err != nil {
+		t.Fatal(err)
+	}
+	// 之后导入的休市日包含成交日期，不修改成交日期时仍可修改交易
+	repo.holidays = []Holiday{{Calendar: CalendarSSE, Date: "2025-06-03"}, {Calendar: CalendarSSE, Date: "2025-06-04"}}
+	edit := *tran
+	edit.Price = 10.5
+	if err := ss.UpdateTransaction("test", &edit); err != nil {
+		t.Fatal(err)
+	}
+	edit.FinishTime = "2025-06-04 10:00:00"
+	if err := ss.UpdateTransaction("test", &edit); err == nil || !strings.Contains(err.Error(), "is a holiday") {
+		t.Fatalf("got error %v, want holiday rejected", err)
+	}
+}
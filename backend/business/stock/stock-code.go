@@ -0,0 +1,258 @@
+package stock
+
+import (
+	"context"
+	"pixiu/backend/pkg/exception"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	RecodeRename = "rename" // 更改股票编码
+	RecodeMerge  = "merge"  // 吸收合并到另一只股票
+)
+
+// GetStockAliases 查询所有股票编码别名
+func (ss StockService) GetStockAliases() (*[]StockAlias, error) {
+	return ss.sr.GetStockAliases(ss.gtm.Context())
+}
+
+// RenameStock 更改股票编码：股票信息、所有投资和交易（包括回收站中的）、计划订单、网格计划和日线行情转到新编码，
+// 原编码保留为别名
+func (ss StockService) RenameStock(operator string, from string, to string) error {
+	if from == "" || to == "" {
+		return exception.NewBusiness(400, "code is required")
+	}
+	if from == to {
+		return exception.NewBusiness(400, "new code is the same as the old code")
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		osi, err := ss.sr.GetStock(ctx, from)
+		if err != nil {
+			return err
+		}
+		if _, err := ss.sr.GetStock(ctx, to); err == nil {
+			return exception.NewBusiness(400, "stock "+to+" already exists, merge it instead")
+		} else if !isNotFound(err) {
+			return err
+		}
+
+		nsi := *osi
+		nsi.Code = to
+		nsi.UpdatedAt = time.Now()
+		if err := ss.sr.SaveStock(ctx, &nsi); err != nil {
+			return err
+		}
+		if err := ss.sr.ChangeStockRefs(ctx, from, to); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		return ss.recode(ctx, operator, osi, &nsi, RecodeRename, decimal.NewFromInt(1))
+	})
+}
+
+// MergeStock 将股票吸收合并到另一只股票：所有交易（包括回收站中的）按换股比例折算为新股票的数量和价格，
+// 成交金额不变，与新股票的交易一起按成交时间重建持仓，不足新股票数量精度的零碎数量以现金卖出；
+// 定投计划和现金分红按金额计算，直接转到新股票；原股票的计划订单、网格计划和日线行情按价格计算，不折算，
+// 仍使用原编码，未完成的计划订单取消、进行中的网格计划结束
+func (ss StockService) MergeStock(operator string, from string, to string, ratio decimal.Decimal) error {
+	if from == "" || to == "" {
+		return exception.NewBusiness(400, "code is required")
+	}
+	if from == to {
+		return exception.NewBusiness(400, "can not merge a stock into itself")
+	}
+	if !ratio.IsPositive() {
+		return exception.NewBusiness(400, "conversion ratio must be positive")
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		osi, err := ss.sr.GetStock(ctx, from)
+		if err != nil {
+			return err
+		}
+		nsi, err := ss.sr.GetStock(ctx, to)
+		if err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "stock "+to+" not found", err)
+			}
+			return err
+		}
+		if nsi.Status != 0 {
+			return exception.NewBusiness(400, "stock "+to+" is deleted")
+		}
+		if err := ss.closeCodePlans(ctx, from); err != nil {
+			return err
+		}
+		if err := ss.sr.ChangeAmountRefs(ctx, from, to); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		return ss.recode(ctx, operator, osi, nsi, RecodeMerge, ratio)
+	})
+}
+
+// recode 将原股票的交易和投资转到新编码，重建新编码所有组合的持仓，清除原股票信息并保留别名
+func (ss StockService) recode(ctx context.Context, operator string, osi *StockInfo, nsi *StockInfo, kind string, ratio decimal.Decimal) error {
+	trans, err := ss.sr.GetCodeTransactions(ctx, osi.Code)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	spec, err := stockSpec(nsi)
+	if err != nil {
+		return err
+	}
+	nowTime := time.Now()
+	recoded := make(map[int64]bool, len(*trans))
+	for _, t := range *trans {
+		before := t
+		t.StockCode = nsi.Code
+		if !ratio.Equal(decimal.NewFromInt(1)) {
+			// 折算价格按新股票的价格精度保留，交易金额保持原成交金额
+			t.Quantity = t.Quantity.Mul(ratio)
+			t.Price = decimal.NewFromFloat(t.Price).Div(ratio).Round(int32(spec.PricePrecision)).InexactFloat64()
+			t.Converted = true
+		}
+		t.UpdatedAt = nowTime
+		if err := ss.sr.UpdateTransactionCode(ctx, &t); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		if err := ss.audit(ctx, operator, EntityTransaction, idKey(t.ID), ActionRecode, &before, &t); err != nil {
+			return err
+		}
+		recoded[t.ID] = true
+	}
+	if err := ss.sr.ChangeInvestmentCode(ctx, osi.Code, nsi.Code); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+
+	portfolios, err := ss.sr.GetStockPortfolios(ctx, nsi.Code)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	for _, portfolioId := range portfolios {
+		if !ratio.Equal(decimal.NewFromInt(1)) {
+			if err := ss.sellFraction(ctx, operator, portfolioId, nsi.Code, spec, recoded); err != nil {
+				return err
+			}
+		}
+		if err := ss.rebuildHolding(ctx, operator, portfolioId, nsi.Code); err != nil {
+			return err
+		}
+	}
+
+	// 原股票信息不再被引用，直接清除
+	if err := ss.sr.DeleteStock(ctx, osi.Code); err != nil {
+		return err
+	}
+	if _, err := ss.sr.PurgeStock(ctx, osi.Code); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	if err := ss.audit(ctx, operator, EntityStock, osi.Code, ActionRecode, osi, nsi); err != nil {
+		return err
+	}
+
+	// 新编码不再是别名，指向原编码的别名改为指向新编码
+	if err := ss.sr.DeleteStockAlias(ctx, nsi.Code); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	if err := ss.sr.RetargetStockAliases(ctx, osi.Code, nsi.Code); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	alias := &StockAlias{Code: osi.Code, StockCode: nsi.Code, Name: osi.Name, Kind: kind, Ratio: ratio, Operator: operator, CreatedAt: nowTime}
+	if err := ss.sr.SaveStockAlias(ctx, alias); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	return nil
+}
+
+// sellFraction 折算后的持有数量不足新股票的数量精度时，零碎数量按最后一笔折算交易的价格和时间卖出（现金替代），
+// 之后的交易按新股票的精度校验，持仓可以全部卖出
+func (ss StockService) sellFraction(ctx context.Context, operator string, portfolioId int64, code string, spec *InstrumentSpec, recoded map[int64]bool) error {
+	trans, err := ss.sr.GetStockTransactions(ctx, portfolioId, code)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	// 新股票自身的交易数量符合精度，之前合并的零碎数量已卖出，剩余的零碎数量来自本次折算
+	quantity := decimal.Zero
+	var last *Transaction
+	for i, t := range *trans {
+		if !t.Converted {
+			continue
+		}
+		quantity = quantity.Add(signedQuantity(t))
+		if recoded[t.ID] {
+			last = &(*trans)[i]
+		}
+	}
+	fraction := quantity.Sub(quantity.Truncate(int32(spec.QuantityPrecision)))
+	if last == nil || !fraction.IsPositive() {
+		return nil
+	}
+
+	nowTime := time.Now()
+	tran := &Transaction{PortfolioID: portfolioId, StockCode: code, Action: -1, Price: last.Price, Quantity: fraction,
+		Amount: floatMulDecimal(last.Price, fraction), FinishTime: last.FinishTime, FinishAt: last.FinishAt, SettleDate: last.SettleDate,
+		Converted: true, CreatedAt: nowTime, UpdatedAt: nowTime}
+	if err := ss.sr.CreateTransaction(ctx, tran); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	return ss.audit(ctx, operator, EntityTransaction, idKey(tran.ID), ActionRecode, nil, tran)
+}
+
+// closeCodePlans 取消股票未完成的计划订单、结束进行中的网格计划：计划的价格和数量按原股票计算，合并后不能继续执行
+func (ss StockService) closeCodePlans(ctx context.Context, code string) error {
+	nowTime := time.Now()
+	orders, err := ss.sr.GetPlannedOrders(ctx)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	for _, plan := range *orders {
+		if plan.StockCode != code {
+			continue
+		}
+		if err := ss.fillPlan(ctx, &plan); err != nil {
+			return err
+		}
+		switch plan.Status {
+		case PlanDraft, PlanActive, PlanPartial:
+			plan.Status = PlanCancelled
+			plan.UpdatedAt = nowTime
+			if err := ss.sr.UpdatePlannedOrder(ctx, &plan); err != nil {
+				return exception.WrapService(500, "dao error", err)
+			}
+		}
+	}
+
+	grids, err := ss.sr.GetGridPlans(ctx)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	for _, plan := range *grids {
+		if plan.StockCode != code || plan.Status != GridActive {
+			continue
+		}
+		plan.Status = GridClosed
+		plan.UpdatedAt = nowTime
+		if err := ss.sr.UpdateGridPlan(ctx, &plan); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+	}
+	return nil
+}
+
+// resolveCode 返回编码当前对应的股票编码：股票信息不存在且有别名时返回别名指向的编码
+func (ss StockService) resolveCode(ctx context.Context, code string) (string, error) {
+	if code == "" {
+		return code, nil
+	}
+	if _, err := ss.sr.GetStock(ctx, code); err == nil || !isNotFound(err) {
+		return code, err
+	}
+	alias, err := ss.sr.GetStockAlias(ctx, code)
+	if err != nil {
+		if isNotFound(err) {
+			return code, nil
+		}
+		return "", err
+	}
+	return alias.StockCode, nil
+}
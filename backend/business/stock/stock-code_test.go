@@ -0,0 +1,155 @@
+package stock
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// addCodePlans 为股票登记生效的计划订单、网格计划和定投计划
+func addCodePlans(repo *memoryRepository, code string) (orderId int64, gridId int64, dcaId int64) {
+	orderId, gridId, dcaId = repo.id(), repo.id(), repo.id()
+	repo.orders[orderId] = PlannedOrder{ID: orderId, StockCode: code, Action: 1, Price: 9, Quantity: qty("100"), Status: PlanActive}
+	repo.grids[gridId] = GridPlan{ID: gridId, StockCode: code, LowerPrice: 8, UpperPrice: 12, GridCount: 4, GridQuantity: qty("100"), Status: GridActive}
+	repo.plans[dcaId] = DcaPlan{ID: dcaId, StockCode: code, Amount: 1000, Frequency: "monthly", Day: 1, StartDate: "2025-06-01", Status: "active"}
+	return orderId, gridId, dcaId
+}
+
+func TestRenameStock(t *testing.T) {
+	ss, repo := newTestService(t, "600001")
+	for _, tran := range []Transaction{
+		{StockCode: "600001", Action: 1, Price: 10, Quantity: qty("300"), FinishTime: "2025-06-03 10:00:00"},
+		{StockCode: "600001", Action: -1, Price: 11, Quantity: qty("100"), FinishTime: "2025-06-04 10:00:00"},
+	} {
+		if err := ss.AddTransaction("test", &tran); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orderId, gridId, dcaId := addCodePlans(repo, "600001")
+
+	if err := ss.RenameStock("test", "600001", "600002"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repo.stocks["600001"]; ok {
+		t.Error("old stock is kept after rename")
+	}
+	if _, err := repo.GetStock(context.Background(), "600002"); err != nil {
+		t.Fatalf("renamed stock: %v", err)
+	}
+	for _, tran := range repo.trans {
+		if tran.StockCode != "600002" || tran.Converted {
+			t.Errorf("got transaction %d on %s converted %v, want it on 600002 unconverted", tran.ID, tran.StockCode, tran.Converted)
+		}
+	}
+	invests := openInvestments(t, repo, "600002")
+	if len(invests) != 1 || !invests[0].Quantity.Equal(qty("200")) {
+		t.Fatalf("got investments %+v, want one holding 200", invests)
+	}
+
+	// 计划按价格计算，改名后仍然有效
+	if plan := repo.orders[orderId]; plan.StockCode != "600002" || plan.Status != PlanActive {
+		t.Errorf("got planned order on %s %s, want it active on 600002", plan.StockCode, plan.Status)
+	}
+	if plan := repo.grids[gridId]; plan.StockCode != "600002" || plan.Status != GridActive {
+		t.Errorf("got grid plan on %s %s, want it active on 600002", plan.StockCode, plan.Status)
+	}
+	if plan := repo.plans[dcaId]; plan.StockCode != "600002" {
+		t.Errorf("got dca plan on %s, want 600002", plan.StockCode)
+	}
+
+	code, err := ss.resolveCode(context.Background(), "600001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "600002" || repo.aliases["600001"].Kind != RecodeRename {
+		t.Errorf("old code resolves to %s with alias %+v, want 600002 by rename", code, repo.aliases["600001"])
+	}
+
+	if err := ss.RenameStock("test", "600002", "600002"); err == nil {
+		t.Error("rename to the same code is accepted")
+	}
+}
+
+func TestMergeStock(t *testing.T) {
+	cases := []struct {
+		ratio    string
+		holding  string // 合并后的持有数量（新股票原有 100）
+		fraction string // 以现金卖出的零碎数量，为空表示没有
+	}{
+		{ratio: "2", holding: "500"},
+		// 折算后持有 66.6，零碎的 0.6 按最后一笔折算交易的价格卖出
+		{ratio: "0.333", holding: "166", fraction: "0.6"},
+	}
+	for _, c := range cases {
+		t.Run(c.ratio, func(t *testing.T) {
+			ss, repo := newTestService(t, "600001", "600002")
+			for _, tran := range []Transaction{
+				{StockCode: "600002", Action: 1, Price: 20, Quantity: qty("100"), FinishTime: "2025-06-02 10:00:00"},
+				{StockCode: "600001", Action: 1, Price: 10, Quantity: qty("300"), FinishTime: "2025-06-03 10:00:00"},
+				{StockCode: "600001", Action: -1, Price: 11, Quantity: qty("100"), FinishTime: "2025-06-04 10:00:00"},
+			} {
+				if err := ss.AddTransaction("test", &tran); err != nil {
+					t.Fatal(err)
+				}
+			}
+			orderId, gridId, dcaId := addCodePlans(repo, "600001")
+			existing := make(map[int64]bool)
+			for id := range repo.trans {
+				existing[id] = true
+			}
+
+			ratio := decimal.RequireFromString(c.ratio)
+			if err := ss.MergeStock("test", "600001", "600002", ratio); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := repo.stocks["600001"]; ok {
+				t.Error("merged stock is kept")
+			}
+			if alias := repo.aliases["600001"]; alias.StockCode != "600002" || alias.Kind != RecodeMerge || !alias.Ratio.Equal(ratio) {
+				t.Errorf("got alias %+v, want a merge into 600002", alias)
+			}
+
+			invests := openInvestments(t, repo, "600002")
+			if len(invests) != 1 || !invests[0].Quantity.Equal(qty(c.holding)) {
+				t.Fatalf("got investments %+v, want one holding %s", invests, c.holding)
+			}
+			var sold []Transaction
+			for _, tran := range repo.trans {
+				if tran.StockCode != "600002" {
+					t.Errorf("transaction %d is left on %s", tran.ID, tran.StockCode)
+				}
+				if !existing[tran.ID] {
+					sold = append(sold, tran)
+				}
+			}
+			if c.fraction == "" {
+				if len(sold) != 0 {
+					t.Errorf("got fraction sells %+v, want none", sold)
+				}
+			} else if len(sold) != 1 || !sold[0].Quantity.Equal(qty(c.fraction)) || sold[0].FinishTime != "2025-06-04 10:00:00" {
+				t.Errorf("got fraction sells %+v, want %s sold at the last converted trade", sold, c.fraction)
+			}
+
+			// 未完成的计划订单取消、网格计划结束，仍使用原编码；定投计划按金额转到新股票
+			if plan := repo.orders[orderId]; plan.StockCode != "600001" || plan.Status != PlanCancelled {
+				t.Errorf("got planned order on %s %s, want it cancelled on 600001", plan.StockCode, plan.Status)
+			}
+			if plan := repo.grids[gridId]; plan.StockCode != "600001" || plan.Status != GridClosed {
+				t.Errorf("got grid plan on %s %s, want it closed on 600001", plan.StockCode, plan.Status)
+			}
+			if plan := repo.plans[dcaId]; plan.StockCode != "600002" {
+				t.Errorf("got dca plan on %s, want 600002", plan.StockCode)
+			}
+
+			// 合并后的持仓可以全部卖出
+			sell := &Transaction{StockCode: "600002", Action: -1, Price: 12, Quantity: qty(c.holding), FinishTime: "2025-06-05 10:00:00"}
+			if err := ss.AddTransaction("test", sell); err != nil {
+				t.Fatal(err)
+			}
+			if invests := openInvestments(t, repo, "600002"); len(invests) != 1 || !invests[0].Quantity.IsZero() {
+				t.Errorf("got investments %+v after selling the holding, want it closed", invests)
+			}
+		})
+	}
+}
@@ -0,0 +1,521 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"slices"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	DcaWeekly     = "weekly"      // 每周
+	DcaBiweekly   = "biweekly"    // 每两周
+	DcaMonthly    = "monthly"     // 每月
+	DcaTradingDay = "trading_day" // 每月第几个交易日
+
+	HolidayNext     = "next"     // 顺延到下一个交易日
+	HolidayPrevious = "previous" // 提前到上一个交易日
+	HolidaySkip     = "skip"     // 跳过本期
+
+	DcaActive = "active"
+	DcaPaused = "paused"
+	DcaEnded  = "ended"
+
+	DcaPending   = "pending"
+	DcaConfirmed = "confirmed"
+	DcaSkipped   = "skipped"
+
+	// 排期向后多看的天数，提前到上一个交易日的定投可能在定投日之前到期
+	dcaLookahead = 31
+)
+
+// GetDcaPlans 查询定投计划，status 为空时返回所有状态
+func (ss StockService) GetDcaPlans(status string) (*[]DcaPlan, error) {
+	plans, err := ss.sr.GetDcaPlans(ss.gtm.Context())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DcaPlan, 0, len(*plans))
+	for _, plan := range *plans {
+		if status == "" || plan.Status == status {
+			result = append(result, plan)
+		}
+	}
+	return &result, nil
+}
+
+// SaveDcaPlan 新增定投计划，从开始日期排期
+func (ss StockService) SaveDcaPlan(plan *DcaPlan) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		if err := ss.validateDcaPlan(ctx, plan); err != nil {
+			return err
+		}
+		plan.ID = 0
+		plan.ScheduleFrom = plan.StartDate
+		plan.Status = DcaActive
+		plan.CreatedAt = time.Now()
+		plan.UpdatedAt = time.Now()
+		return ss.sr.CreateDcaPlan(ctx, plan)
+	})
+}
+
+// UpdateDcaPlan 修改未结束的定投计划，股票、投资组合和开始日期不能修改；已生成的定投不受影响
+func (ss StockService) UpdateDcaPlan(plan *DcaPlan) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		oplan, err := ss.sr.GetDcaPlan(ctx, plan.ID)
+		if err != nil {
+			return err
+		}
+		if oplan.Status == DcaEnded {
+			return exception.NewBusiness(400, "dca plan is ended and can not be modified")
+		}
+		plan.StockCode = oplan.StockCode
+		plan.PortfolioID = oplan.PortfolioID
+		plan.StartDate = oplan.StartDate
+		if err := ss.validateDcaPlan(ctx, plan); err != nil {
+			return err
+		}
+
+		oplan.Amount = plan.Amount
+		oplan.Frequency = plan.Frequency
+		oplan.Day = plan.Day
+		oplan.HolidayRule = plan.HolidayRule
+		oplan.EndDate = plan.EndDate
+		oplan.Remark = plan.Remark
+		oplan.UpdatedAt = time.Now()
+		return ss.sr.UpdateDcaPlan(ctx, oplan)
+	})
+}
+
+// PauseDcaPlan 暂停定投计划，暂停期间不生成定投
+func (ss StockService) PauseDcaPlan(id int64) error {
+	return ss.changeDcaStatus(id, DcaPaused, DcaActive)
+}
+
+// ResumeDcaPlan 恢复暂停的定投计划，从当天开始重新排期
+func (ss StockService) ResumeDcaPlan(id int64) error {
+	return ss.changeDcaStatus(id, DcaActive, DcaPaused)
+}
+
+// EndDcaPlan 结束定投计划，待确认的定投仍可确认或跳过
+func (ss StockService) EndDcaPlan(id int64) error {
+	return ss.changeDcaStatus(id, DcaEnded, DcaActive, DcaPaused)
+}
+
+func (ss StockService) changeDcaStatus(id int64, status string, from ...string) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		plan, err := ss.sr.GetDcaPlan(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(from, plan.Status) {
+			return exception.NewBusiness(400, fmt.Sprintf("dca plan is %s and can not be %s", plan.Status, status))
+		}
+		if plan.Status == DcaPaused && status == DcaActive {
+			si, err := ss.stockOf(ctx, plan.StockCode)
+			if err != nil {
+				return err
+			}
+			plan.ScheduleFrom = marketNow(si).Format(DateLayout)
+		}
+		plan.Status = status
+		plan.UpdatedAt = time.Now()
+		return ss.sr.UpdateDcaPlan(ctx, plan)
+	})
+}
+
+// ScheduleDcaPlans 为运行中的定投计划生成到期（按市场时区的当天）的待确认定投，已生成的不重复生成；
+// 过了结束日期且没有未到期的定投时结束计划，返回生成的定投数
+func (ss StockService) ScheduleDcaPlans() (int, error) {
+	count := 0
+	err := ss.gtm.Execute(func(ctx context.Context) error {
+		plans, err := ss.sr.GetDcaPlans(ctx)
+		if err != nil {
+			return err
+		}
+		for i := range *plans {
+			plan := &(*plans)[i]
+			if plan.Status != DcaActive {
+				continue
+			}
+			n, err := ss.schedulePlan(ctx, plan)
+			if err != nil {
+				return err
+			}
+			count += n
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (ss StockService) schedulePlan(ctx context.Context, plan *DcaPlan) (int, error) {
+	si, err := ss.stockOf(ctx, plan.StockCode)
+	if err != nil {
+		return 0, err
+	}
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return 0, err
+	}
+	return ss.scheduleEntries(ctx, plan, tc, tc.Now().Format(DateLayout))
+}
+
+// scheduleEntries 按交易日历生成到 today（yyyy-MM-dd）为止到期的定投
+func (ss StockService) scheduleEntries(ctx context.Context, plan *DcaPlan, tc *TradingCalendar, today string) (int, error) {
+	entries, err := ss.sr.GetDcaEntries(ctx, plan.ID)
+	if err != nil {
+		return 0, err
+	}
+	scheduled := make(map[string]bool, len(*entries))
+	for _, entry := range *entries {
+		scheduled[entry.PeriodDate] = true
+	}
+
+	until, _ := time.Parse(DateLayout, today)
+	periods := dcaPeriods(plan, tc, until.AddDate(0, 0, dcaLookahead))
+	count, upcoming := 0, false
+	nowTime := time.Now()
+	for _, p := range periods {
+		if p.due == "" || p.due < plan.ScheduleFrom || scheduled[p.period] {
+			continue
+		}
+		if p.due > today {
+			upcoming = true
+			continue
+		}
+		entry := &DcaEntry{PlanID: plan.ID, PeriodDate: p.period, DueDate: p.due, Amount: plan.Amount, Status: DcaPending, CreatedAt: nowTime, UpdatedAt: nowTime}
+		if err := ss.sr.CreateDcaEntry(ctx, entry); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if plan.EndDate != "" && today >= plan.EndDate && !upcoming {
+		plan.Status = DcaEnded
+		plan.UpdatedAt = nowTime
+		if err := ss.sr.UpdateDcaPlan(ctx, plan); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// GetDcaEntries 查询定投计划的定投（planId 为 0 时查询所有计划），status 为空时返回所有状态
+func (ss StockService) GetDcaEntries(planId int64, status string) (*[]DcaEntry, error) {
+	entries, err := ss.sr.GetDcaEntries(ss.gtm.Context(), planId)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DcaEntry, 0, len(*entries))
+	for _, entry := range *entries {
+		if status == "" || entry.Status == status {
+			result = append(result, entry)
+		}
+	}
+	return &result, nil
+}
+
+// ConfirmDcaEntry 按实际成交确认待确认的定投，生成买入交易：成交价格必填，数量为空时按定投金额计算
+// （有每手数量的品种按整手买入，其余按金额买入），成交时间为空时取到期日的收盘时间
+func (ss StockService) ConfirmDcaEntry(operator string, entryId int64, fill *Transaction) (*Transaction, error) {
+	if fill == nil || fill.Price <= 0 {
+		return nil, exception.NewBusiness(400, "fill price must be positive")
+	}
+	var tran *Transaction
+	err := ss.gtm.Execute(func(ctx context.Context) error {
+		entry, err := ss.sr.GetDcaEntry(ctx, entryId)
+		if err != nil {
+			return err
+		}
+		if entry.Status != DcaPending {
+			return exception.NewBusiness(400, fmt.Sprintf("dca entry is %s and can not be confirmed", entry.Status))
+		}
+		plan, err := ss.sr.GetDcaPlan(ctx, entry.PlanID)
+		if err != nil {
+			return err
+		}
+		si, err := ss.stockOf(ctx, plan.StockCode)
+		if err != nil {
+			return err
+		}
+
+		tran = &Transaction{
+			PortfolioID: plan.PortfolioID,
+			StockCode:   plan.StockCode,
+			Action:      1,
+			Price:       fill.Price,
+			Quantity:    fill.Quantity,
+			TaxFee:      fill.TaxFee,
+			FinishTime:  fill.FinishTime,
+		}
+		if tran.FinishTime == "" {
+			tran.FinishTime = entry.DueDate + marketCloseTime(si)
+		}
+		if tran.Quantity.IsZero() {
+			spec, err := stockSpec(si)
+			if err != nil {
+				return err
+			}
+			if tran.Quantity, err = lotsByAmount(si, spec, entry.Amount, tran.Price); err != nil {
+				return err
+			}
+			if tran.Quantity.IsZero() {
+				// 没有每手数量的品种（如场外基金）按金额买入
+				tran.Amount = entry.Amount
+			}
+		}
+		if err := ss.addTransaction(ctx, operator, tran); err != nil {
+			return err
+		}
+
+		entry.Status = DcaConfirmed
+		entry.TranID = tran.ID
+		entry.UpdatedAt = time.Now()
+		return ss.sr.UpdateDcaEntry(ctx, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tran, nil
+}
+
+// SkipDcaEntry 跳过待确认的定投
+func (ss StockService) SkipDcaEntry(entryId int64) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		entry, err := ss.sr.GetDcaEntry(ctx, entryId)
+		if err != nil {
+			return err
+		}
+		if entry.Status != DcaPending {
+			return exception.NewBusiness(400, fmt.Sprintf("dca entry is %s and can not be skipped", entry.Status))
+		}
+		entry.Status = DcaSkipped
+		entry.UpdatedAt = time.Now()
+		return ss.sr.UpdateDcaEntry(ctx, entry)
+	})
+}
+
+// GetDcaStatus 统计定投计划已确认定投的投入、数量和按参考价格计算的收益，已删除的交易不计入
+func (ss StockService) GetDcaStatus(id int64) (*DcaStatus, error) {
+	ctx := ss.gtm.Context()
+	plan, err := ss.sr.GetDcaPlan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ss.sr.GetDcaEntries(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &DcaStatus{Plan: plan, Entries: *entries, Quantity: decimal.Zero}
+	invested, taxFee := decimal.Zero, decimal.Zero
+	price := 0.0
+	for _, entry := range *entries {
+		switch entry.Status {
+		case DcaPending:
+			status.Pending++
+		case DcaSkipped:
+			status.Skipped++
+		case DcaConfirmed:
+			status.Confirmed++
+			tran, err := ss.sr.GetTransaction(ctx, entry.TranID)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			if tran.Status != 0 {
+				continue
+			}
+			status.Quantity = status.Quantity.Add(tran.Quantity)
+			invested = invested.Add(decimal.NewFromFloat(tran.Amount)).Add(decimal.NewFromFloat(tran.TaxFee))
+			taxFee = taxFee.Add(decimal.NewFromFloat(tran.TaxFee))
+			price = tran.Price
+		}
+	}
+
+	if status.Price, err = ss.referencePrice(ctx, plan.StockCode, price); err != nil {
+		return nil, err
+	}
+	status.Invested = invested.RoundBank(2).InexactFloat64()
+	status.TaxFee = taxFee.RoundBank(2).InexactFloat64()
+	if status.Quantity.IsPositive() {
+		status.AvgCost = invested.Div(status.Quantity).Round(4).InexactFloat64()
+		value := decimal.NewFromFloat(status.Price).Mul(status.Quantity)
+		status.MarketValue = value.RoundBank(2).InexactFloat64()
+		status.ProfitLoss = value.Sub(invested).RoundBank(2).InexactFloat64()
+		if invested.IsPositive() {
+			status.Roi = value.Sub(invested).Div(invested).Mul(decimal.NewFromInt(100)).RoundBank(2).InexactFloat64()
+		}
+	}
+	return status, nil
+}
+
+func (ss StockService) validateDcaPlan(ctx context.Context, plan *DcaPlan) error {
+	if plan.StockCode == "" {
+		return exception.NewBusiness(400, "stock code is empty")
+	}
+	if _, err := ss.sr.GetStock(ctx, plan.StockCode); err != nil {
+		if isNotFound(err) {
+			return exception.WrapBusiness(404, "stock not found", err)
+		}
+		return err
+	}
+	if plan.PortfolioID != 0 {
+		if _, err := ss.sr.GetPortfolio(ctx, plan.PortfolioID); err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "portfolio not found", err)
+			}
+			return err
+		}
+	}
+	if plan.Amount <= 0 {
+		return exception.NewBusiness(400, "amount must be positive")
+	}
+	switch plan.Frequency {
+	case DcaWeekly, DcaBiweekly:
+		if plan.Day < 1 || plan.Day > 5 {
+			return exception.NewBusiness(400, "weekday must be between 1 (Monday) and 5 (Friday)")
+		}
+	case DcaMonthly:
+		if plan.Day < 1 || plan.Day > 31 {
+			return exception.NewBusiness(400, "day of month must be between 1 and 31")
+		}
+	case DcaTradingDay:
+		if plan.Day < 1 || plan.Day > 23 {
+			return exception.NewBusiness(400, "trading day of month must be between 1 and 23")
+		}
+	default:
+		return exception.NewBusiness(400, "frequency must be weekly, biweekly, monthly or trading_day")
+	}
+	if plan.HolidayRule == "" {
+		plan.HolidayRule = HolidayNext
+	}
+	if plan.HolidayRule != HolidayNext && plan.HolidayRule != HolidayPrevious && plan.HolidayRule != HolidaySkip {
+		return exception.NewBusiness(400, "holiday rule must be next, previous or skip")
+	}
+	if _, err := time.Parse(DateLayout, plan.StartDate); err != nil {
+		return exception.WrapBusiness(400, "start date must be yyyy-MM-dd", err)
+	}
+	if plan.EndDate != "" {
+		if _, err := time.Parse(DateLayout, plan.EndDate); err != nil {
+			return exception.WrapBusiness(400, "end date must be yyyy-MM-dd", err)
+		}
+		if plan.EndDate < plan.StartDate {
+			return exception.NewBusiness(400, "end date is before start date")
+		}
+	}
+	return nil
+}
+
+// 一期定投：按频率计算的定投日和按休市规则调整后的交易日（跳过时为空）
+type dcaPeriod struct {
+	period string
+	due    string
+}
+
+// dcaPeriods 计算开始日期到结束日期（不晚于 until）之间的各期定投
+func dcaPeriods(plan *DcaPlan, tc *TradingCalendar, until time.Time) []dcaPeriod {
+	start, err := time.Parse(DateLayout, plan.StartDate)
+	if err != nil {
+		return nil
+	}
+	if plan.EndDate != "" {
+		if end, err := time.Parse(DateLayout, plan.EndDate); err == nil && end.Before(until) {
+			until = end
+		}
+	}
+
+	var days []time.Time
+	switch plan.Frequency {
+	case DcaWeekly, DcaBiweekly:
+		step := 7
+		if plan.Frequency == DcaBiweekly {
+			step = 14
+		}
+		day := start.AddDate(0, 0, (plan.Day-int(start.Weekday())+7)%7)
+		for ; !day.After(until); day = day.AddDate(0, 0, step) {
+			days = append(days, day)
+		}
+	case DcaMonthly, DcaTradingDay:
+		for month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC); !month.After(until); month = month.AddDate(0, 1, 0) {
+			var day time.Time
+			if plan.Frequency == DcaMonthly {
+				last := month.AddDate(0, 1, -1).Day()
+				day = month.AddDate(0, 0, min(plan.Day, last)-1)
+			} else {
+				day = nthTradingDay(tc, month, plan.Day)
+			}
+			if !day.Before(start) && !day.After(until) {
+				days = append(days, day)
+			}
+		}
+	}
+
+	periods := make([]dcaPeriod, 0, len(days))
+	for _, day := range days {
+		p := dcaPeriod{period: day.Format(DateLayout)}
+		switch {
+		case plan.Frequency == DcaTradingDay || tc.IsTradingDay(day):
+			p.due = p.period
+		case plan.HolidayRule == HolidayNext:
+			p.due = tc.NextTradingDay(day).Format(DateLayout)
+		case plan.HolidayRule == HolidayPrevious:
+			p.due = tc.PrevTradingDay(day).Format(DateLayout)
+		}
+		periods = append(periods, p)
+	}
+	return periods
+}
+
+// nthTradingDay 返回当月第 n 个交易日，当月交易日不足时返回最后一个交易日
+func nthTradingDay(tc *TradingCalendar, month time.Time, n int) time.Time {
+	var found time.Time
+	for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+		if tc.IsTradingDay(day) {
+			found = day
+			if n--; n == 0 {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// lotsByAmount 按金额（含估算的买入税费）计算可买入的整手数量，没有每手数量的品种返回 0
+func lotsByAmount(si *StockInfo, spec *InstrumentSpec, amount float64, price float64) (decimal.Decimal, error) {
+	rule := GetMarketRule(si.Market)
+	if rule == nil || !rule.applies(spec) {
+		return decimal.Zero, nil
+	}
+	lot, step, _ := rule.LotRule(si)
+	if lot <= 0 || step <= 0 {
+		return decimal.Zero, nil
+	}
+	budget := decimal.NewFromFloat(amount)
+	steps := decimal.NewFromInt(int64(step))
+	quantity := budget.Div(decimal.NewFromFloat(price)).Div(steps).Floor().Mul(steps)
+	for quantity.GreaterThanOrEqual(decimal.NewFromInt(int64(lot))) {
+		cost := floatMulDecimal(price, quantity)
+		if decimal.NewFromFloat(cost + spec.Fee.EstimateFee(1, cost)).LessThanOrEqual(budget) {
+			return quantity, nil
+		}
+		quantity = quantity.Sub(steps)
+	}
+	return decimal.Zero, exception.NewBusiness(400, fmt.Sprintf("amount %v is not enough to buy %d at %v", amount, lot, price))
+}
+
+// 未登记交易时段的市场的收盘时间
+const defaultCloseTime = " 15:00:00"
+
+// marketCloseTime 返回股票所在市场的收盘时间（" HH:mm:ss"），未登记交易时段时为 15:00
+func marketCloseTime(si *StockInfo) string {
+	if rule := GetMarketRule(si.Market); rule != nil && len(rule.Sessions) > 0 {
+		return " " + rule.Sessions[len(rule.Sessions)-1].Close + ":00"
+	}
+	return defaultCloseTime
+}
@@ -0,0 +1,212 @@
+package stock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dcaCalendar 定投测试使用的交易日历：2026 年的周末和以下休市日
+func dcaCalendar() *TradingCalendar {
+	var holidays []Holiday
+	for _, date := range []string{"2026-04-03", "2026-05-01", "2026-05-04", "2026-05-05", "2026-06-01"} {
+		holidays = append(holidays, Holiday{Calendar: "TEST", Date: date})
+	}
+	return NewTradingCalendar("TEST", holidays)
+}
+
+func formatPeriods(periods []dcaPeriod) string {
+	items := make([]string, 0, len(periods))
+	for _, p := range periods {
+		items = append(items, p.period+">"+p.due)
+	}
+	return strings.Join(items, " ")
+}
+
+func TestDcaPeriods(t *testing.T) {
+	cases := []struct {
+		name  string
+		plan  DcaPlan
+		until string
+		want  string // 定投日>到期日，跳过时到期日为空
+	}{
+		{
+			name:  "day of month clamps to the month end",
+			plan:  DcaPlan{Frequency: DcaMonthly, Day: 31, HolidayRule: HolidayNext, StartDate: "2026-01-01"},
+			until: "2026-04-30",
+			want:  "2026-01-31>2026-02-02 2026-02-28>2026-03-02 2026-03-31>2026-03-31 2026-04-30>2026-04-30",
+		},
+		{
+			name:  "previous rule moves before the period date",
+			plan:  DcaPlan{Frequency: DcaWeekly, Day: 5, HolidayRule: HolidayPrevious, StartDate: "2026-03-30"},
+			until: "2026-05-08",
+			want: "2026-04-03>2026-04-02 2026-04-10>2026-04-10 2026-04-17>2026-04-17 2026-04-24>2026-04-24 " +
+				"2026-05-01>2026-04-30 2026-05-08>2026-05-08",
+		},
+		{
+			name:  "next rule crosses consecutive holidays",
+			plan:  DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidayNext, StartDate: "2026-05-01"},
+			until: "2026-06-30",
+			want:  "2026-05-01>2026-05-06 2026-06-01>2026-06-02",
+		},
+		{
+			name:  "skip rule leaves the due date empty",
+			plan:  DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidaySkip, StartDate: "2026-05-01"},
+			until: "2026-07-31",
+			want:  "2026-05-01> 2026-06-01> 2026-07-01>2026-07-01",
+		},
+		{
+			name:  "biweekly starts from the first weekday after the start date",
+			plan:  DcaPlan{Frequency: DcaBiweekly, Day: 1, HolidayRule: HolidayNext, StartDate: "2026-04-01"},
+			until: "2026-05-10",
+			want:  "2026-04-06>2026-04-06 2026-04-20>2026-04-20 2026-05-04>2026-05-06",
+		},
+		{
+			name:  "nth trading day of the month",
+			plan:  DcaPlan{Frequency: DcaTradingDay, Day: 1, HolidayRule: HolidayNext, StartDate: "2026-05-01"},
+			until: "2026-06-30",
+			want:  "2026-05-06>2026-05-06 2026-06-02>2026-06-02",
+		},
+		{
+			name:  "end date limits the periods",
+			plan:  DcaPlan{Frequency: DcaMonthly, Day: 15, HolidayRule: HolidayNext, StartDate: "2026-01-01", EndDate: "2026-03-10"},
+			until: "2026-06-30",
+			want:  "2026-01-15>2026-01-15 2026-02-15>2026-02-16",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			until, _ := time.Parse(DateLayout, c.until)
+			if got := formatPeriods(dcaPeriods(&c.plan, dcaCalendar(), until)); got != c.want {
+				t.Fatalf("got  %s\nwant %s", got, c.want)
+			}
+		})
+	}
+}
+
+// 一次排期：当天的日期，期望生成的定投数和排期后的计划状态
+type scheduleStep struct {
+	today  string
+	count  int
+	status string
+}
+
+func TestScheduleEntries(t *testing.T) {
+	cases := []struct {
+		name    string
+		plan    DcaPlan
+		steps   []scheduleStep
+		entries string // 定投日>到期日
+	}{
+		{
+			name:    "lookahead schedules an entry due before its period date",
+			plan:    DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidayPrevious, StartDate: "2026-04-01"},
+			steps:   []scheduleStep{{"2026-04-30", 2, DcaActive}},
+			entries: "2026-04-01>2026-04-01 2026-05-01>2026-04-30",
+		},
+		{
+			name:    "entries are scheduled once when due",
+			plan:    DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidayNext, StartDate: "2026-04-01"},
+			steps:   []scheduleStep{{"2026-04-30", 1, DcaActive}, {"2026-05-01", 0, DcaActive}, {"2026-05-06", 1, DcaActive}, {"2026-05-06", 0, DcaActive}},
+			entries: "2026-04-01>2026-04-01 2026-05-01>2026-05-06",
+		},
+		{
+			name:    "periods before schedule from are not scheduled",
+			plan:    DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidayNext, StartDate: "2026-01-01", ScheduleFrom: "2026-04-15"},
+			steps:   []scheduleStep{{"2026-05-06", 1, DcaActive}},
+			entries: "2026-05-01>2026-05-06",
+		},
+		{
+			name:    "plan ends after the last entry is due",
+			plan:    DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidayNext, StartDate: "2026-04-01", EndDate: "2026-05-01"},
+			steps:   []scheduleStep{{"2026-05-01", 1, DcaActive}, {"2026-05-06", 1, DcaEnded}},
+			entries: "2026-04-01>2026-04-01 2026-05-01>2026-05-06",
+		},
+		{
+			name:    "plan ends on the end date when entries are already scheduled",
+			plan:    DcaPlan{Frequency: DcaMonthly, Day: 1, HolidayRule: HolidayPrevious, StartDate: "2026-04-01", EndDate: "2026-05-01"},
+			steps:   []scheduleStep{{"2026-04-30", 2, DcaActive}, {"2026-05-01", 0, DcaEnded}},
+			entries: "2026-04-01>2026-04-01 2026-05-01>2026-04-30",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ss, repo := newTestService(t)
+			ctx := context.Background()
+			plan := c.plan
+			plan.Amount, plan.Status = 1000, DcaActive
+			if plan.ScheduleFrom == "" {
+				plan.ScheduleFrom = plan.StartDate
+			}
+			if err := repo.CreateDcaPlan(ctx, &plan); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range c.steps {
+				count, err := ss.scheduleEntries(ctx, &plan, dcaCalendar(), step.today)
+				if err != nil {
+					t.Fatalf("%s: %v", step.today, err)
+				}
+				if count != step.count || plan.Status != step.status {
+					t.Fatalf("%s: got %d entries and status %s, want %d and %s", step.today, count, plan.Status, step.count, step.status)
+				}
+			}
+			entries, err := repo.GetDcaEntries(ctx, plan.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var periods []dcaPeriod
+			for _, entry := range *entries {
+				periods = append(periods, dcaPeriod{period: entry.PeriodDate, due: entry.DueDate})
+			}
+			if got := formatPeriods(periods); got != c.entries {
+				t.Fatalf("got entries %s, want %s", got, c.entries)
+			}
+		})
+	}
+}
+
+func TestLotsByAmount(t *testing.T) {
+	cases := []struct {
+		name    string
+		si      StockInfo
+		amount  float64
+		price   float64
+		want    string
+		wantErr string
+	}{
+		{"whole lots within the amount", StockInfo{Code: "600000", Market: MarketA, Type: InstrumentStock}, 10000, 9.9, "1000", ""},
+		{"one lot less to cover the fee", StockInfo{Code: "600000", Market: MarketA, Type: InstrumentStock}, 10000, 10, "900", ""},
+		{"star board buys by one share above the minimum", StockInfo{Code: "688001", Market: MarketA, Type: InstrumentStock}, 10000, 49.5, "201", ""},
+		{"star board below the minimum", StockInfo{Code: "688001", Market: MarketA, Type: InstrumentStock}, 5000, 49.5, "", "not enough to buy 200"},
+		{"less than one lot", StockInfo{Code: "600000", Market: MarketA, Type: InstrumentStock}, 500, 9.9, "", "not enough to buy 100"},
+		{"h share uses the stock lot size", StockInfo{Code: "00700", Market: MarketH, Type: InstrumentStock, LotSize: 100}, 50000, 320, "100", ""},
+		{"fund has no lots", StockInfo{Code: "000001", Market: MarketA, Type: InstrumentFund}, 1000, 1.2345, "0", ""},
+		{"stock without market has no lots", StockInfo{Code: "X001", Type: InstrumentStock}, 1000, 10, "0", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			spec, err := stockSpec(&c.si)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := lotsByAmount(&c.si, spec, c.amount, c.price)
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("got %s and error %v, want error %q", got, err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(qty(c.want)) {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+			cost := floatMulDecimal(c.price, got)
+			if total := cost + spec.Fee.EstimateFee(1, cost); total > c.amount {
+				t.Fatalf("cost %v with fee exceeds amount %v", total, c.amount)
+			}
+		})
+	}
+}
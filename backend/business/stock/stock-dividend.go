@@ -0,0 +1,252 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// GetDividends 查询股票的现金分红（为空时查询全部），按派息时间排列
+func (ss StockService) GetDividends(stockCode string) (*[]Dividend, error) {
+	ctx := ss.gtm.Context()
+	code, err := ss.resolveCode(ctx, stockCode)
+	if err != nil {
+		return nil, err
+	}
+	divs, err := ss.sr.GetDividends(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	for i := range *divs {
+		if err := ss.fillReinvest(ctx, &(*divs)[i]); err != nil {
+			return nil, err
+		}
+	}
+	return divs, nil
+}
+
+// RecordDividend 登记现金分红，派息日之前必须建仓。再投资价格大于 0 时按该价格在派息日收盘买入：
+// 有每手数量的品种按整手买入，其余按金额买入，买不足的零头作为现金留在组合中
+func (ss StockService) RecordDividend(operator string, d *Dividend) error {
+	if d.Amount <= 0 {
+		return exception.NewBusiness(400, "dividend amount must be positive")
+	}
+	if d.Tax < 0 {
+		return exception.NewBusiness(400, "dividend tax can not be negative")
+	}
+	if d.ReinvestPrice < 0 {
+		return exception.NewBusiness(400, "reinvest price can not be negative")
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		si, err := ss.validateDividend(ctx, d)
+		if err != nil {
+			return err
+		}
+
+		nowTime := time.Now()
+		d.ID = 0
+		d.TranID = 0
+		d.CreatedAt = nowTime
+		d.UpdatedAt = nowTime
+		// 先登记分红的资金流入，再投资买入时按包含分红的资金余额校验
+		if err := ss.sr.CreateDividend(ctx, d); err != nil {
+			return err
+		}
+		if d.ReinvestPrice > 0 {
+			tran, err := ss.reinvest(ctx, operator, si, d)
+			if err != nil {
+				return err
+			}
+			d.TranID = tran.ID
+			if err := ss.sr.UpdateDividend(ctx, d); err != nil {
+				return err
+			}
+		}
+		if err := ss.fillReinvest(ctx, d); err != nil {
+			return err
+		}
+		return ss.audit(ctx, operator, EntityDividend, idKey(d.ID), ActionCreate, nil, d)
+	})
+}
+
+// DeleteDividend 删除现金分红，同时删除再投资生成的买入交易
+func (ss StockService) DeleteDividend(operator string, id int64) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		d, err := ss.sr.GetDividend(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := ss.fillReinvest(ctx, d); err != nil {
+			return err
+		}
+		if err := ss.sr.DeleteDividend(ctx, id); err != nil {
+			return err
+		}
+		if d.Reinvested > 0 {
+			if err := ss.deleteTransaction(ctx, operator, d.TranID); err != nil {
+				return err
+			}
+		}
+		if err := ss.audit(ctx, operator, EntityDividend, idKey(d.ID), ActionDelete, d, nil); err != nil {
+			return err
+		}
+		return ss.checkCash(ctx, d.PortfolioID)
+	})
+}
+
+// validateDividend 校验股票、投资组合和派息日，派息时刻为市场时区派息日的零点
+func (ss StockService) validateDividend(ctx context.Context, d *Dividend) (*StockInfo, error) {
+	if d.StockCode == "" {
+		return nil, exception.NewBusiness(400, "stock code is empty")
+	}
+	code, err := ss.resolveCode(ctx, d.StockCode)
+	if err != nil {
+		return nil, err
+	}
+	si, err := ss.sr.GetStock(ctx, code)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, exception.WrapBusiness(404, "stock not found", err)
+		}
+		return nil, err
+	}
+	d.StockCode = si.Code
+	if d.PortfolioID != 0 {
+		if _, err := ss.sr.GetPortfolio(ctx, d.PortfolioID); err != nil {
+			if isNotFound(err) {
+				return nil, exception.WrapBusiness(404, "portfolio not found", err)
+			}
+			return nil, err
+		}
+	}
+	day, err := time.ParseInLocation(DateLayout, d.PayDate, marketLocation(si))
+	if err != nil {
+		return nil, exception.WrapBusiness(400, fmt.Sprintf("invalid pay date %q, expected yyyy-MM-dd", d.PayDate), err)
+	}
+	d.PaidAt = day.UTC()
+
+	invests, err := ss.sr.GetStockInvestments(ctx, d.PortfolioID, d.StockCode)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	if dividendInvestment(*invests, d.PaidAt) == nil {
+		return nil, exception.NewBusiness(400, fmt.Sprintf("no investment in %s before pay date %s", d.StockCode, d.PayDate))
+	}
+	return si, nil
+}
+
+// reinvest 按再投资价格用分红金额买入
+func (ss StockService) reinvest(ctx context.Context, operator string, si *StockInfo, d *Dividend) (*Transaction, error) {
+	spec, err := stockSpec(si)
+	if err != nil {
+		return nil, err
+	}
+	tran := &Transaction{
+		PortfolioID: d.PortfolioID,
+		StockCode:   d.StockCode,
+		Action:      1,
+		Price:       d.ReinvestPrice,
+		FinishTime:  d.PayDate + marketCloseTime(si),
+	}
+	if tran.Quantity, err = lotsByAmount(si, spec, d.Amount, d.ReinvestPrice); err != nil {
+		return nil, err
+	}
+	if tran.Quantity.IsZero() {
+		// 没有每手数量的品种（如场外基金）按金额买入
+		tran.Amount = d.Amount
+	}
+	if err := ss.addTransaction(ctx, operator, tran); err != nil {
+		return nil, err
+	}
+	return tran, nil
+}
+
+// fillReinvest 按再投资的买入交易计算再投资金额、数量和留作现金的零头，买入交易已删除时全部作为现金
+func (ss StockService) fillReinvest(ctx context.Context, d *Dividend) error {
+	d.Reinvested, d.ReinvestQty = 0, decimal.Zero
+	if d.TranID != 0 {
+		tran, err := ss.sr.GetTransaction(ctx, d.TranID)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		if err == nil && tran.Status == 0 {
+			d.Reinvested = round2Decimal(tran.Amount + tran.TaxFee)
+			d.ReinvestQty = tran.Quantity
+		}
+	}
+	d.Remainder = round2Decimal(d.Amount - d.Reinvested)
+	return nil
+}
+
+// dividendInvestment 分红归属派息时已建仓的最后一笔投资
+func dividendInvestment(invests []Investment, paidAt time.Time) *Investment {
+	var found *Investment
+	for i := range invests {
+		if !invests[i].OpenAt.After(paidAt) && (found == nil || invests[i].OpenAt.After(found.OpenAt)) {
+			found = &invests[i]
+		}
+	}
+	return found
+}
+
+// fillDividends 按分红归属计算投资的累计分红、再投资金额和数量，以及净盈亏加分红的总收益
+func (ss StockService) fillDividends(ctx context.Context, invests []Investment) error {
+	type totals struct {
+		dividend   decimal.Decimal
+		reinvested decimal.Decimal
+		quantity   decimal.Decimal
+	}
+	byInvest := make(map[int64]*totals)
+	loaded := make(map[holdingKey]bool)
+	for _, invest := range invests {
+		key := holdingKey{invest.PortfolioID, invest.StockCode}
+		if loaded[key] {
+			continue
+		}
+		loaded[key] = true
+		divs, err := ss.sr.GetStockDividends(ctx, key.portfolioId, key.stockCode)
+		if err != nil {
+			return err
+		}
+		if len(*divs) == 0 {
+			continue
+		}
+		all, err := ss.sr.GetStockInvestments(ctx, key.portfolioId, key.stockCode)
+		if err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		for i := range *divs {
+			d := &(*divs)[i]
+			owner := dividendInvestment(*all, d.PaidAt)
+			if owner == nil {
+				continue
+			}
+			if err := ss.fillReinvest(ctx, d); err != nil {
+				return err
+			}
+			t, ok := byInvest[owner.ID]
+			if !ok {
+				t = &totals{decimal.Zero, decimal.Zero, decimal.Zero}
+				byInvest[owner.ID] = t
+			}
+			t.dividend = t.dividend.Add(decimal.NewFromFloat(d.Amount))
+			t.reinvested = t.reinvested.Add(decimal.NewFromFloat(d.Reinvested))
+			t.quantity = t.quantity.Add(d.ReinvestQty)
+		}
+	}
+
+	for i := range invests {
+		invest := &invests[i]
+		invest.Dividend, invest.Reinvested, invest.ReinvestQty = 0, 0, decimal.Zero
+		if t, ok := byInvest[invest.ID]; ok {
+			invest.Dividend = t.dividend.RoundBank(2).InexactFloat64()
+			invest.Reinvested = t.reinvested.RoundBank(2).InexactFloat64()
+			invest.ReinvestQty = t.quantity
+		}
+		invest.TotalReturn = round2Decimal(invest.ProfitLoss + invest.Dividend)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	GridActive = "active"
+	GridClosed = "closed"
+
+	maxGridCount = 200
+)
+
+// GetGridPlans 查询网格计划，status 为空时返回所有状态
+func (ss StockService) GetGridPlans(status string) (*[]GridPlan, error) {
+	plans, err := ss.sr.GetGridPlans(ss.gtm.Context())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]GridPlan, 0, len(*plans))
+	for _, plan := range *plans {
+		if status == "" || plan.Status == status {
+			result = append(result, plan)
+		}
+	}
+	return &result, nil
+}
+
+// SaveGridPlan 新增网格计划
+func (ss StockService) SaveGridPlan(plan *GridPlan) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		if err := ss.validateGridPlan(ctx, plan); err != nil {
+			return err
+		}
+		plan.ID = 0
+		plan.Status = GridActive
+		plan.CreatedAt = time.Now()
+		plan.UpdatedAt = time.Now()
+		return ss.sr.CreateGridPlan(ctx, plan)
+	})
+}
+
+// UpdateGridPlan 修改运行中的网格计划，股票和投资组合不能修改
+func (ss StockService) UpdateGridPlan(plan *GridPlan) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		oplan, err := ss.sr.GetGridPlan(ctx, plan.ID)
+		if err != nil {
+			return err
+		}
+		if oplan.Status != GridActive {
+			return exception.NewBusiness(400, fmt.Sprintf("grid plan is %s and can not be modified", oplan.Status))
+		}
+		plan.StockCode = oplan.StockCode
+		plan.PortfolioID = oplan.PortfolioID
+		if err := ss.validateGridPlan(ctx, plan); err != nil {
+			return err
+		}
+
+		oplan.LowerPrice = plan.LowerPrice
+		oplan.UpperPrice = plan.UpperPrice
+		oplan.GridCount = plan.GridCount
+		oplan.GridQuantity = plan.GridQuantity
+		oplan.BasePosition = plan.BasePosition
+		oplan.StartTime = plan.StartTime
+		oplan.Remark = plan.Remark
+		oplan.UpdatedAt = time.Now()
+		return ss.sr.UpdateGridPlan(ctx, oplan)
+	})
+}
+
+// CloseGridPlan 结束网格计划，已有的交易保留
+func (ss StockService) CloseGridPlan(id int64) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		plan, err := ss.sr.GetGridPlan(ctx, id)
+		if err != nil {
+			return err
+		}
+		if plan.Status == GridClosed {
+			return exception.NewBusiness(400, "grid plan is already closed")
+		}
+		plan.Status = GridClosed
+		plan.UpdatedAt = time.Now()
+		return ss.sr.UpdateGridPlan(ctx, plan)
+	})
+}
+
+// GetGridStatus 将组合中该股票的交易映射到网格，返回各网格的持有情况、建议的买卖价格以及网格收益和底仓盈亏
+func (ss StockService) GetGridStatus(id int64) (*GridStatus, error) {
+	ctx := ss.gtm.Context()
+	plan, err := ss.sr.GetGridPlan(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	si, err := ss.stockOf(ctx, plan.StockCode)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := stockSpec(si)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := ss.sr.GetStockTransactions(ctx, plan.PortfolioID, plan.StockCode)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+
+	grid := newGridBook(plan, spec.PricePrecision)
+	for _, t := range *trans {
+		grid.apply(t)
+	}
+
+	price := 0.0
+	if n := len(*trans); n > 0 {
+		price = (*trans)[n-1].Price
+	}
+	price, err = ss.referencePrice(ctx, plan.StockCode, price)
+	if err != nil {
+		return nil, err
+	}
+	return grid.status(price), nil
+}
+
+func (ss StockService) validateGridPlan(ctx context.Context, plan *GridPlan) error {
+	if plan.StockCode == "" {
+		return exception.NewBusiness(400, "stock code is empty")
+	}
+	if plan.LowerPrice <= 0 {
+		return exception.NewBusiness(400, "lower price must be positive")
+	}
+	if plan.UpperPrice <= plan.LowerPrice {
+		return exception.NewBusiness(400, "upper price must be greater than lower price")
+	}
+	if plan.GridCount < 1 || plan.GridCount > maxGridCount {
+		return exception.NewBusiness(400, fmt.Sprintf("grid count must be between 1 and %d", maxGridCount))
+	}
+	if !plan.GridQuantity.IsPositive() {
+		return exception.NewBusiness(400, "grid quantity must be positive")
+	}
+	if plan.BasePosition.IsNegative() {
+		return exception.NewBusiness(400, "base position can not be negative")
+	}
+	if plan.StartTime != "" {
+		if _, err := time.Parse(DateTimeLayout, plan.StartTime); err != nil {
+			if _, err := time.Parse(DateLayout, plan.StartTime); err != nil {
+				return exception.WrapBusiness(400, "invalid start time: "+plan.StartTime, err)
+			}
+		}
+	}
+	if plan.PortfolioID != 0 {
+		if _, err := ss.sr.GetPortfolio(ctx, plan.PortfolioID); err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "portfolio not found", err)
+			}
+			return err
+		}
+	}
+	si, err := ss.sr.GetStock(ctx, plan.StockCode)
+	if err != nil {
+		if isNotFound(err) {
+			return exception.WrapBusiness(404, "stock not found", err)
+		}
+		return err
+	}
+	spec, err := stockSpec(si)
+	if err != nil {
+		return err
+	}
+	// 每格数量须是一笔可以成交的数量
+	if err := spec.Validate(&Transaction{Price: plan.LowerPrice, Quantity: plan.GridQuantity}); err != nil {
+		return err
+	}
+	if rule := GetMarketRule(si.Market); rule != nil && rule.applies(spec) {
+		return rule.checkLot(si, &Transaction{Action: 1, Quantity: plan.GridQuantity}, decimal.Zero)
+	}
+	return nil
+}
+
+// 网格的持有情况
+type gridSlot struct {
+	level  GridLevel
+	cost   decimal.Decimal // 实际买入价
+	fee    decimal.Decimal // 分摊的买入税费
+	profit decimal.Decimal
+}
+
+// gridBook 按成交时间逐笔将交易映射到网格：开始时间之前的交易计入底仓；
+// 之后的买入先补足底仓，再按每格数量逐格买入价格最接近的空网格，卖出按每格数量逐格卖出卖出价最接近的持有网格，
+// 不足一格或没有可用网格的数量计入底仓，税费按数量分摊
+type gridBook struct {
+	plan       *GridPlan
+	slots      []*gridSlot
+	baseQty    decimal.Decimal
+	baseCost   decimal.Decimal // 底仓成本金额（含税费）
+	baseProfit decimal.Decimal
+	taxFee     decimal.Decimal
+}
+
+func newGridBook(plan *GridPlan, precision int) *gridBook {
+	book := &gridBook{plan: plan}
+	lower := decimal.NewFromFloat(plan.LowerPrice)
+	step := decimal.NewFromFloat(plan.UpperPrice).Sub(lower).Div(decimal.NewFromInt(int64(plan.GridCount)))
+	price := func(i int) float64 {
+		return lower.Add(step.Mul(decimal.NewFromInt(int64(i)))).Round(int32(precision)).InexactFloat64()
+	}
+	for i := 0; i < plan.GridCount; i++ {
+		book.slots = append(book.slots, &gridSlot{level: GridLevel{Index: i, BuyPrice: price(i), SellPrice: price(i + 1), Quantity: decimal.Zero}})
+	}
+	return book
+}
+
+func (gb *gridBook) apply(t Transaction) {
+	price := decimal.NewFromFloat(t.Price)
+	fee := decimal.NewFromFloat(t.TaxFee)
+	gb.taxFee = gb.taxFee.Add(fee)
+	feeOf := func(qty decimal.Decimal) decimal.Decimal {
+		return fee.Mul(qty).Div(t.Quantity)
+	}
+	remaining := t.Quantity
+	if gb.plan.StartTime != "" && t.FinishTime < gb.plan.StartTime {
+		gb.base(t.Action, price, remaining, feeOf(remaining))
+		return
+	}
+
+	unit := gb.plan.GridQuantity
+	if t.Action == 1 {
+		if short := gb.plan.BasePosition.Sub(gb.baseQty); short.IsPositive() {
+			qty := decimal.Min(short, remaining)
+			gb.base(1, price, qty, feeOf(qty))
+			remaining = remaining.Sub(qty)
+		}
+		for !remaining.LessThan(unit) {
+			slot := gb.nearest(t.Price, false)
+			if slot == nil {
+				break
+			}
+			slot.level.Filled = true
+			slot.level.Quantity = unit
+			slot.level.CostPrice = t.Price
+			slot.level.TranID = t.ID
+			slot.cost = price
+			slot.fee = feeOf(unit)
+			remaining = remaining.Sub(unit)
+		}
+	} else {
+		for !remaining.LessThan(unit) {
+			slot := gb.nearest(t.Price, true)
+			if slot == nil {
+				break
+			}
+			profit := price.Sub(slot.cost).Mul(unit).Sub(slot.fee).Sub(feeOf(unit))
+			slot.profit = slot.profit.Add(profit)
+			slot.level.Trips++
+			slot.level.Filled = false
+			slot.level.Quantity = decimal.Zero
+			slot.level.CostPrice = 0
+			slot.level.TranID = 0
+			remaining = remaining.Sub(unit)
+		}
+	}
+	if remaining.IsPositive() {
+		gb.base(t.Action, price, remaining, feeOf(remaining))
+	}
+}
+
+// nearest 返回买入价（filled 为 false 时在空网格中）或卖出价（filled 为 true 时在持有网格中）与价格最接近的网格
+func (gb *gridBook) nearest(price float64, filled bool) *gridSlot {
+	var found *gridSlot
+	best := 0.0
+	for _, slot := range gb.slots {
+		if slot.level.Filled != filled {
+			continue
+		}
+		level := slot.level.BuyPrice
+		if filled {
+			level = slot.level.SellPrice
+		}
+		diff := level - price
+		if diff < 0 {
+			diff = -diff
+		}
+		if found == nil || diff < best {
+			found, best = slot, diff
+		}
+	}
+	return found
+}
+
+// base 底仓按含税费的平均成本计算卖出盈亏
+func (gb *gridBook) base(action int8, price decimal.Decimal, qty decimal.Decimal, fee decimal.Decimal) {
+	if action == 1 {
+		gb.baseQty = gb.baseQty.Add(qty)
+		gb.baseCost = gb.baseCost.Add(price.Mul(qty)).Add(fee)
+		return
+	}
+	if !gb.baseQty.IsPositive() {
+		gb.baseProfit = gb.baseProfit.Sub(fee)
+		return
+	}
+	qty = decimal.Min(qty, gb.baseQty)
+	cost := gb.baseCost.Mul(qty).Div(gb.baseQty)
+	gb.baseProfit = gb.baseProfit.Add(price.Mul(qty)).Sub(fee).Sub(cost)
+	gb.baseCost = gb.baseCost.Sub(cost)
+	gb.baseQty = gb.baseQty.Sub(qty)
+}
+
+func (gb *gridBook) status(price float64) *GridStatus {
+	ref := decimal.NewFromFloat(price)
+	status := &GridStatus{Plan: gb.plan, Price: price, GridQuantity: decimal.Zero, BaseQuantity: gb.baseQty}
+	profit, floating := decimal.Zero, decimal.Zero
+	for _, slot := range gb.slots {
+		slot.level.Profit = slot.profit.RoundBank(2).InexactFloat64()
+		status.Levels = append(status.Levels, slot.level)
+		status.GridTrips += slot.level.Trips
+		profit = profit.Add(slot.profit)
+		if slot.level.Filled {
+			status.FilledCount++
+			status.GridQuantity = status.GridQuantity.Add(slot.level.Quantity)
+			floating = floating.Add(ref.Sub(slot.cost).Mul(slot.level.Quantity)).Sub(slot.fee)
+			if status.NextSellPrice == 0 || slot.level.SellPrice < status.NextSellPrice {
+				status.NextSellPrice = slot.level.SellPrice
+			}
+		} else if (price == 0 || slot.level.BuyPrice < price) && slot.level.BuyPrice > status.NextBuyPrice {
+			status.NextBuyPrice = slot.level.BuyPrice
+		}
+	}
+	status.GridProfit = profit.RoundBank(2).InexactFloat64()
+	if price > 0 {
+		status.GridFloating = floating.RoundBank(2).InexactFloat64()
+		status.BaseFloating = ref.Mul(gb.baseQty).Sub(gb.baseCost).RoundBank(2).InexactFloat64()
+	}
+	if gb.baseQty.IsPositive() {
+		status.BaseCost = gb.baseCost.Div(gb.baseQty).Round(4).InexactFloat64()
+	}
+	status.BaseProfitLoss = gb.baseProfit.RoundBank(2).InexactFloat64()
+	status.TaxFee = gb.taxFee.RoundBank(2).InexactFloat64()
+	return status
+}
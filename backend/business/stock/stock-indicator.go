@@ -0,0 +1,310 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"pixiu/backend/pkg/exception"
+	"strconv"
+	"strings"
+)
+
+const (
+	IndicatorMA   = "ma"   // 简单移动平均（周期）
+	IndicatorEMA  = "ema"  // 指数移动平均（周期）
+	IndicatorMACD = "macd" // 指数平滑异同移动平均（快线周期、慢线周期、信号线周期）
+	IndicatorRSI  = "rsi"  // 相对强弱指标（周期）
+	IndicatorBOLL = "boll" // 布林带（周期、标准差倍数）
+	IndicatorATR  = "atr"  // 平均真实波幅（周期）
+	IndicatorVMA  = "vma"  // 成交量移动平均（周期）
+)
+
+// 各指标的默认参数
+var indicatorDefaults = map[string][]float64{
+	IndicatorMA:   {20},
+	IndicatorEMA:  {20},
+	IndicatorMACD: {12, 26, 9},
+	IndicatorRSI:  {14},
+	IndicatorBOLL: {20, 2},
+	IndicatorATR:  {14},
+	IndicatorVMA:  {5},
+}
+
+// 指标序列，与行情逐日对应，数据不足的日期为 NaN（JSON 中为 null）
+type Series []float64
+
+func (s Series) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, len(s)*8+2)
+	buf = append(buf, '[')
+	for i, v := range s {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			buf = append(buf, "null"...)
+		} else {
+			buf = strconv.AppendFloat(buf, math.Round(v*10000)/10000, 'f', -1, 64)
+		}
+	}
+	return append(buf, ']'), nil
+}
+
+// 指标及其参数，参数为空时使用默认参数
+type IndicatorSpec struct {
+	Name   string    `json:"name"`
+	Params []float64 `json:"params"`
+}
+
+// 指标线，如 MA20，MACD 有 DIF、DEA、MACD 三条线
+type IndicatorLine struct {
+	Name      string    `json:"name"`      // 线名称
+	Indicator string    `json:"indicator"` // 指标
+	Params    []float64 `json:"params"`    // 指标参数
+	Values    Series    `json:"values"`    // 指标值
+}
+
+type IndicatorResult struct {
+	StockCode string          `json:"stockCode"`
+	Adjust    string          `json:"adjust"`
+	Dates     []string        `json:"dates"`
+	Lines     []IndicatorLine `json:"lines"`
+}
+
+// GetIndicators 按复权方式计算日期范围内的技术指标，计算包含开始日期之前的行情，开始日期的指标值不受范围影响
+func (ss StockService) GetIndicators(stockCode string, startDate string, endDate string, adjust string, specs []IndicatorSpec) (*IndicatorResult, error) {
+	if stockCode == "" {
+		return nil, exception.NewBusiness(400, "stock code is empty")
+	}
+	if len(specs) == 0 {
+		return nil, exception.NewBusiness(400, "indicators are required")
+	}
+	return ss.indicators(ss.gtm.Context(), stockCode, startDate, endDate, adjust, specs)
+}
+
+func (ss StockService) indicators(ctx context.Context, stockCode string, startDate string, endDate string, adjust string, specs []IndicatorSpec) (*IndicatorResult, error) {
+	bars, err := ss.priceBars(ctx, stockCode, "", endDate, adjust)
+	if err != nil {
+		return nil, err
+	}
+	from := 0
+	for from < len(bars.adjusted) && bars.adjusted[from].Date < startDate {
+		from++
+	}
+
+	result := &IndicatorResult{StockCode: stockCode, Adjust: adjust, Dates: make([]string, 0, len(bars.adjusted)-from)}
+	for _, bar := range bars.adjusted[from:] {
+		result.Dates = append(result.Dates, bar.Date)
+	}
+	for _, spec := range specs {
+		lines, err := CalcIndicator(bars.adjusted, spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			line.Values = line.Values[from:]
+			result.Lines = append(result.Lines, line)
+		}
+	}
+	return result, nil
+}
+
+// CalcIndicator 计算行情（按日期升序）的技术指标
+func CalcIndicator(bars []PriceBar, spec IndicatorSpec) ([]IndicatorLine, error) {
+	name := strings.ToLower(spec.Name)
+	params := spec.Params
+	defaults, ok := indicatorDefaults[name]
+	if !ok {
+		return nil, exception.NewBusiness(400, "unknown indicator: "+spec.Name)
+	}
+	if len(params) == 0 {
+		params = defaults
+	}
+	if len(params) != len(defaults) {
+		return nil, exception.NewBusiness(400, fmt.Sprintf("indicator %s requires %d params", name, len(defaults)))
+	}
+	periods := make([]int, len(params))
+	for i, p := range params {
+		periods[i] = int(p)
+		// 布林带的第二个参数是标准差倍数，其他参数都是周期
+		if p <= 0 || (float64(periods[i]) != p && !(name == IndicatorBOLL && i == 1)) {
+			return nil, exception.NewBusiness(400, fmt.Sprintf("invalid param %v of indicator %s", p, name))
+		}
+	}
+
+	closes := make([]float64, len(bars))
+	for i, bar := range bars {
+		closes[i] = bar.Close
+	}
+	line := func(label string, values []float64) IndicatorLine {
+		return IndicatorLine{Name: label, Indicator: name, Params: params, Values: values}
+	}
+
+	switch name {
+	case IndicatorMA:
+		return []IndicatorLine{line(fmt.Sprintf("MA%d", periods[0]), SMA(closes, periods[0]))}, nil
+	case IndicatorEMA:
+		return []IndicatorLine{line(fmt.Sprintf("EMA%d", periods[0]), EMA(closes, periods[0]))}, nil
+	case IndicatorMACD:
+		dif, dea, hist := MACD(closes, periods[0], periods[1], periods[2])
+		return []IndicatorLine{line("DIF", dif), line("DEA", dea), line("MACD", hist)}, nil
+	case IndicatorRSI:
+		return []IndicatorLine{line(fmt.Sprintf("RSI%d", periods[0]), RSI(closes, periods[0]))}, nil
+	case IndicatorBOLL:
+		mid, upper, lower := Bollinger(closes, periods[0], params[1])
+		return []IndicatorLine{line("MID", mid), line("UPPER", upper), line("LOWER", lower)}, nil
+	case IndicatorATR:
+		return []IndicatorLine{line(fmt.Sprintf("ATR%d", periods[0]), ATR(bars, periods[0]))}, nil
+	default:
+		volumes := make([]float64, len(bars))
+		for i, bar := range bars {
+			volumes[i] = bar.Volume
+		}
+		return []IndicatorLine{line(fmt.Sprintf("VMA%d", periods[0]), SMA(volumes, periods[0]))}, nil
+	}
+}
+
+// nanSeries 返回长度为 n 的 NaN 序列
+func nanSeries(n int) []float64 {
+	s := make([]float64, n)
+	for i := range s {
+		s[i] = math.NaN()
+	}
+	return s
+}
+
+// SMA 简单移动平均，前 period-1 个值为 NaN
+func SMA(values []float64, period int) []float64 {
+	result := nanSeries(len(values))
+	sum := 0.0
+	for i, v := range values {
+		sum += v
+		if i >= period {
+			sum -= values[i-period]
+		}
+		if i >= period-1 {
+			result[i] = sum / float64(period)
+		}
+	}
+	return result
+}
+
+// EMA 指数移动平均，平滑系数为 2/(period+1)，以第一个完整周期的简单平均为初值；
+// 序列开头的 NaN 被跳过
+func EMA(values []float64, period int) []float64 {
+	result := nanSeries(len(values))
+	start := 0
+	for start < len(values) && math.IsNaN(values[start]) {
+		start++
+	}
+	if len(values)-start < period {
+		return result
+	}
+	alpha := 2 / float64(period+1)
+	sum := 0.0
+	for _, v := range values[start : start+period] {
+		sum += v
+	}
+	ema := sum / float64(period)
+	result[start+period-1] = ema
+	for i := start + period; i < len(values); i++ {
+		ema += alpha * (values[i] - ema)
+		result[i] = ema
+	}
+	return result
+}
+
+// MACD 返回 DIF（快线 EMA 减慢线 EMA）、DEA（DIF 的 EMA）和 MACD 柱（2 倍的 DIF 减 DEA）
+func MACD(values []float64, fast int, slow int, signal int) ([]float64, []float64, []float64) {
+	fastEMA, slowEMA := EMA(values, fast), EMA(values, slow)
+	dif := make([]float64, len(values))
+	for i := range values {
+		dif[i] = fastEMA[i] - slowEMA[i]
+	}
+	dea := EMA(dif, signal)
+	hist := make([]float64, len(values))
+	for i := range values {
+		hist[i] = 2 * (dif[i] - dea[i])
+	}
+	return dif, dea, hist
+}
+
+// RSI 相对强弱指标，平均涨跌幅按 Wilder 平滑计算
+func RSI(values []float64, period int) []float64 {
+	result := nanSeries(len(values))
+	if len(values) <= period {
+		return result
+	}
+	var gain, loss float64
+	for i := 1; i <= period; i++ {
+		change := values[i] - values[i-1]
+		gain += max(change, 0)
+		loss += max(-change, 0)
+	}
+	gain, loss = gain/float64(period), loss/float64(period)
+	result[period] = rsiValue(gain, loss)
+	for i := period + 1; i < len(values); i++ {
+		change := values[i] - values[i-1]
+		gain = (gain*float64(period-1) + max(change, 0)) / float64(period)
+		loss = (loss*float64(period-1) + max(-change, 0)) / float64(period)
+		result[i] = rsiValue(gain, loss)
+	}
+	return result
+}
+
+func rsiValue(gain float64, loss float64) float64 {
+	if loss == 0 {
+		if gain == 0 {
+			return 50
+		}
+		return 100
+	}
+	return 100 - 100/(1+gain/loss)
+}
+
+// Bollinger 布林带，返回中轨（简单移动平均）、上轨和下轨（中轨加减 k 倍总体标准差）
+func Bollinger(values []float64, period int, k float64) ([]float64, []float64, []float64) {
+	mid, upper, lower := nanSeries(len(values)), nanSeries(len(values)), nanSeries(len(values))
+	sum, sumSq := 0.0, 0.0
+	for i, v := range values {
+		sum += v
+		sumSq += v * v
+		if i >= period {
+			old := values[i-period]
+			sum -= old
+			sumSq -= old * old
+		}
+		if i >= period-1 {
+			mean := sum / float64(period)
+			std := math.Sqrt(max(sumSq/float64(period)-mean*mean, 0))
+			mid[i], upper[i], lower[i] = mean, mean+k*std, mean-k*std
+		}
+	}
+	return mid, upper, lower
+}
+
+// ATR 平均真实波幅，真实波幅取最高价减最低价、与前收盘价差值中的最大值，按 Wilder 平滑计算
+func ATR(bars []PriceBar, period int) []float64 {
+	result := nanSeries(len(bars))
+	if len(bars) < period {
+		return result
+	}
+	tr := func(i int) float64 {
+		bar := bars[i]
+		if i == 0 {
+			return bar.High - bar.Low
+		}
+		prev := bars[i-1].Close
+		return max(bar.High-bar.Low, math.Abs(bar.High-prev), math.Abs(bar.Low-prev))
+	}
+	atr := 0.0
+	for i := 0; i < period; i++ {
+		atr += tr(i)
+	}
+	atr /= float64(period)
+	result[period-1] = atr
+	for i := period; i < len(bars); i++ {
+		atr = (atr*float64(period-1) + tr(i)) / float64(period)
+		result[i] = atr
+	}
+	return result
+}
@@ -0,0 +1,182 @@
+package stock
+
+import (
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	InstrumentStock = "stock" // 股票
+	InstrumentETF   = "etf"   // 交易所基金（ETF、LOF）
+	InstrumentFund  = "fund"  // 场外基金
+	InstrumentBond  = "bond"  // 交易所债券
+	InstrumentCBond = "cbond" // 可转债
+)
+
+// 费用规则：费用 = max(成交金额 × 费率, 最低费用)，卖出另收印花税
+type FeeRule struct {
+	Rate        float64 `json:"rate"`        // 费率（佣金、过户费等合计）
+	MinFee      float64 `json:"minFee"`      // 最低费用
+	SellTaxRate float64 `json:"sellTaxRate"` // 卖出印花税率
+}
+
+// 品种交易规则
+type InstrumentSpec struct {
+	Type              string  `json:"type"`              // 品种类型
+	Name              string  `json:"name"`              // 品种名称
+	PricePrecision    int     `json:"pricePrecision"`    // 价格小数位数
+	QuantityPrecision int     `json:"quantityPrecision"` // 数量小数位数（场外基金份额为小数）
+	QuantityUnit      int     `json:"quantityUnit"`      // 数量单位（成交数量须为其整数倍）
+	SettleDays        int     `json:"settleDays"`        // 交收周期（T+N）
+	T0                bool    `json:"t0"`                // 是否支持当日买入当日卖出
+	Fee               FeeRule `json:"fee"`               // 费用规则
+}
+
+var instrumentSpecs = map[string]*InstrumentSpec{
+	InstrumentStock: {Type: InstrumentStock, Name: "股票", PricePrecision: 2, QuantityUnit: 1, SettleDays: 1, T0: false,
+		Fee: FeeRule{Rate: 0.00137}},
+	InstrumentETF: {Type: InstrumentETF, Name: "ETF", PricePrecision: 3, QuantityUnit: 1, SettleDays: 1, T0: false,
+		Fee: FeeRule{Rate: 0.0003}},
+	InstrumentFund: {Type: InstrumentFund, Name: "场外基金", PricePrecision: 4, QuantityPrecision: 2, QuantityUnit: 1, SettleDays: 1, T0: false,
+		Fee: FeeRule{Rate: 0.0015}},
+	InstrumentBond: {Type: InstrumentBond, Name: "债券", PricePrecision: 3, QuantityUnit: 10, SettleDays: 0, T0: true,
+		Fee: FeeRule{Rate: 0.0001}},
+	InstrumentCBond: {Type: InstrumentCBond, Name: "可转债", PricePrecision: 3, QuantityUnit: 10, SettleDays: 0, T0: true,
+		Fee: FeeRule{Rate: 0.0001}},
+}
+
+// GetInstrumentSpec 返回品种的交易规则，未设置品种的按股票处理
+func GetInstrumentSpec(instType string) (*InstrumentSpec, error) {
+	if instType == "" {
+		instType = InstrumentStock
+	}
+	spec, ok := instrumentSpecs[instType]
+	if !ok {
+		return nil, exception.NewBusiness(400, "unknown instrument type: "+instType)
+	}
+	return spec, nil
+}
+
+// InstrumentSpecs 返回所有品种的交易规则
+func InstrumentSpecs() []InstrumentSpec {
+	specs := make([]InstrumentSpec, 0, len(instrumentSpecs))
+	for _, spec := range instrumentSpecs {
+		specs = append(specs, *spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Type < specs[j].Type })
+	return specs
+}
+
+// stockSpec 返回股票的交易规则，市场设置的交收周期和费用规则覆盖品种的规则，股票设置了数量精度时覆盖品种的数量精度
+func stockSpec(si *StockInfo) (*InstrumentSpec, error) {
+	spec, err := GetInstrumentSpec(si.Type)
+	if err != nil {
+		return nil, err
+	}
+	if rule := GetMarketRule(si.Market); rule != nil {
+		spec = rule.spec(spec)
+	}
+	if si.QuantityPrecision != nil && *si.QuantityPrecision != spec.QuantityPrecision {
+		custom := *spec
+		custom.QuantityPrecision = *si.QuantityPrecision
+		return &custom, nil
+	}
+	return spec, nil
+}
+
+// EstimateFee 按费用规则估算交易税费
+func (fr FeeRule) EstimateFee(action int8, amount float64) float64 {
+	fee := decimal.NewFromFloat(amount).Mul(decimal.NewFromFloat(fr.Rate))
+	if min := decimal.NewFromFloat(fr.MinFee); fee.LessThan(min) {
+		fee = min
+	}
+	if action == -1 && fr.SellTaxRate > 0 {
+		fee = fee.Add(decimal.NewFromFloat(amount).Mul(decimal.NewFromFloat(fr.SellTaxRate)))
+	}
+	return fee.RoundBank(2).InexactFloat64()
+}
+
+// SellAmountFor 返回卖出后扣除税费净得 net 所需的卖出金额
+func (fr FeeRule) SellAmountFor(net decimal.Decimal) decimal.Decimal {
+	one := decimal.NewFromInt(1)
+	rate := decimal.NewFromFloat(fr.Rate)
+	tax := decimal.NewFromFloat(fr.SellTaxRate)
+	amount := net.Div(one.Sub(rate).Sub(tax))
+	// 按费率计算的费用低于最低费用时按最低费用计算
+	if minFee := decimal.NewFromFloat(fr.MinFee); amount.Mul(rate).LessThan(minFee) {
+		amount = net.Add(minFee).Div(one.Sub(tax))
+	}
+	return amount
+}
+
+// UnitsByAmount 按金额买入（如场外基金申购）时，按净值计算可得份额：
+// 未指定费用时按外扣法估算（费用 = 金额 - 金额 / (1 + 费率)），份额按数量精度截断
+func (spec *InstrumentSpec) UnitsByAmount(amount float64, nav float64, fee float64) (decimal.Decimal, float64) {
+	gross := decimal.NewFromFloat(amount)
+	if fee == 0 {
+		one := decimal.NewFromInt(1)
+		f := gross.Sub(gross.Div(one.Add(decimal.NewFromFloat(spec.Fee.Rate))))
+		if min := decimal.NewFromFloat(spec.Fee.MinFee); f.LessThan(min) {
+			f = min
+		}
+		fee = f.RoundBank(2).InexactFloat64()
+	}
+	units := gross.Sub(decimal.NewFromFloat(fee)).Div(decimal.NewFromFloat(nav)).Truncate(int32(spec.QuantityPrecision))
+	return units, fee
+}
+
+// Validate 校验成交价格精度、成交数量精度和成交数量单位
+func (spec *InstrumentSpec) Validate(tran *Transaction) error {
+	price := decimal.NewFromFloat(tran.Price)
+	if !price.Equal(price.Round(int32(spec.PricePrecision))) {
+		return exception.NewBusiness(400, fmt.Sprintf("%s price allows at most %d decimals", spec.Type, spec.PricePrecision))
+	}
+	if !tran.Quantity.Equal(tran.Quantity.Truncate(int32(spec.QuantityPrecision))) {
+		return exception.NewBusiness(400, fmt.Sprintf("%s quantity allows at most %d decimals", spec.Type, spec.QuantityPrecision))
+	}
+	if spec.QuantityUnit > 1 && !tran.Quantity.Mod(decimal.NewFromInt(int64(spec.QuantityUnit))).IsZero() {
+		return exception.NewBusiness(400, fmt.Sprintf("%s quantity must be a multiple of %d", spec.Type, spec.QuantityUnit))
+	}
+	return nil
+}
+
+// SettleDate 按交收周期和交易日历计算交收日期
+func (spec *InstrumentSpec) SettleDate(finish time.Time, tc *TradingCalendar) time.Time {
+	return tc.AddTradingDays(finish, spec.SettleDays)
+}
+
+// CheckSellable 校验 T+1 品种当日买入的数量不能在当日卖出：holding 为该笔交易成交之前的持仓，
+// dayBought 为其中当日买入的数量，超过持仓的卖出由重建持仓时报告
+func (spec *InstrumentSpec) CheckSellable(tran *Transaction, holding decimal.Decimal, dayBought decimal.Decimal) error {
+	if spec.T0 || tran.Action != -1 || tran.Quantity.GreaterThan(holding) {
+		return nil
+	}
+	if tran.Quantity.GreaterThan(holding.Sub(dayBought)) {
+		return exception.NewBusiness(400, fmt.Sprintf("%s is T+1, quantity bought on %s can not be sold the same day", spec.Type, dateOf(tran.FinishTime)))
+	}
+	return nil
+}
+
+func (spec *InstrumentSpec) settleDate(finishTime string, tc *TradingCalendar) string {
+	finish, err := time.Parse(DateLayout, dateOf(finishTime))
+	if err != nil {
+		return ""
+	}
+	return spec.SettleDate(finish, tc).Format(DateLayout)
+}
+
+// signedQuantity 返回带方向的成交数量，买入为正、卖出为负
+func signedQuantity(t Transaction) decimal.Decimal {
+	return t.Quantity.Mul(decimal.NewFromInt(int64(t.Action)))
+}
+
+func dateOf(datetime string) string {
+	if len(datetime) >= 10 {
+		return datetime[:10]
+	}
+	return datetime
+}
@@ -0,0 +1,466 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"pixiu/backend/pkg/exception"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	IssueMismatch         = "mismatch"           // 投资汇总与交易记录不一致
+	IssueOrphanTrans      = "orphan_transaction" // 交易记录关联的投资不存在
+	IssueEmptyInvest      = "empty_investment"   // 投资没有交易记录
+	IssueMultipleOpen     = "multiple_open"      // 同一股票存在多个持仓投资
+	IssueNegativeQuantity = "negative_quantity"  // 按时间累计的持仓数量为负
+	IssueUnsplit          = "unsplit"            // 持仓归零后仍有交易，应拆分为新的投资
+	IssueMissingTime      = "missing_time"       // 交易没有成交时刻（旧版本的成交时间无法解析）
+	IssueRebuildFailed    = "rebuild_failed"     // 重新计算持仓失败
+)
+
+const (
+	MigrationStampTime = "stamp_finish_time"     // 旧版本的成交时间按市场时区解析为成交时刻
+	MigrationRecompute = "recompute_investments" // 重新计算所有投资（旧版本的投资缺少新增的汇总字段或成交时刻）
+)
+
+// 数据迁移按顺序执行，run 返回执行结果和是否全部完成
+var migrations = []struct {
+	name string
+	run  func(ms *MaintainService) (string, bool, error)
+}{
+	{MigrationStampTime, (*MaintainService).migrateStampTime},
+	{MigrationRecompute, (*MaintainService).migrateRecompute},
+}
+
+// 数据维护服务：校验投资汇总与交易记录的一致性，并可在一个数据库事务中修复
+type MaintainService struct {
+	ss *StockService
+}
+
+func NewMaintainService(ss *StockService) *MaintainService {
+	return &MaintainService{ss: ss}
+}
+
+// CheckIntegrity 校验所有投资和交易记录，只报告问题不做修改
+func (ms *MaintainService) CheckIntegrity() (*IntegrityReport, error) {
+	return ms.check(ms.ss.gtm.Context())
+}
+
+// RepairIntegrity 校验并在一个数据库事务中修复发现的问题
+func (ms *MaintainService) RepairIntegrity(operator string) (*IntegrityReport, error) {
+	var report *IntegrityReport
+	err := ms.ss.gtm.Execute(func(ctx context.Context) error {
+		var err error
+		report, err = ms.check(ctx)
+		if err != nil {
+			return err
+		}
+		return ms.repair(ctx, operator, report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// MigrateTimestamps 为旧版本没有成交时刻的交易（包括回收站中的）按股票所在市场的时区解析成交时间，
+// 只有日期时按当天零点，返回更新的交易数和成交时间无法解析的交易
+func (ms *MaintainService) MigrateTimestamps() (int, []int64, error) {
+	count := 0
+	var failed []int64
+	err := ms.ss.gtm.Execute(func(ctx context.Context) error {
+		trans, err := ms.ss.sr.GetUnstampedTransactions(ctx)
+		if err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		locations := make(map[string]*time.Location)
+		for _, t := range *trans {
+			loc, ok := locations[t.StockCode]
+			if !ok {
+				si, err := ms.ss.stockOf(ctx, t.StockCode)
+				if err != nil {
+					return err
+				}
+				loc = marketLocation(si)
+				locations[t.StockCode] = loc
+			}
+			if err := stampTransaction(&t, loc); err != nil {
+				day, err := time.ParseInLocation(DateLayout, t.FinishTime, loc)
+				if err != nil {
+					failed = append(failed, t.ID)
+					continue
+				}
+				t.FinishAt = day.UTC()
+				t.FinishTime = marketTime(t.FinishAt, loc)
+			}
+			if err := ms.ss.sr.UpdateTransactionTime(ctx, &t); err != nil {
+				return exception.WrapService(500, "dao error", err)
+			}
+			count++
+		}
+		return nil
+	})
+	return count, failed, err
+}
+
+// 持仓的重建范围：投资组合中的一只股票
+type holdingKey struct {
+	portfolioId int64
+	stockCode   string
+}
+
+// RecomputeAll 按成交时间重建所有组合中所有股票的投资，每个持仓在独立的事务中重建，
+// 失败的持仓回滚并报告，不影响其他持仓
+func (ms *MaintainService) RecomputeAll(operator string) (*RecomputeReport, error) {
+	keys, err := ms.holdingKeys(ms.ss.gtm.Context())
+	if err != nil {
+		return nil, err
+	}
+	// 有交易没有成交时刻的持仓无法按时间重建，需要先修正成交时间
+	unstamped, err := ms.ss.sr.GetUnstampedTransactions(ms.ss.gtm.Context())
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	missing := make(map[holdingKey]*Transaction)
+	for i := range *unstamped {
+		t := &(*unstamped)[i]
+		key := holdingKey{t.PortfolioID, t.StockCode}
+		if _, ok := missing[key]; !ok && t.Status == 0 {
+			missing[key] = t
+		}
+	}
+
+	report := &RecomputeReport{Failures: []IntegrityIssue{}}
+	for _, key := range keys {
+		if t, ok := missing[key]; ok {
+			report.Failures = append(report.Failures, IntegrityIssue{Kind: IssueMissingTime, PortfolioID: key.portfolioId, StockCode: key.stockCode, TranID: t.ID,
+				Stored: t.FinishTime, Message: fmt.Sprintf("finish time %q of transaction %d can not be parsed", t.FinishTime, t.ID)})
+			continue
+		}
+		err := ms.ss.gtm.Execute(func(ctx context.Context) error {
+			return ms.ss.rebuildHolding(ctx, operator, key.portfolioId, key.stockCode)
+		})
+		if err != nil {
+			report.Failures = append(report.Failures, IntegrityIssue{Kind: IssueRebuildFailed, PortfolioID: key.portfolioId, StockCode: key.stockCode,
+				Message: err.Error()})
+			continue
+		}
+		report.Holdings++
+	}
+	return report, nil
+}
+
+// PlanMigrations 登记待执行的数据迁移，执行成功前每次启动都会重试
+func (ms *MaintainService) PlanMigrations(names ...string) error {
+	return ms.ss.gtm.Execute(func(ctx context.Context) error {
+		for _, name := range names {
+			m, err := ms.ss.sr.GetMigration(ctx, name)
+			if err != nil {
+				if !isNotFound(err) {
+					return err
+				}
+				m = &Migration{Name: name, CreatedAt: time.Now()}
+			}
+			m.Pending = true
+			m.UpdatedAt = time.Now()
+			if err := ms.ss.sr.SaveMigration(ctx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RunMigrations 按顺序执行待执行的数据迁移，全部完成的迁移清除待执行标记，
+// 未完成或失败的保留到下次启动重试，返回本次执行的迁移及结果
+func (ms *MaintainService) RunMigrations() (*[]Migration, error) {
+	ctx := ms.ss.gtm.Context()
+	ran := []Migration{}
+	for _, migration := range migrations {
+		// 前面的迁移可能登记新的迁移，每次重新读取
+		m, err := ms.ss.sr.GetMigration(ctx, migration.name)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return &ran, err
+		}
+		if !m.Pending {
+			continue
+		}
+		message, done, err := migration.run(ms)
+		if err != nil {
+			message, done = err.Error(), false
+		}
+		m.Pending = !done
+		m.Message = message
+		m.UpdatedAt = time.Now()
+		if err := ms.ss.sr.SaveMigration(ctx, m); err != nil {
+			return &ran, err
+		}
+		ran = append(ran, *m)
+	}
+	return &ran, nil
+}
+
+// migrateStampTime 解析旧版本的成交时间，有交易更新时需要重新计算投资；有无法解析的成交时间时未完成，
+// 这些交易在数据校验中报告为 missing_time，修改成交时间后下次启动时重试
+func (ms *MaintainService) migrateStampTime() (string, bool, error) {
+	count, failed, err := ms.MigrateTimestamps()
+	if err != nil {
+		return "", false, err
+	}
+	if count > 0 {
+		if err := ms.PlanMigrations(MigrationRecompute); err != nil {
+			return "", false, err
+		}
+	}
+	message := fmt.Sprintf("stamped %d transactions", count)
+	if len(failed) > 0 {
+		message += fmt.Sprintf(", finish time of transactions %v can not be parsed", failed)
+	}
+	return message, len(failed) == 0, nil
+}
+
+// migrateRecompute 重新计算所有投资，有持仓重建失败时未完成
+func (ms *MaintainService) migrateRecompute() (string, bool, error) {
+	report, err := ms.RecomputeAll("system")
+	if err != nil {
+		return "", false, err
+	}
+	message := fmt.Sprintf("recomputed %d holdings", report.Holdings)
+	if len(report.Failures) > 0 {
+		failures := make([]string, 0, len(report.Failures))
+		for _, f := range report.Failures {
+			failures = append(failures, fmt.Sprintf("%s(portfolio %d): %s", f.StockCode, f.PortfolioID, f.Message))
+		}
+		message += fmt.Sprintf(", %d failed: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return message, len(report.Failures) == 0, nil
+}
+
+// holdingKeys 返回有投资或交易记录的组合和股票
+func (ms *MaintainService) holdingKeys(ctx context.Context) ([]holdingKey, error) {
+	invests, err := ms.ss.sr.GetInvestments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := ms.ss.sr.GetAllTransactions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var keys []holdingKey
+	seen := make(map[holdingKey]bool)
+	add := func(key holdingKey) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, invest := range *invests {
+		if invest.Status != -1 {
+			add(holdingKey{invest.PortfolioID, invest.StockCode})
+		}
+	}
+	for _, t := range *trans {
+		add(holdingKey{t.PortfolioID, t.StockCode})
+	}
+	return keys, nil
+}
+
+func (ms *MaintainService) check(ctx context.Context) (*IntegrityReport, error) {
+	invests, err := ms.ss.sr.GetInvestments(ctx)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	trans, err := ms.ss.sr.GetAllTransactions(ctx)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+
+	pending, err := ms.ss.sr.GetPendingMigrations(ctx)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+
+	report := &IntegrityReport{CheckTime: time.Now(), Issues: []IntegrityIssue{}, Migrations: *pending}
+
+	// 按投资分组交易记录（已按成交时间排序）
+	investTrans := make(map[int64][]Transaction)
+	for _, t := range *trans {
+		investTrans[t.InvestID] = append(investTrans[t.InvestID], t)
+	}
+
+	specs := make(map[string]*InstrumentSpec)
+	known := make(map[int64]bool)
+	openInvests := make(map[holdingKey][]Investment)
+	for _, invest := range *invests {
+		known[invest.ID] = true
+		if invest.Status == -1 {
+			continue
+		}
+		report.Investments++
+
+		its := investTrans[invest.ID]
+		if len(its) == 0 {
+			report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueEmptyInvest, PortfolioID: invest.PortfolioID, StockCode: invest.StockCode, InvestID: invest.ID,
+				Message: "investment has no transactions"})
+			continue
+		}
+
+		running := decimal.Zero
+		for i, t := range its {
+			running = running.Add(signedQuantity(t))
+			if running.IsNegative() {
+				report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueNegativeQuantity, PortfolioID: invest.PortfolioID, StockCode: invest.StockCode, InvestID: invest.ID, TranID: t.ID,
+					Message: fmt.Sprintf("running quantity is %s after transaction at %s", running, t.FinishTime)})
+				break
+			}
+			if running.IsZero() && i < len(its)-1 {
+				report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueUnsplit, PortfolioID: invest.PortfolioID, StockCode: invest.StockCode, InvestID: invest.ID, TranID: t.ID,
+					Message: fmt.Sprintf("position is closed at %s but has later transactions", t.FinishTime)})
+				break
+			}
+		}
+
+		spec, ok := specs[invest.StockCode]
+		if !ok {
+			spec, err = ms.ss.instrumentSpec(ctx, invest.StockCode)
+			if err != nil {
+				return nil, err
+			}
+			specs[invest.StockCode] = spec
+		}
+		expected := invest
+		calcHolding(&expected, its, spec)
+		report.Issues = append(report.Issues, diffInvestment(&invest, &expected)...)
+
+		if expected.Status == 0 {
+			key := holdingKey{invest.PortfolioID, invest.StockCode}
+			openInvests[key] = append(openInvests[key], invest)
+		}
+	}
+
+	for _, t := range *trans {
+		report.Transactions++
+		if !known[t.InvestID] {
+			report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueOrphanTrans, PortfolioID: t.PortfolioID, StockCode: t.StockCode, InvestID: t.InvestID, TranID: t.ID,
+				Message: "investment of the transaction does not exist"})
+		}
+		if t.FinishAt.IsZero() {
+			report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueMissingTime, PortfolioID: t.PortfolioID, StockCode: t.StockCode, InvestID: t.InvestID, TranID: t.ID,
+				Stored: t.FinishTime, Message: fmt.Sprintf("finish time %q can not be parsed", t.FinishTime)})
+		}
+	}
+
+	for key, opens := range openInvests {
+		if len(opens) < 2 {
+			continue
+		}
+		for _, invest := range opens[1:] {
+			report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueMultipleOpen, PortfolioID: key.portfolioId, StockCode: key.stockCode, InvestID: invest.ID, RelatedID: opens[0].ID,
+				Message: fmt.Sprintf("stock has %d open investments", len(opens))})
+		}
+	}
+
+	return report, nil
+}
+
+func diffInvestment(stored *Investment, expected *Investment) []IntegrityIssue {
+	var issues []IntegrityIssue
+	add := func(field string, s any, e any) {
+		issues = append(issues, IntegrityIssue{Kind: IssueMismatch, PortfolioID: stored.PortfolioID, StockCode: stored.StockCode, InvestID: stored.ID, Field: field,
+			Stored: fmt.Sprint(s), Expected: fmt.Sprint(e), Message: field + " does not match transactions"})
+	}
+	if !stored.Quantity.Equal(expected.Quantity) {
+		add("quantity", stored.Quantity, expected.Quantity)
+	}
+	if !sameFloat(stored.CostPrice, expected.CostPrice) {
+		add("costPrice", stored.CostPrice, expected.CostPrice)
+	}
+	if !sameFloat(stored.HoldingCost, expected.HoldingCost) {
+		add("holdingCost", stored.HoldingCost, expected.HoldingCost)
+	}
+	if !sameFloat(stored.DilutedCost, expected.DilutedCost) {
+		add("dilutedCost", stored.DilutedCost, expected.DilutedCost)
+	}
+	if !sameFloat(stored.BreakEven, expected.BreakEven) {
+		add("breakEven", stored.BreakEven, expected.BreakEven)
+	}
+	if !sameFloat(stored.Amount, expected.Amount) {
+		add("amount", stored.Amount, expected.Amount)
+	}
+	if !sameFloat(stored.TotalTaxFee, expected.TotalTaxFee) {
+		add("totalTaxFee", stored.TotalTaxFee, expected.TotalTaxFee)
+	}
+	if !sameFloat(stored.ProfitLoss, expected.ProfitLoss) {
+		add("profitLoss", stored.ProfitLoss, expected.ProfitLoss)
+	}
+	if !sameFloat(stored.GrossProfit, expected.GrossProfit) {
+		add("grossProfit", stored.GrossProfit, expected.GrossProfit)
+	}
+	if stored.Status != expected.Status {
+		add("status", stored.Status, expected.Status)
+	}
+	if stored.OpenTime != expected.OpenTime {
+		add("openTime", stored.OpenTime, expected.OpenTime)
+	}
+	if stored.CloseTime != expected.CloseTime {
+		add("closeTime", stored.CloseTime, expected.CloseTime)
+	}
+	if !stored.OpenAt.Equal(expected.OpenAt) {
+		add("openAt", stored.OpenAt, expected.OpenAt)
+	}
+	if (stored.CloseAt == nil) != (expected.CloseAt == nil) || (stored.CloseAt != nil && !stored.CloseAt.Equal(*expected.CloseAt)) {
+		add("closeAt", stored.CloseAt, expected.CloseAt)
+	}
+	return issues
+}
+
+func sameFloat(a, b float64) bool {
+	return math.Abs(a-b) < 0.0005
+}
+
+// repair 孤立的交易重新分配投资，其余问题按成交时间重建所在股票的投资；
+// 累计数量为负或成交时间无法解析的股票需要人工修正交易后再修复
+func (ms *MaintainService) repair(ctx context.Context, operator string, report *IntegrityReport) error {
+	report.Repaired = true
+
+	manual := make(map[holdingKey]bool)
+	for _, issue := range report.Issues {
+		if issue.Kind == IssueNegativeQuantity || issue.Kind == IssueMissingTime {
+			manual[holdingKey{issue.PortfolioID, issue.StockCode}] = true
+		}
+	}
+
+	var keys []holdingKey
+	rebuild := make(map[holdingKey]bool)
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		key := holdingKey{issue.PortfolioID, issue.StockCode}
+		if manual[key] {
+			continue
+		}
+		if issue.Kind == IssueOrphanTrans {
+			if err := ms.ss.sr.UpdateTransactionInvest(ctx, issue.TranID, 0); err != nil {
+				return err
+			}
+		}
+		if !rebuild[key] {
+			rebuild[key] = true
+			keys = append(keys, key)
+		}
+		issue.Repaired = true
+	}
+
+	for _, key := range keys {
+		if err := ms.ss.rebuildHolding(ctx, operator, key.portfolioId, key.stockCode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package stock
+
+import (
+	"encoding/json"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // 系统没有时区数据（如 Windows）时使用内置的时区数据
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	MarketA  = "A股"
+	MarketH  = "H股"
+	MarketUS = "美股"
+)
+
+// 板块交易规则：按股票编码前缀匹配，买入数量不低于最小数量且为递增单位的整数倍
+type BoardRule struct {
+	Name        string   `json:"name"`        // 板块名称
+	Prefixes    []string `json:"prefixes"`    // 股票编码前缀
+	MinQuantity int      `json:"minQuantity"` // 单笔最小数量
+	Step        int      `json:"step"`        // 超过最小数量后的递增单位
+}
+
+// 价位档：价格低于 Below 时最小变动价位为 Tick，Below 为 0 表示无上限
+type TickLevel struct {
+	Below float64 `json:"below"`
+	Tick  float64 `json:"tick"`
+}
+
+// 交易时段（市场时区的 HH:mm）
+type TradingSession struct {
+	Open  string `json:"open"`
+	Close string `json:"close"`
+}
+
+// 市场交易规则，可由配置文件覆盖
+type MarketRule struct {
+	Market      string           `json:"market"`      // 股市名称（A股、H股等，股票信息中保存的值）
+	Code        string           `json:"code"`        // 市场代码（CN、HK、US）
+	Timezone    string           `json:"timezone"`    // 时区（IANA 名称），成交时间和日期按该时区计算
+	Currency    string           `json:"currency"`    // 默认币种
+	Sessions    []TradingSession `json:"sessions"`    // 交易时段
+	Instruments []string         `json:"instruments"` // 适用每手数量、价位、交收周期和费用规则的品种
+	LotSize     int              `json:"lotSize"`     // 每手数量，0 表示按股票设置的每手数量
+	Boards      []BoardRule      `json:"boards"`      // 特殊板块规则（如科创板）
+	TickLadder  []TickLevel      `json:"tickLadder"`  // 价位表，为空时只校验品种的价格精度
+	SettleDays  int              `json:"settleDays"`  // 交收周期（T+N），0 表示按品种规则
+	FeeSchedule string           `json:"feeSchedule"` // 费用规则名称，为空或没有对应品种时按品种规则
+	Calendar    string           `json:"calendar"`    // 交易日历（SSE、HKEX、NYSE）
+
+	location *time.Location
+}
+
+// 各市场按品种的费用规则
+var feeSchedules = map[string]map[string]FeeRule{
+	// 港股买卖双方均收印花税，ETF 免印花税
+	"HK": {
+		InstrumentStock: {Rate: 0.0013, MinFee: 3},
+		InstrumentETF:   {Rate: 0.0003, MinFee: 3},
+	},
+	// 美股零佣金，卖出收取证监会费
+	"US": {
+		InstrumentStock: {SellTaxRate: 0.0000278},
+		InstrumentETF:   {SellTaxRate: 0.0000278},
+	},
+}
+
+var marketRules = map[string]*MarketRule{
+	MarketA: {Market: MarketA, Code: "CN", Timezone: "Asia/Shanghai", Currency: "人民币",
+		Sessions:    []TradingSession{{Open: "09:30", Close: "11:30"}, {Open: "13:00", Close: "15:00"}},
+		Instruments: []string{InstrumentStock, InstrumentETF}, LotSize: 100,
+		Boards:   []BoardRule{{Name: "科创板", Prefixes: []string{"688", "689"}, MinQuantity: 200, Step: 1}},
+		Calendar: CalendarSSE},
+	MarketH: {Market: MarketH, Code: "HK", Timezone: "Asia/Hong_Kong", Currency: "港币",
+		Sessions:    []TradingSession{{Open: "09:30", Close: "12:00"}, {Open: "13:00", Close: "16:00"}},
+		Instruments: []string{InstrumentStock, InstrumentETF}, LotSize: 0,
+		TickLadder: []TickLevel{
+			{Below: 0.25, Tick: 0.001}, {Below: 0.5, Tick: 0.005}, {Below: 10, Tick: 0.01}, {Below: 20, Tick: 0.02},
+			{Below: 100, Tick: 0.05}, {Below: 200, Tick: 0.1}, {Below: 500, Tick: 0.2}, {Below: 1000, Tick: 0.5},
+			{Below: 2000, Tick: 1}, {Below: 5000, Tick: 2}, {Below: 0, Tick: 5},
+		},
+		SettleDays: 2, FeeSchedule: "HK", Calendar: CalendarHKEX},
+	MarketUS: {Market: MarketUS, Code: "US", Timezone: "America/New_York", Currency: "美元",
+		Sessions:    []TradingSession{{Open: "09:30", Close: "16:00"}},
+		Instruments: []string{InstrumentStock, InstrumentETF},
+		// 1 美元以下按 0.0001 报价
+		TickLadder: []TickLevel{{Below: 1, Tick: 0.0001}, {Below: 0, Tick: 0.01}},
+		SettleDays: 1, FeeSchedule: "US", Calendar: CalendarNYSE},
+}
+
+func init() {
+	for _, rule := range marketRules {
+		if err := rule.check(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// GetMarketRule 返回市场的交易规则，未配置规则的市场返回 nil（不校验）
+func GetMarketRule(market string) *MarketRule {
+	return marketRules[market]
+}
+
+// FindMarketRule 按股市名称或市场代码（不区分大小写）查找市场的交易规则
+func FindMarketRule(market string) *MarketRule {
+	if rule, ok := marketRules[market]; ok {
+		return rule
+	}
+	for _, rule := range marketRules {
+		if rule.Code != "" && strings.EqualFold(rule.Code, market) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// MarketRules 返回所有市场的交易规则
+func MarketRules() []MarketRule {
+	rules := make([]MarketRule, 0, len(marketRules))
+	for _, rule := range marketRules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Market < rules[j].Market })
+	return rules
+}
+
+// LoadMarketRules 从配置内容（JSON 数组）加载市场交易规则，同名市场覆盖内置规则
+func LoadMarketRules(data []byte) error {
+	var rules []MarketRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return exception.WrapService(500, "invalid market rules", err)
+	}
+	for i := range rules {
+		// 旧配置没有的市场代码、时区、币种和交易时段沿用内置规则
+		if builtin, ok := marketRules[rules[i].Market]; ok {
+			rules[i].inherit(builtin)
+		}
+		if err := rules[i].check(); err != nil {
+			return err
+		}
+	}
+	for i := range rules {
+		marketRules[rules[i].Market] = &rules[i]
+	}
+	return nil
+}
+
+func (mr *MarketRule) inherit(builtin *MarketRule) {
+	if mr.Code == "" {
+		mr.Code = builtin.Code
+	}
+	if mr.Timezone == "" {
+		mr.Timezone = builtin.Timezone
+	}
+	if mr.Currency == "" {
+		mr.Currency = builtin.Currency
+	}
+	if mr.Sessions == nil {
+		mr.Sessions = builtin.Sessions
+	}
+}
+
+// check 校验配置的市场交易规则
+func (mr *MarketRule) check() error {
+	if mr.Market == "" {
+		return exception.NewService(500, "market of market rule is empty")
+	}
+	if mr.Timezone != "" {
+		loc, err := time.LoadLocation(mr.Timezone)
+		if err != nil {
+			return exception.WrapService(500, fmt.Sprintf("invalid timezone %q of market %s", mr.Timezone, mr.Market), err)
+		}
+		mr.location = loc
+	}
+	for _, session := range mr.Sessions {
+		start, err1 := time.Parse("15:04", session.Open)
+		end, err2 := time.Parse("15:04", session.Close)
+		if err1 != nil || err2 != nil || !start.Before(end) {
+			return exception.NewService(500, fmt.Sprintf("invalid trading session %s-%s of market %s", session.Open, session.Close, mr.Market))
+		}
+	}
+	if mr.SettleDays < 0 {
+		return exception.NewService(500, "settle days of market "+mr.Market+" can not be negative")
+	}
+	if _, ok := feeSchedules[mr.FeeSchedule]; mr.FeeSchedule != "" && !ok {
+		return exception.NewService(500, fmt.Sprintf("unknown fee schedule %s of market %s", mr.FeeSchedule, mr.Market))
+	}
+	return nil
+}
+
+// Location 返回市场的时区，未设置时区时为本地时区
+func (mr *MarketRule) Location() *time.Location {
+	if mr.location == nil {
+		return time.Local
+	}
+	return mr.location
+}
+
+// marketLocation 返回股票所在市场的时区，未登记的市场为本地时区
+func marketLocation(si *StockInfo) *time.Location {
+	if rule := GetMarketRule(si.Market); rule != nil {
+		return rule.Location()
+	}
+	return time.Local
+}
+
+// marketNow 返回股票所在市场时区的当前时间，未登记的市场为本地时间
+func marketNow(si *StockInfo) time.Time {
+	return time.Now().In(marketLocation(si))
+}
+
+// spec 按市场的交收周期、费用规则和价位表调整品种的交易规则，价格精度不低于价位表中最小的变动价位
+func (mr *MarketRule) spec(spec *InstrumentSpec) *InstrumentSpec {
+	if !mr.applies(spec) {
+		return spec
+	}
+	fee, hasFee := feeSchedules[mr.FeeSchedule][spec.Type]
+	precision := mr.tickPrecision()
+	if mr.SettleDays == 0 && !hasFee && precision <= spec.PricePrecision {
+		return spec
+	}
+	custom := *spec
+	if precision > custom.PricePrecision {
+		custom.PricePrecision = precision
+	}
+	if mr.SettleDays > 0 {
+		custom.SettleDays = mr.SettleDays
+	}
+	if hasFee {
+		custom.Fee = fee
+	}
+	return &custom
+}
+
+// tickPrecision 返回价位表中最小变动价位的小数位数
+func (mr *MarketRule) tickPrecision() int {
+	precision := 0
+	for _, level := range mr.TickLadder {
+		if exp := -int(decimal.NewFromFloat(level.Tick).Exponent()); exp > precision {
+			precision = exp
+		}
+	}
+	return precision
+}
+
+// Validate 校验交易是否符合市场的每手数量和价位规则，holding 为该笔交易之前的持仓数量
+func (mr *MarketRule) Validate(si *StockInfo, spec *InstrumentSpec, tran *Transaction, holding decimal.Decimal) error {
+	if !mr.applies(spec) {
+		return nil
+	}
+	// 回测交易的复权价格不在价位档上
+	if !tran.Backtest {
+		if err := mr.checkTick(tran.Price); err != nil {
+			return err
+		}
+	}
+	return mr.checkLot(si, tran, holding)
+}
+
+// applies 判断品种是否适用市场的每手数量和价位规则
+func (mr *MarketRule) applies(spec *InstrumentSpec) bool {
+	return slices.Contains(mr.Instruments, spec.Type)
+}
+
+// checkTick 价格须为所在价位档最小变动价位的整数倍
+func (mr *MarketRule) checkTick(price float64) error {
+	for _, level := range mr.TickLadder {
+		if level.Below != 0 && price >= level.Below {
+			continue
+		}
+		tick := decimal.NewFromFloat(level.Tick)
+		if !decimal.NewFromFloat(price).Mod(tick).IsZero() {
+			return exception.NewBusiness(400, fmt.Sprintf("%s price %v is not on the tick size %v", mr.Market, price, level.Tick))
+		}
+		return nil
+	}
+	return nil
+}
+
+// LotRule 返回股票单笔买入的最小数量、递增单位和规则名称（市场或板块），0 表示不限
+func (mr *MarketRule) LotRule(si *StockInfo) (int, int, string) {
+	min, step, name := mr.LotSize, mr.LotSize, mr.Market
+	if si.LotSize > 0 {
+		min, step = si.LotSize, si.LotSize
+	}
+	for _, board := range mr.Boards {
+		if hasPrefix(si.Code, board.Prefixes) {
+			return board.MinQuantity, board.Step, board.Name
+		}
+	}
+	return min, step, name
+}
+
+// checkLot 买入数量须符合每手数量（或板块最小数量）。卖出全部持仓不受限制，否则整手部分须为递增单位的整数倍
+// 且不少于最小数量，不足一手的零股（持仓数量除以递增单位的余数）只能在一笔卖出中全部卖出
+func (mr *MarketRule) checkLot(si *StockInfo, tran *Transaction, holding decimal.Decimal) error {
+	min, step, name := mr.LotRule(si)
+	if min <= 0 || step <= 0 {
+		// 没有设置每手数量（如 H股未设置股票的每手数量）
+		return nil
+	}
+
+	qty := tran.Quantity
+	steps := decimal.NewFromInt(int64(step))
+	if tran.Action == -1 {
+		if qty.Equal(holding) {
+			return nil
+		}
+		odd := qty.Mod(steps)
+		lots := qty.Sub(odd)
+		if (odd.IsZero() || odd.Equal(holding.Mod(steps))) && (lots.IsZero() || lots.GreaterThanOrEqual(decimal.NewFromInt(int64(min)))) {
+			return nil
+		}
+		return exception.NewBusiness(400, fmt.Sprintf("%s sell quantity %s must be a multiple of %d (at least %d) plus the whole odd lot %s (holding %s)",
+			name, qty, step, min, holding.Mod(steps), holding))
+	}
+	if qty.LessThan(decimal.NewFromInt(int64(min))) || !qty.Mod(steps).IsZero() {
+		return exception.NewBusiness(400, fmt.Sprintf("%s buy quantity %s must be a multiple of %d (at least %d)", name, qty, step, min))
+	}
+	return nil
+}
+
+func hasPrefix(code string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(code, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package stock
+
+import (
+	"testing"
+)
+
+func TestCheckLot(t *testing.T) {
+	rule := GetMarketRule(MarketA)
+	cases := []struct {
+		name     string
+		code     string
+		action   int8
+		quantity string
+		holding  string
+		ok       bool
+	}{
+		{"buy whole lots", "600000", 1, "200", "0", true},
+		{"buy odd lot", "600000", 1, "150", "0", false},
+		{"buy less than one lot", "600000", 1, "50", "0", false},
+		{"sell whole lots", "600000", -1, "100", "150", true},
+		{"sell only the odd lot", "600000", -1, "50", "150", true},
+		{"sell lots with the odd lot", "600000", -1, "150", "250", true},
+		{"sell all holding", "600000", -1, "250", "250", true},
+		{"sell part of the odd lot", "600000", -1, "30", "150", false},
+		{"sell lots with part of the odd lot", "600000", -1, "120", "250", false},
+		{"sell odd quantity without odd lot", "600000", -1, "150", "300", false},
+		{"star buy minimum", "688001", 1, "200", "0", true},
+		{"star buy less than minimum", "688001", 1, "199", "0", false},
+		{"star buy by one share", "688001", 1, "201", "0", true},
+		{"star sell above minimum", "688001", -1, "201", "300", true},
+		{"star sell below minimum", "688001", -1, "150", "300", false},
+		{"star sell all below minimum", "688001", -1, "150", "150", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			si := &StockInfo{Code: c.code, Market: MarketA, Type: InstrumentStock}
+			tran := &Transaction{Action: c.action, Quantity: qty(c.quantity)}
+			err := rule.checkLot(si, tran, qty(c.holding))
+			if (err == nil) != c.ok {
+				t.Fatalf("got error %v, want ok %v", err, c.ok)
+			}
+		})
+	}
+}
+
+func TestMarketPrice(t *testing.T) {
+	cases := []struct {
+		name   string
+		market string
+		price  float64
+		ok     bool
+	}{
+		{"h share below 0.25 by 0.001", MarketH, 0.235, true},
+		{"h share below 0.25 finer than 0.001", MarketH, 0.2355, false},
+		{"h share below 0.5 by 0.005", MarketH, 0.365, true},
+		{"h share below 0.5 off the tick", MarketH, 0.362, false},
+		{"h share below 20 off the tick", MarketH, 12.35, false},
+		{"us stock below 1 by 0.0001", MarketUS, 0.1234, true},
+		{"us stock below 1 finer than 0.0001", MarketUS, 0.12345, false},
+		{"us stock above 1 off the cent", MarketUS, 12.345, false},
+		{"a share keeps 2 decimals", MarketA, 10.005, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			si := &StockInfo{Code: "TEST", Market: c.market, Type: InstrumentStock, LotSize: 100}
+			spec, err := stockSpec(si)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tran := &Transaction{Action: 1, Price: c.price, Quantity: qty("100")}
+			err = spec.Validate(tran)
+			if err == nil {
+				err = GetMarketRule(c.market).Validate(si, spec, tran, qty("0"))
+			}
+			if (err == nil) != c.ok {
+				t.Fatalf("got error %v, want ok %v", err, c.ok)
+			}
+		})
+	}
+}
@@ -2,55 +2,359 @@ package stock
 
 import (
 	"time"
+
+	"github.com/shopspring/decimal"
 )
 
+func init() {
+	// 数量以 JSON 数字（而非字符串）与前端交互
+	decimal.MarshalJSONWithoutQuotes = true
+}
+
 // 定义股票信息结构体
 type StockInfo struct {
-	Code      string    `gorm:"primaryKey" json:"code"` // 编码
-	Name      string    `json:"name"`                   // 名称
-	Market    string    `json:"market"`                 // 股市（A股、港股等）
-	Currency  string    `json:"currency"`               // 币种（人民币、港币、美元等）
-	Status    int       `json:"status"`                 // 状态（-1:删除、0:正常）
-	CreatedAt time.Time `json:"createdAt"`              // 创建时间
-	UpdatedAt time.Time `json:"updatedAt"`              // 更新时间
+	Code              string    `gorm:"primaryKey" json:"code"`    // 编码
+	Name              string    `json:"name"`                      // 名称
+	Market            string    `json:"market"`                    // 股市（A股、港股等）
+	Type              string    `gorm:"default:stock" json:"type"` // 品种（stock、etf、fund、bond、cbond）
+	Currency          string    `json:"currency"`                  // 币种（人民币、港币、美元等）
+	QuantityPrecision *int      `json:"quantityPrecision"`         // 数量小数位数（为空时按品种规则，如美股碎股单独设置）
+	LotSize           int       `json:"lotSize"`                   // 每手数量（0:按市场规则，H股按股票设置）
+	Status            int       `json:"status"`                    // 状态（-1:删除、0:正常）
+	CreatedAt         time.Time `json:"createdAt"`                 // 创建时间
+	UpdatedAt         time.Time `json:"updatedAt"`                 // 更新时间
+}
+
+// 股票编码别名：改名或被吸收合并后不再使用的原编码，按原编码查询时指向新编码
+type StockAlias struct {
+	Code      string          `gorm:"primaryKey" json:"code"` // 原编码
+	StockCode string          `json:"stockCode"`              // 新编码
+	Name      string          `json:"name"`                   // 原名称
+	Kind      string          `json:"kind"`                   // 变更类型（rename、merge）
+	Ratio     decimal.Decimal `gorm:"type:text" json:"ratio"` // 换股比例（每股原股票换得的新股票数量）
+	Operator  string          `json:"operator"`               // 操作人
+	CreatedAt time.Time       `json:"createdAt"`              // 创建时间
 }
 
 // 投资信息结构体
 type Investment struct {
-	ID          int64     `gorm:"primaryKey" json:"id"` // 标识（唯一标识符）
-	StockCode   string    `json:"stockCode"`            // 股票编码
-	ProfitLoss  float64   `json:"profitLoss"`           // 持仓盈亏金额
-	TotalTaxFee float64   `json:"totalTaxFee"`          // 税费合计
-	CostPrice   float64   `json:"costPrice"`            // 成本价格
-	Quantity    int       `json:"quantity"`             // 持仓数量
-	Amount      float64   `json:"amount"`               // 投资金额
-	Status      int       `json:"status"`               // 状态（-1:删除、0:持仓、1:清仓）
-	HoldingDays int       `gorm:"-" json:"holdingDays"` // 持仓天数
-	OpenTime    string    `json:"openTime"`             // 建仓时间
-	CloseTime   string    `json:"closeTime"`            // 清仓时间
-	CreatedAt   time.Time `json:"createdAt"`            // 创建时间
-	UpdatedAt   time.Time `json:"updatedAt"`            // 更新时间
+	ID          int64           `gorm:"primaryKey" json:"id"`                  // 标识（唯一标识符）
+	PortfolioID int64           `gorm:"default:0;not null" json:"portfolioId"` // 投资组合标识（0:默认实盘组合）
+	StockCode   string          `json:"stockCode"`                             // 股票编码
+	ProfitLoss  float64         `json:"profitLoss"`                            // 净盈亏（已实现的毛盈亏减卖出税费和已卖出部分分摊的买入税费）
+	GrossProfit float64         `json:"grossProfit"`                           // 毛盈亏（卖出金额减卖出数量的平均买入成本，不含税费）
+	TotalTaxFee float64         `json:"totalTaxFee"`                           // 税费合计
+	CostPrice   float64         `json:"costPrice"`                             // 成本价格（买入均价）
+	HoldingCost float64         `json:"holdingCost"`                           // 持仓成本（含买入税费的移动平均成本，卖出按成本转出）
+	DilutedCost float64         `json:"dilutedCost"`                           // 摊薄成本（买入金额加税费合计减卖出金额，再除以持仓数量）
+	BreakEven   float64         `json:"breakEven"`                             // 保本卖出价（全部卖出后净盈亏为 0 的价格，含卖出税费）
+	Quantity    decimal.Decimal `gorm:"type:text" json:"quantity"`             // 持仓数量
+	Amount      float64         `json:"amount"`                                // 投资金额
+	Status      int             `json:"status"`                                // 状态（-1:删除、0:持仓、1:清仓）
+	HoldingDays int             `gorm:"-" json:"holdingDays"`                  // 持仓天数（自然日）
+	TradingDays int             `gorm:"-" json:"tradingDays"`                  // 持仓天数（交易日）
+	Dividend    float64         `gorm:"-" json:"dividend"`                     // 累计分红（税后到账金额）
+	Reinvested  float64         `gorm:"-" json:"reinvested"`                   // 分红再投资金额（买入金额加税费，已计入投资金额）
+	ReinvestQty decimal.Decimal `gorm:"-" json:"reinvestQty"`                  // 分红再投资买入的数量
+	TotalReturn float64         `gorm:"-" json:"totalReturn"`                  // 总收益（净盈亏加累计分红，净盈亏为价格带来的收益）
+	OpenTime    string          `json:"openTime"`                              // 建仓时间（市场时区）
+	CloseTime   string          `json:"closeTime"`                             // 清仓时间（市场时区）
+	OpenAt      time.Time       `gorm:"index" json:"openAt"`                   // 建仓时刻（UTC）
+	CloseAt     *time.Time      `json:"closeAt"`                               // 清仓时刻（UTC，持仓中为空）
+	CreatedAt   time.Time       `json:"createdAt"`                             // 创建时间
+	UpdatedAt   time.Time       `json:"updatedAt"`                             // 更新时间
 }
 
 // 交易信息结构体
 type Transaction struct {
-	ID         int64     `gorm:"primaryKey" json:"id"` // 标识（唯一标识符）
-	InvestID   int64     `json:"investId"`             // 投资标识（关联 Investment 结构体的 ID）
-	StockCode  string    `json:"stockCode"`            // 股票编码
-	Action     int8      `json:"action"`               // 操作类型：买入:1、删除:0、卖出:-1
-	TaxFee     float64   `json:"taxFee"`               // 税费（如交易税、手续费等）
-	Price      float64   `json:"price"`                // 成交价格
-	Quantity   int       `json:"quantity"`             // 成交数量
-	Amount     float64   `json:"amount"`               // 交易金额
-	FinishTime string    `json:"finishTime"`           // 成交时间
-	CreatedAt  time.Time `json:"createdAt"`            // 创建时间
-	UpdatedAt  time.Time `json:"updatedAt"`            // 更新时间
+	ID          int64           `gorm:"primaryKey" json:"id"`                  // 标识（唯一标识符）
+	InvestID    int64           `json:"investId"`                              // 投资标识（关联 Investment 结构体的 ID）
+	PlanID      int64           `json:"planId"`                                // 计划标识（由计划订单执行生成时关联 PlannedOrder 的 ID）
+	PortfolioID int64           `gorm:"default:0;not null" json:"portfolioId"` // 投资组合标识（0:默认实盘组合）
+	StockCode   string          `json:"stockCode"`                             // 股票编码
+	Action      int8            `json:"action"`                                // 操作类型：买入:1、删除:0、卖出:-1
+	TaxFee      float64         `json:"taxFee"`                                // 税费（如交易税、手续费等）
+	Price       float64         `json:"price"`                                 // 成交价格
+	Quantity    decimal.Decimal `gorm:"type:text" json:"quantity"`             // 成交数量（场外基金份额等可为小数）
+	Amount      float64         `json:"amount"`                                // 交易金额
+	FinishTime  string          `json:"finishTime"`                            // 成交时间（市场时区的 yyyy-MM-dd HH:mm:ss）
+	FinishAt    time.Time       `gorm:"index" json:"finishAt"`                 // 成交时刻（UTC，用于排序和按时间查询）
+	SettleDate  string          `json:"settleDate"`                            // 交收日期
+	Status      int             `gorm:"default:0" json:"status"`               // 状态（-1:删除、0:正常）
+	Converted   bool            `gorm:"default:false" json:"converted"`        // 按换股比例折算（价格和数量为折算值，交易金额保持原成交金额）
+	Backtest    bool            `gorm:"default:false" json:"backtest"`         // 回测交易（按日线收盘价成交，复权价格不校验最小变动价位，成交日期以行情为准）
+	CreatedAt   time.Time       `json:"createdAt"`                             // 创建时间
+	UpdatedAt   time.Time       `json:"updatedAt"`                             // 更新时间
+}
+
+// 投资组合：默认组合（标识 0）为实盘，模拟组合有独立的资金余额，默认不计入实盘统计
+type Portfolio struct {
+	ID          int64     `gorm:"primaryKey" json:"id"` // 标识
+	Name        string    `json:"name"`                 // 名称
+	Simulated   bool      `json:"simulated"`            // 是否模拟组合
+	InitialCash float64   `json:"initialCash"`          // 初始资金
+	Cash        float64   `gorm:"-" json:"cash"`        // 资金余额（初始资金加卖出金额和现金分红，减买入金额和税费）
+	Remark      string    `json:"remark"`               // 备注
+	CreatedAt   time.Time `json:"createdAt"`            // 创建时间
+	UpdatedAt   time.Time `json:"updatedAt"`            // 更新时间
+}
+
+// 投资组合在同一期间的清仓表现
+type PortfolioStats struct {
+	PortfolioID int64   `json:"portfolioId"`
+	Name        string  `json:"name"`
+	Simulated   bool    `json:"simulated"`
+	Gross       bool    `json:"gross"` // 是否按毛盈亏统计
+	TotalCount  int     `json:"totalCount"`
+	ProfitCount int     `json:"profitCount"`
+	LossCount   int     `json:"lossCount"`
+	WinRate     float64 `json:"winRate"` // 盈利次数占比（%）
+	ProfitLoss  float64 `json:"profitLoss"`
+	Amount      float64 `json:"amount"`
+	Roi         float64 `json:"roi"`
+	Cash        float64 `json:"cash"`     // 模拟组合的资金余额
+	Holdings    int     `json:"holdings"` // 持仓中的投资数
+	StartTime   string  `json:"startTime"`
+	FinishTime  string  `json:"finishTime"`
+}
+
+// 计划订单：事先计划的买卖价格、数量和止损价格，执行时生成一笔或多笔交易
+type PlannedOrder struct {
+	ID             int64           `gorm:"primaryKey" json:"id"`                  // 标识
+	PortfolioID    int64           `gorm:"default:0;not null" json:"portfolioId"` // 投资组合标识（0:默认实盘组合）
+	StockCode      string          `json:"stockCode"`                             // 股票编码
+	Action         int8            `json:"action"`                                // 操作类型：买入:1、卖出:-1
+	Price          float64         `json:"price"`                                 // 计划价格
+	Quantity       decimal.Decimal `gorm:"type:text" json:"quantity"`             // 计划数量
+	StopPrice      float64         `json:"stopPrice"`                             // 止损价格
+	FilledQuantity decimal.Decimal `gorm:"-" json:"filledQuantity"`               // 已成交数量（由关联交易计算）
+	Status         string          `gorm:"default:draft" json:"status"`           // 状态（draft、active、partially_filled、filled、cancelled、expired）
+	ExpireDate     string          `json:"expireDate"`                            // 到期日期（yyyy-MM-dd，为空表示不过期）
+	Remark         string          `json:"remark"`                                // 备注
+	CreatedAt      time.Time       `json:"createdAt"`                             // 创建时间
+	UpdatedAt      time.Time       `json:"updatedAt"`                             // 更新时间
+}
+
+// 网格计划：在价格区间内等分网格，每格低买高卖固定数量，另持有不参与网格的底仓
+type GridPlan struct {
+	ID           int64           `gorm:"primaryKey" json:"id"`                  // 标识
+	PortfolioID  int64           `gorm:"default:0;not null" json:"portfolioId"` // 投资组合标识（0:默认实盘组合）
+	StockCode    string          `json:"stockCode"`                             // 股票编码
+	LowerPrice   float64         `json:"lowerPrice"`                            // 区间下限（最低买入价）
+	UpperPrice   float64         `json:"upperPrice"`                            // 区间上限（最高卖出价）
+	GridCount    int             `json:"gridCount"`                             // 网格数
+	GridQuantity decimal.Decimal `gorm:"type:text" json:"gridQuantity"`         // 每格买卖数量
+	BasePosition decimal.Decimal `gorm:"type:text" json:"basePosition"`         // 底仓数量
+	StartTime    string          `json:"startTime"`                             // 开始时间（之前的交易计入底仓）
+	Status       string          `gorm:"default:active" json:"status"`          // 状态（active、closed）
+	Remark       string          `json:"remark"`                                // 备注
+	CreatedAt    time.Time       `json:"createdAt"`                             // 创建时间
+	UpdatedAt    time.Time       `json:"updatedAt"`                             // 更新时间
+}
+
+// 网格：以 BuyPrice 买入、以 SellPrice 卖出
+type GridLevel struct {
+	Index     int             `json:"index"`     // 序号（从区间下限开始，0 起）
+	BuyPrice  float64         `json:"buyPrice"`  // 买入价
+	SellPrice float64         `json:"sellPrice"` // 卖出价
+	Filled    bool            `json:"filled"`    // 是否持有
+	Quantity  decimal.Decimal `json:"quantity"`  // 持有数量
+	CostPrice float64         `json:"costPrice"` // 实际买入价
+	TranID    int64           `json:"tranId"`    // 买入交易
+	Trips     int             `json:"trips"`     // 已完成的买卖次数
+	Profit    float64         `json:"profit"`    // 已实现收益
+}
+
+// 网格计划的执行情况，网格收益与底仓盈亏分开计算
+type GridStatus struct {
+	Plan           *GridPlan       `json:"plan"`
+	Levels         []GridLevel     `json:"levels"`
+	Price          float64         `json:"price"`          // 参考价格（最新收盘价，没有行情时为最近成交价）
+	NextBuyPrice   float64         `json:"nextBuyPrice"`   // 建议的下一买入价（参考价格之下最近的空网格，0 表示没有）
+	NextSellPrice  float64         `json:"nextSellPrice"`  // 建议的下一卖出价（持有网格中最低的卖出价，0 表示没有）
+	FilledCount    int             `json:"filledCount"`    // 持有的网格数
+	GridQuantity   decimal.Decimal `json:"gridQuantity"`   // 网格持有数量
+	GridTrips      int             `json:"gridTrips"`      // 网格完成的买卖次数
+	GridProfit     float64         `json:"gridProfit"`     // 网格已实现收益（扣除分摊的税费）
+	GridFloating   float64         `json:"gridFloating"`   // 网格浮动盈亏（按参考价格）
+	BaseQuantity   decimal.Decimal `json:"baseQuantity"`   // 底仓数量
+	BaseCost       float64         `json:"baseCost"`       // 底仓成本价（含税费）
+	BaseProfitLoss float64         `json:"baseProfitLoss"` // 底仓已实现盈亏
+	BaseFloating   float64         `json:"baseFloating"`   // 底仓浮动盈亏（按参考价格）
+	TaxFee         float64         `json:"taxFee"`         // 税费合计
+}
+
+// 现金分红：可按再投资价格买入，买不足一手（或一份）的零头作为现金留在组合中
+type Dividend struct {
+	ID            int64           `gorm:"primaryKey" json:"id"`                                           // 标识
+	PortfolioID   int64           `gorm:"index:idx_dividend_stock;default:0;not null" json:"portfolioId"` // 投资组合标识（0:默认实盘组合）
+	StockCode     string          `gorm:"index:idx_dividend_stock" json:"stockCode"`                      // 股票编码
+	PayDate       string          `json:"payDate"`                                                        // 派息日（市场时区的 yyyy-MM-dd）
+	PaidAt        time.Time       `gorm:"index" json:"paidAt"`                                            // 派息时刻（派息日零点，UTC）
+	Amount        float64         `json:"amount"`                                                         // 到账金额（税后）
+	Tax           float64         `json:"tax"`                                                            // 代扣税
+	ReinvestPrice float64         `json:"reinvestPrice"`                                                  // 再投资价格（0:不再投资）
+	TranID        int64           `json:"tranId"`                                                         // 再投资生成的买入交易
+	Reinvested    float64         `gorm:"-" json:"reinvested"`                                            // 再投资金额（买入金额加税费，买入交易删除后为 0）
+	ReinvestQty   decimal.Decimal `gorm:"-" json:"reinvestQty"`                                           // 再投资买入的数量
+	Remainder     float64         `gorm:"-" json:"remainder"`                                             // 留作现金的零头
+	Remark        string          `json:"remark"`                                                         // 备注
+	CreatedAt     time.Time       `json:"createdAt"`                                                      // 创建时间
+	UpdatedAt     time.Time       `json:"updatedAt"`                                                      // 更新时间
+}
+
+// 定投计划：按频率在定投日生成待确认的买入，确认时按实际成交价格买入固定金额
+type DcaPlan struct {
+	ID           int64     `gorm:"primaryKey" json:"id"`                  // 标识
+	PortfolioID  int64     `gorm:"default:0;not null" json:"portfolioId"` // 投资组合标识（0:默认实盘组合）
+	StockCode    string    `json:"stockCode"`                             // 股票编码
+	Amount       float64   `json:"amount"`                                // 每期定投金额（含税费）
+	Frequency    string    `json:"frequency"`                             // 频率（weekly、biweekly、monthly、trading_day）
+	Day          int       `json:"day"`                                   // 定投日（每周/双周为星期 1-5，每月为日期 1-31，trading_day 为当月第几个交易日）
+	HolidayRule  string    `gorm:"default:next" json:"holidayRule"`       // 定投日休市时的处理（next:顺延、previous:提前、skip:跳过）
+	StartDate    string    `json:"startDate"`                             // 开始日期（yyyy-MM-dd）
+	EndDate      string    `json:"endDate"`                               // 结束日期（yyyy-MM-dd，为空表示不结束）
+	ScheduleFrom string    `json:"scheduleFrom"`                          // 排期开始日期（恢复运行时为恢复当天，暂停期间的定投不再补建）
+	Status       string    `gorm:"default:active" json:"status"`          // 状态（active、paused、ended）
+	Remark       string    `json:"remark"`                                // 备注
+	CreatedAt    time.Time `json:"createdAt"`                             // 创建时间
+	UpdatedAt    time.Time `json:"updatedAt"`                             // 更新时间
+}
+
+// 定投计划的一期：调度生成时待确认，确认后关联买入交易
+type DcaEntry struct {
+	ID         int64     `gorm:"primaryKey" json:"id"`                         // 标识
+	PlanID     int64     `gorm:"uniqueIndex:idx_dca_period" json:"planId"`     // 定投计划标识
+	PeriodDate string    `gorm:"uniqueIndex:idx_dca_period" json:"periodDate"` // 按频率计算的定投日（yyyy-MM-dd）
+	DueDate    string    `json:"dueDate"`                                      // 按休市规则调整后的交易日（yyyy-MM-dd）
+	Amount     float64   `json:"amount"`                                       // 定投金额
+	Status     string    `gorm:"default:pending" json:"status"`                // 状态（pending、confirmed、skipped）
+	TranID     int64     `json:"tranId"`                                       // 确认后生成的买入交易
+	CreatedAt  time.Time `json:"createdAt"`                                    // 创建时间
+	UpdatedAt  time.Time `json:"updatedAt"`                                    // 更新时间
+}
+
+// 定投计划的收益：只统计计划买入的数量，按参考价格计算市值
+type DcaStatus struct {
+	Plan        *DcaPlan        `json:"plan"`
+	Entries     []DcaEntry      `json:"entries"`
+	Pending     int             `json:"pending"`     // 待确认的期数
+	Confirmed   int             `json:"confirmed"`   // 已买入的期数
+	Skipped     int             `json:"skipped"`     // 跳过的期数
+	Quantity    decimal.Decimal `json:"quantity"`    // 累计买入数量
+	Invested    float64         `json:"invested"`    // 累计投入（买入金额加税费）
+	TaxFee      float64         `json:"taxFee"`      // 税费合计
+	AvgCost     float64         `json:"avgCost"`     // 平均成本（含税费）
+	Price       float64         `json:"price"`       // 参考价格（最新收盘价，没有行情时为最近成交价）
+	MarketValue float64         `json:"marketValue"` // 市值
+	ProfitLoss  float64         `json:"profitLoss"`  // 浮动盈亏
+	Roi         float64         `json:"roi"`         // 收益率（%）
+}
+
+// 计划订单执行滑点：实际成交均价与计划价格的差异，正数表示比计划更不利
+type Slippage struct {
+	PlanID         int64           `json:"planId"`
+	StockCode      string          `json:"stockCode"`
+	Action         int8            `json:"action"`
+	PlannedPrice   float64         `json:"plannedPrice"`
+	AvgPrice       float64         `json:"avgPrice"`
+	Quantity       decimal.Decimal `json:"quantity"`
+	FilledQuantity decimal.Decimal `json:"filledQuantity"`
+	FillCount      int             `json:"fillCount"`
+	Slippage       float64         `json:"slippage"`       // 每股滑点
+	SlippageRate   float64         `json:"slippageRate"`   // 滑点比例（%）
+	SlippageAmount float64         `json:"slippageAmount"` // 滑点金额
+}
+
+// 休市日（交易日历中周末以外的非交易日）
+type Holiday struct {
+	Calendar string `gorm:"primaryKey" json:"calendar"` // 交易日历（SSE、HKEX、NYSE）
+	Date     string `gorm:"primaryKey" json:"date"`     // 日期（yyyy-MM-dd）
+	Name     string `json:"name"`                       // 节假日名称
+}
+
+// 做T：同一投资在窗口期内方向相反、数量配对的一买一卖
+type RoundTrip struct {
+	InvestID      int64           `json:"investId"`
+	StockCode     string          `json:"stockCode"`
+	Kind          string          `json:"kind"`        // 先卖后买（sell_buy）或先买后卖（buy_sell）
+	OpenTranID    int64           `json:"openTranId"`  // 先成交的交易
+	CloseTranID   int64           `json:"closeTranId"` // 后成交的交易
+	OpenTime      string          `json:"openTime"`
+	CloseTime     string          `json:"closeTime"`
+	Quantity      decimal.Decimal `json:"quantity"` // 配对数量
+	SellPrice     float64         `json:"sellPrice"`
+	BuyPrice      float64         `json:"buyPrice"`
+	TaxFee        float64         `json:"taxFee"`        // 按配对数量分摊的买卖税费
+	Profit        float64         `json:"profit"`        // 做T收益（卖出金额减买入金额减税费）
+	CostReduction float64         `json:"costReduction"` // 降低的每股成本（收益除以完成后的持仓数量）
+
+	closeAt time.Time // 后成交的时刻，用于按期间统计
+}
+
+// 投资的做T统计
+type RoundTripStats struct {
+	InvestID  int64           `json:"investId"`
+	StockCode string          `json:"stockCode"`
+	Count     int             `json:"count"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	TaxFee    float64         `json:"taxFee"`
+	Profit    float64         `json:"profit"`
+	Trips     []RoundTrip     `json:"trips"`
+}
+
+// 期间内（按后成交的时间）组合的做T统计
+type RoundTripReport struct {
+	PortfolioID int64            `json:"portfolioId"`
+	StartTime   string           `json:"startTime"`
+	FinishTime  string           `json:"finishTime"`
+	Window      int              `json:"window"` // 配对窗口（交易日，0 表示当日）
+	Count       int              `json:"count"`
+	TaxFee      float64          `json:"taxFee"`
+	Profit      float64          `json:"profit"`
+	Investments []RoundTripStats `json:"investments"`
 }
 
+// 日线行情，价格为未复权价格；复权因子为累计因子，后复权价格为价格乘以因子，前复权价格再除以最新因子
+type PriceBar struct {
+	StockCode string  `gorm:"primaryKey" json:"stockCode"` // 股票编码
+	Date      string  `gorm:"primaryKey" json:"date"`      // 日期（yyyy-MM-dd）
+	Open      float64 `json:"open"`                        // 开盘价
+	High      float64 `json:"high"`                        // 最高价
+	Low       float64 `json:"low"`                         // 最低价
+	Close     float64 `json:"close"`                       // 收盘价
+	Volume    float64 `json:"volume"`                      // 成交量
+	Amount    float64 `json:"amount"`                      // 成交额
+	Factor    float64 `json:"factor"`                      // 复权因子
+}
+
+// K线图上的交易标记，价格与行情使用相同的复权方式
+type TradeMarker struct {
+	TranID     int64           `json:"tranId"`
+	Date       string          `json:"date"`
+	FinishTime string          `json:"finishTime"`
+	Action     int8            `json:"action"`   // 买入:1、卖出:-1
+	Price      float64         `json:"price"`    // 复权后的成交价
+	RawPrice   float64         `json:"rawPrice"` // 实际成交价
+	Quantity   decimal.Decimal `json:"quantity"`
+	Amount     float64         `json:"amount"`
+}
+
+type PriceChart struct {
+	StockCode string        `json:"stockCode"`
+	Adjust    string        `json:"adjust"` // 复权方式
+	Bars      []PriceBar    `json:"bars"`
+	Markers   []TradeMarker `json:"markers"`
+}
+
+// 清仓统计，盈亏、收益率和盈亏次数默认按净盈亏计算，Gross 为 true 时按毛盈亏计算
 type ClearStats struct {
 	StockCode   string  `json:"stockCode"`
 	StockName   string  `json:"stockName"`
+	Gross       bool    `json:"gross"`
 	ProfitLoss  float64 `json:"profitLoss"`
+	TotalTaxFee float64 `json:"totalTaxFee"`
+	Amount      float64 `json:"amount"`
 	Roi         float64 `json:"roi"`
 	TotalCount  int     `json:"totalCount"`
 	ProfitCount int     `json:"profitCount"`
@@ -59,8 +363,107 @@ type ClearStats struct {
 	FinishTime  string  `json:"finishTime"`
 }
 
+// 分页及排序参数
+type Page struct {
+	PageNo   int    `json:"pageNo"`   // 页码（从1开始）
+	PageSize int    `json:"pageSize"` // 每页记录数
+	OrderBy  string `json:"orderBy"`  // 排序字段（JSON字段名）
+	Desc     bool   `json:"desc"`     // 是否降序
+}
+
+// 查询条件，各条件之间为“且”的关系，空值表示不过滤
+type Criteria struct {
+	PortfolioID *int64  `json:"portfolioId"` // 投资组合标识，为空时只查询实盘（不含模拟组合）
+	StockCode   string  `json:"stockCode"`   // 股票编码
+	InvestID    int64   `json:"investId"`    // 投资标识（仅交易）
+	Action      int8    `json:"action"`      // 买卖方向：买入:1、卖出:-1（仅交易）
+	Status      *int    `json:"status"`      // 状态（仅投资：0:持仓、1:清仓）
+	StartTime   string  `json:"startTime"`   // 开始时间（交易按成交时间，投资按建仓时间；指定股票时为市场时区，否则为本地时区）
+	FinishTime  string  `json:"finishTime"`  // 结束时间（只有日期时包含当天）
+	MinPrice    float64 `json:"minPrice"`    // 最低价格（交易按成交价，投资按成本价）
+	MaxPrice    float64 `json:"maxPrice"`    // 最高价格
+
+	Range TimeRange `json:"-"` // 由开始和结束时间解析的时间范围
+}
+
+// 回收站（已删除且未清除的数据）
+type RecycleBin struct {
+	Stocks       *[]StockInfo   `json:"stocks"`
+	Investments  *[]Investment  `json:"investments"`
+	Transactions *[]Transaction `json:"transactions"`
+}
+
 type ClearInvest struct {
 	Stock   *StockInfo    `json:"stock"`
 	Stats   *ClearStats   `json:"stats"`
 	Invests *[]Investment `json:"invests"`
 }
+
+// 审计日志结构体（只追加，不修改业务数据）
+type AuditLog struct {
+	ID        int64     `gorm:"primaryKey" json:"id"`         // 标识（唯一标识符）
+	Entity    string    `json:"entity"`                       // 实体类型（stock、investment、transaction）
+	EntityKey string    `json:"entityKey"`                    // 实体标识（股票编码或记录ID）
+	Action    string    `json:"action"`                       // 操作类型（create、update、delete）
+	Before    string    `json:"before"`                       // 变更前数据（JSON）
+	After     string    `json:"after"`                        // 变更后数据（JSON）
+	Operator  string    `json:"operator"`                     // 操作人
+	Reverted  bool      `json:"reverted"`                     // 是否已撤销
+	Derived   bool      `gorm:"default:false" json:"derived"` // 是否为重建持仓产生的投资变更（由交易推导，不能撤销）
+	CreatedAt time.Time `json:"createdAt"`                    // 创建时间
+}
+
+// 数据校验问题
+type IntegrityIssue struct {
+	Kind        string `json:"kind"`        // 问题类型
+	PortfolioID int64  `json:"portfolioId"` // 投资组合标识
+	StockCode   string `json:"stockCode"`   // 股票编码
+	InvestID    int64  `json:"investId"`    // 投资标识
+	TranID      int64  `json:"tranId"`      // 交易标识
+	RelatedID   int64  `json:"relatedId"`   // 关联的投资标识（如合并目标）
+	Field       string `json:"field"`       // 不一致的字段
+	Stored      string `json:"stored"`      // 存储值
+	Expected    string `json:"expected"`    // 重新计算的值
+	Message     string `json:"message"`     // 问题描述
+	Repaired    bool   `json:"repaired"`    // 是否已修复
+}
+
+// 数据校验报告
+type IntegrityReport struct {
+	Investments  int              `json:"investments"`  // 校验的投资数
+	Transactions int              `json:"transactions"` // 校验的交易数
+	Repaired     bool             `json:"repaired"`     // 是否执行了修复
+	Issues       []IntegrityIssue `json:"issues"`       // 发现的问题
+	Migrations   []Migration      `json:"migrations"`   // 未完成的数据迁移
+	CheckTime    time.Time        `json:"checkTime"`    // 校验时间
+}
+
+// 重新计算投资的结果
+type RecomputeReport struct {
+	Holdings int              `json:"holdings"` // 重建成功的持仓数
+	Failures []IntegrityIssue `json:"failures"` // 重建失败的持仓（已回滚，不影响其他持仓）
+}
+
+// 数据迁移：升级后需要执行的数据转换，执行成功前一直为待执行，每次启动时重试
+type Migration struct {
+	Name      string    `gorm:"primaryKey" json:"name"` // 迁移名称
+	Pending   bool      `json:"pending"`                // 是否待执行
+	Message   string    `json:"message"`                // 最近一次执行的结果
+	CreatedAt time.Time `json:"createdAt"`              // 创建时间
+	UpdatedAt time.Time `json:"updatedAt"`              // 更新时间
+}
+
+// 批量新增交易中一行的结果
+type TransactionResult struct {
+	Index       int          `json:"index"`       // 行号（从 0 开始）
+	Transaction *Transaction `json:"transaction"` // 校验后的交易，保存成功时包含标识和投资标识
+	Error       string       `json:"error"`       // 失败原因，为空表示该行有效
+}
+
+// 批量新增交易的结果：任意一行无效时整批都不保存
+type TransactionBatch struct {
+	Total   int                 `json:"total"`   // 总行数
+	Failed  int                 `json:"failed"`  // 无效的行数
+	Saved   bool                `json:"saved"`   // 是否已保存
+	Results []TransactionResult `json:"results"` // 每一行的结果
+}
@@ -0,0 +1,329 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	PlanDraft     = "draft"
+	PlanActive    = "active"
+	PlanPartial   = "partially_filled"
+	PlanFilled    = "filled"
+	PlanCancelled = "cancelled"
+	PlanExpired   = "expired"
+)
+
+// GetPlannedOrders 查询计划订单，status 为空时返回所有状态
+func (ss StockService) GetPlannedOrders(status string) (*[]PlannedOrder, error) {
+	ctx := ss.gtm.Context()
+	plans, err := ss.sr.GetPlannedOrders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]PlannedOrder, 0, len(*plans))
+	for _, plan := range *plans {
+		if err := ss.fillPlan(ctx, &plan); err != nil {
+			return nil, err
+		}
+		if status == "" || plan.Status == status {
+			result = append(result, plan)
+		}
+	}
+	return &result, nil
+}
+
+func (ss StockService) GetPlannedOrder(id int64) (*PlannedOrder, error) {
+	ctx := ss.gtm.Context()
+	plan, err := ss.sr.GetPlannedOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ss.fillPlan(ctx, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// SavePlannedOrder 新增计划订单，状态只能是草稿或生效
+func (ss StockService) SavePlannedOrder(plan *PlannedOrder) error {
+	if plan.Status == "" {
+		plan.Status = PlanDraft
+	}
+	if plan.Status != PlanDraft && plan.Status != PlanActive {
+		return exception.NewBusiness(400, "planned order must be created as draft or active")
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		if err := ss.validatePlan(ctx, plan); err != nil {
+			return err
+		}
+		plan.ID = 0
+		plan.CreatedAt = time.Now()
+		plan.UpdatedAt = time.Now()
+		return ss.sr.CreatePlannedOrder(ctx, plan)
+	})
+}
+
+// UpdatePlannedOrder 修改草稿或生效且未成交的计划订单
+func (ss StockService) UpdatePlannedOrder(plan *PlannedOrder) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		oplan, err := ss.sr.GetPlannedOrder(ctx, plan.ID)
+		if err != nil {
+			return err
+		}
+		if err := ss.fillPlan(ctx, oplan); err != nil {
+			return err
+		}
+		if oplan.Status != PlanDraft && oplan.Status != PlanActive {
+			return exception.NewBusiness(400, fmt.Sprintf("planned order is %s and can not be modified", oplan.Status))
+		}
+		plan.StockCode = oplan.StockCode
+		plan.PortfolioID = oplan.PortfolioID
+		if err := ss.validatePlan(ctx, plan); err != nil {
+			return err
+		}
+
+		oplan.Action = plan.Action
+		oplan.Price = plan.Price
+		oplan.Quantity = plan.Quantity
+		oplan.StopPrice = plan.StopPrice
+		oplan.ExpireDate = plan.ExpireDate
+		oplan.Remark = plan.Remark
+		oplan.UpdatedAt = time.Now()
+		return ss.sr.UpdatePlannedOrder(ctx, oplan)
+	})
+}
+
+// ActivatePlannedOrder 草稿生效后才能执行
+func (ss StockService) ActivatePlannedOrder(id int64) error {
+	return ss.changePlanStatus(id, PlanActive, PlanDraft)
+}
+
+// CancelPlannedOrder 取消未全部成交的计划订单，已成交的交易保留
+func (ss StockService) CancelPlannedOrder(id int64) error {
+	return ss.changePlanStatus(id, PlanCancelled, PlanDraft, PlanActive, PlanPartial)
+}
+
+func (ss StockService) changePlanStatus(id int64, status string, from ...string) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		plan, err := ss.sr.GetPlannedOrder(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := ss.fillPlan(ctx, plan); err != nil {
+			return err
+		}
+		allowed := false
+		for _, s := range from {
+			allowed = allowed || plan.Status == s
+		}
+		if !allowed {
+			return exception.NewBusiness(400, fmt.Sprintf("planned order is %s and can not be changed to %s", plan.Status, status))
+		}
+		plan.Status = status
+		plan.UpdatedAt = time.Now()
+		return ss.sr.UpdatePlannedOrder(ctx, plan)
+	})
+}
+
+// ExecutePlannedOrder 按实际成交生成交易，每笔成交的价格为空时取计划价格，数量为空时取剩余数量；
+// 所有成交在一个数据库事务中通过新增交易的逻辑完成，返回生成的交易
+func (ss StockService) ExecutePlannedOrder(operator string, planId int64, fills []Transaction) (*[]Transaction, error) {
+	if len(fills) == 0 {
+		return nil, exception.NewBusiness(400, "fills are required")
+	}
+	trans := make([]Transaction, 0, len(fills))
+	err := ss.gtm.Execute(func(ctx context.Context) error {
+		plan, err := ss.sr.GetPlannedOrder(ctx, planId)
+		if err != nil {
+			return err
+		}
+		if err := ss.fillPlan(ctx, plan); err != nil {
+			return err
+		}
+		if plan.Status != PlanActive && plan.Status != PlanPartial {
+			return exception.NewBusiness(400, fmt.Sprintf("planned order is %s and can not be executed", plan.Status))
+		}
+
+		for _, fill := range fills {
+			remaining := plan.Quantity.Sub(plan.FilledQuantity)
+			tran := Transaction{
+				PortfolioID: plan.PortfolioID,
+				StockCode:   plan.StockCode,
+				Action:      plan.Action,
+				PlanID:      plan.ID,
+				Price:       fill.Price,
+				Quantity:    fill.Quantity,
+				TaxFee:      fill.TaxFee,
+				FinishTime:  fill.FinishTime,
+			}
+			if tran.Price == 0 {
+				tran.Price = plan.Price
+			}
+			if tran.Quantity.IsZero() {
+				tran.Quantity = remaining
+			}
+			if tran.Quantity.GreaterThan(remaining) {
+				return exception.NewBusiness(400, fmt.Sprintf("fill quantity %s exceeds remaining planned quantity %s", tran.Quantity, remaining))
+			}
+			if plan.ExpireDate != "" && tran.FinishTime != "" && dateOf(tran.FinishTime) > plan.ExpireDate {
+				return exception.NewBusiness(400, fmt.Sprintf("fill at %s is after the planned order expired on %s", tran.FinishTime, plan.ExpireDate))
+			}
+			if err := ss.addTransaction(ctx, operator, &tran); err != nil {
+				return err
+			}
+			plan.FilledQuantity = plan.FilledQuantity.Add(tran.Quantity)
+			trans = append(trans, tran)
+		}
+
+		plan.Status = planStatus(plan.Status, plan.Quantity, plan.FilledQuantity)
+		plan.UpdatedAt = time.Now()
+		return ss.sr.UpdatePlannedOrder(ctx, plan)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &trans, nil
+}
+
+// GetSlippageReport 比较计划价格与实际成交均价，planId 为 0 时返回所有有成交的计划订单
+func (ss StockService) GetSlippageReport(planId int64) (*[]Slippage, error) {
+	ctx := ss.gtm.Context()
+	var plans []PlannedOrder
+	if planId != 0 {
+		plan, err := ss.sr.GetPlannedOrder(ctx, planId)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, *plan)
+	} else {
+		all, err := ss.sr.GetPlannedOrders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		plans = *all
+	}
+
+	report := make([]Slippage, 0, len(plans))
+	for _, plan := range plans {
+		trans, err := ss.sr.GetPlanTransactions(ctx, plan.ID)
+		if err != nil {
+			return nil, exception.WrapService(500, "dao error", err)
+		}
+		if len(*trans) == 0 {
+			continue
+		}
+		filled := decimal.Zero
+		amount := decimal.Zero
+		for _, t := range *trans {
+			filled = filled.Add(t.Quantity)
+			amount = amount.Add(decimal.NewFromFloat(t.Price).Mul(t.Quantity))
+		}
+		avg := amount.Div(filled)
+		// 买入成交价高于计划、卖出成交价低于计划为不利滑点
+		diff := avg.Sub(decimal.NewFromFloat(plan.Price)).Mul(decimal.NewFromInt(int64(plan.Action)))
+		item := Slippage{
+			PlanID:         plan.ID,
+			StockCode:      plan.StockCode,
+			Action:         plan.Action,
+			PlannedPrice:   plan.Price,
+			AvgPrice:       avg.Round(4).InexactFloat64(),
+			Quantity:       plan.Quantity,
+			FilledQuantity: filled,
+			FillCount:      len(*trans),
+			Slippage:       diff.Round(4).InexactFloat64(),
+			SlippageAmount: diff.Mul(filled).RoundBank(2).InexactFloat64(),
+		}
+		if plan.Price != 0 {
+			item.SlippageRate = diff.Div(decimal.NewFromFloat(plan.Price)).Mul(decimal.NewFromInt(100)).Round(2).InexactFloat64()
+		}
+		report = append(report, item)
+	}
+	return &report, nil
+}
+
+func (ss StockService) validatePlan(ctx context.Context, plan *PlannedOrder) error {
+	if plan.StockCode == "" {
+		return exception.NewBusiness(400, "stock code is empty")
+	}
+	if plan.Action != 1 && plan.Action != -1 {
+		return exception.NewBusiness(400, "action must be buy(1) or sell(-1)")
+	}
+	if plan.Price <= 0 {
+		return exception.NewBusiness(400, "price must be positive")
+	}
+	if !plan.Quantity.IsPositive() {
+		return exception.NewBusiness(400, "quantity must be positive")
+	}
+	if plan.StopPrice < 0 {
+		return exception.NewBusiness(400, "stop price can not be negative")
+	}
+	if plan.ExpireDate != "" {
+		if _, err := time.Parse(DateLayout, plan.ExpireDate); err != nil {
+			return exception.WrapBusiness(400, "invalid expire date: "+plan.ExpireDate, err)
+		}
+	}
+	if plan.PortfolioID != 0 {
+		if _, err := ss.sr.GetPortfolio(ctx, plan.PortfolioID); err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "portfolio not found", err)
+			}
+			return err
+		}
+	}
+	if _, err := ss.sr.GetStock(ctx, plan.StockCode); err != nil {
+		if isNotFound(err) {
+			return exception.WrapBusiness(404, "stock not found", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// fillPlan 按关联的交易计算已成交数量，并按成交数量和到期日期更新状态
+func (ss StockService) fillPlan(ctx context.Context, plan *PlannedOrder) error {
+	trans, err := ss.sr.GetPlanTransactions(ctx, plan.ID)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	plan.FilledQuantity = decimal.Zero
+	for _, t := range *trans {
+		plan.FilledQuantity = plan.FilledQuantity.Add(t.Quantity)
+	}
+	plan.Status = planStatus(plan.Status, plan.Quantity, plan.FilledQuantity)
+
+	switch plan.Status {
+	case PlanDraft, PlanActive, PlanPartial:
+		if plan.ExpireDate == "" {
+			break
+		}
+		si, err := ss.stockOf(ctx, plan.StockCode)
+		if err != nil {
+			return err
+		}
+		// 按市场时区的当前日期判断是否到期
+		if marketNow(si).Format(DateLayout) > plan.ExpireDate {
+			plan.Status = PlanExpired
+		}
+	}
+	return nil
+}
+
+// planStatus 生效后的计划订单按成交数量确定状态，删除关联交易后可回到生效或部分成交
+func planStatus(status string, quantity decimal.Decimal, filled decimal.Decimal) string {
+	switch status {
+	case PlanActive, PlanPartial, PlanFilled:
+		if !filled.LessThan(quantity) {
+			return PlanFilled
+		}
+		if filled.IsPositive() {
+			return PlanPartial
+		}
+		return PlanActive
+	}
+	return status
+}
@@ -0,0 +1,206 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// 默认实盘组合的名称（标识为 0，不在组合表中）
+const DefaultPortfolioName = "实盘"
+
+// GetPortfolios 返回所有投资组合（不含默认实盘组合），模拟组合计算资金余额
+func (ss StockService) GetPortfolios() (*[]Portfolio, error) {
+	ctx := ss.gtm.Context()
+	ps, err := ss.sr.GetPortfolios(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range *ps {
+		p := &(*ps)[i]
+		if p.Simulated {
+			if p.Cash, err = ss.portfolioCash(ctx, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ps, nil
+}
+
+func (ss StockService) SavePortfolio(p *Portfolio) error {
+	if p.Name == "" {
+		return exception.NewBusiness(400, "name is required")
+	}
+	if p.InitialCash < 0 {
+		return exception.NewBusiness(400, "initial cash can not be negative")
+	}
+	p.ID = 0
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = time.Now()
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		return ss.sr.CreatePortfolio(ctx, p)
+	})
+}
+
+// UpdatePortfolio 修改组合名称、初始资金和备注，组合是否模拟创建后不能修改
+func (ss StockService) UpdatePortfolio(p *Portfolio) error {
+	if p.Name == "" {
+		return exception.NewBusiness(400, "name is required")
+	}
+	if p.InitialCash < 0 {
+		return exception.NewBusiness(400, "initial cash can not be negative")
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		op, err := ss.sr.GetPortfolio(ctx, p.ID)
+		if err != nil {
+			return err
+		}
+		op.Name = p.Name
+		op.InitialCash = p.InitialCash
+		op.Remark = p.Remark
+		op.UpdatedAt = time.Now()
+		if err := ss.sr.UpdatePortfolio(ctx, op); err != nil {
+			return err
+		}
+		return ss.checkCash(ctx, op.ID)
+	})
+}
+
+// ComparePortfolios 对比同一期间（按股票所在市场的建仓日期）实盘和各组合的清仓表现，默认按净盈亏统计
+func (ss StockService) ComparePortfolios(startTime string, finishTime string, gross bool) (*[]PortfolioStats, error) {
+	ctx := ss.gtm.Context()
+	ps, err := ss.sr.GetPortfolios(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all := append([]Portfolio{{ID: 0, Name: DefaultPortfolioName}}, *ps...)
+	mr, err := ss.newMarketRanges(startTime, finishTime)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]PortfolioStats, 0, len(all))
+	for _, p := range all {
+		invests, err := ss.sr.GetPortfolioInvestments(ctx, p.ID, mr.span())
+		if err != nil {
+			return nil, err
+		}
+		s := PortfolioStats{PortfolioID: p.ID, Name: p.Name, Simulated: p.Simulated, Gross: gross, StartTime: startTime, FinishTime: finishTime}
+		clear := ClearStats{Gross: gross}
+		for _, invest := range *invests {
+			in, err := mr.contains(ctx, invest.StockCode, invest.OpenAt)
+			if err != nil {
+				return nil, err
+			}
+			if !in {
+				continue
+			}
+			if invest.Status != 1 {
+				s.Holdings++
+				continue
+			}
+			clear.add(&invest)
+		}
+		clear.round()
+		s.TotalCount, s.ProfitCount, s.LossCount = clear.TotalCount, clear.ProfitCount, clear.LossCount
+		s.ProfitLoss, s.Amount, s.Roi = clear.ProfitLoss, clear.Amount, clear.Roi
+		if s.TotalCount > 0 {
+			s.WinRate = round2Decimal(float64(s.ProfitCount) / float64(s.TotalCount) * 100)
+		}
+		if p.Simulated {
+			if s.Cash, err = ss.portfolioCash(ctx, &p); err != nil {
+				return nil, err
+			}
+		}
+		stats = append(stats, s)
+	}
+	return &stats, nil
+}
+
+// checkCash 模拟组合按时间累计的资金余额（交易和现金分红）不能为负
+func (ss StockService) checkCash(ctx context.Context, portfolioId int64) error {
+	if portfolioId == 0 {
+		return nil
+	}
+	p, err := ss.sr.GetPortfolio(ctx, portfolioId)
+	if err != nil {
+		return err
+	}
+	if !p.Simulated {
+		return nil
+	}
+	events, err := ss.cashEvents(ctx, portfolioId)
+	if err != nil {
+		return err
+	}
+	cash := decimal.NewFromFloat(p.InitialCash)
+	for _, e := range events {
+		cash = cash.Add(e.flow)
+		if cash.IsNegative() {
+			return exception.NewBusiness(400, fmt.Sprintf("insufficient cash in portfolio %s at %s, short of %s", p.Name, e.time, cash.Neg().StringFixed(2)))
+		}
+	}
+	return nil
+}
+
+// portfolioCash 计算组合当前的资金余额
+func (ss StockService) portfolioCash(ctx context.Context, p *Portfolio) (float64, error) {
+	events, err := ss.cashEvents(ctx, p.ID)
+	if err != nil {
+		return 0, err
+	}
+	cash := decimal.NewFromFloat(p.InitialCash)
+	for _, e := range events {
+		cash = cash.Add(e.flow)
+	}
+	return cash.RoundBank(2).InexactFloat64(), nil
+}
+
+// 组合的一笔资金变动
+type cashEvent struct {
+	time   string
+	flow   decimal.Decimal
+	tranId int64 // 交易标识，现金分红为 0
+}
+
+// cashEvents 按时间合并组合的交易和现金分红的资金变动，同一时刻分红在前
+func (ss StockService) cashEvents(ctx context.Context, portfolioId int64) ([]cashEvent, error) {
+	trans, err := ss.sr.GetPortfolioTransactions(ctx, portfolioId)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	divs, err := ss.sr.GetPortfolioDividends(ctx, portfolioId)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]cashEvent, 0, len(*trans)+len(*divs))
+	i := 0
+	for _, t := range *trans {
+		for ; i < len(*divs) && !(*divs)[i].PaidAt.After(t.FinishAt); i++ {
+			events = append(events, dividendCash((*divs)[i]))
+		}
+		events = append(events, cashEvent{t.FinishTime, cashFlow(t), t.ID})
+	}
+	for ; i < len(*divs); i++ {
+		events = append(events, dividendCash((*divs)[i]))
+	}
+	return events, nil
+}
+
+// dividendCash 现金分红的税后金额全部流入，再投资的买入作为交易支出
+func dividendCash(d Dividend) cashEvent {
+	return cashEvent{d.PayDate, decimal.NewFromFloat(d.Amount), 0}
+}
+
+// cashFlow 返回交易的资金变动：买入支出金额和税费，卖出收入金额并支出税费
+func cashFlow(t Transaction) decimal.Decimal {
+	amount := decimal.NewFromFloat(t.Amount)
+	fee := decimal.NewFromFloat(t.TaxFee)
+	if t.Action == 1 {
+		return amount.Add(fee).Neg()
+	}
+	return amount.Sub(fee)
+}
@@ -0,0 +1,292 @@
+package stock
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"pixiu/backend/pkg/exception"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	AdjustNone     = ""         // 不复权
+	AdjustForward  = "forward"  // 前复权：以最新价格为基准
+	AdjustBackward = "backward" // 后复权：以上市首日价格为基准
+)
+
+// 行情文件的列名（支持英文和中文表头）
+var priceColumns = map[string]string{
+	"date": "date", "trade_date": "date", "日期": "date", "交易日期": "date",
+	"open": "open", "开盘": "open", "开盘价": "open",
+	"high": "high", "最高": "high", "最高价": "high",
+	"low": "low", "最低": "low", "最低价": "low",
+	"close": "close", "收盘": "close", "收盘价": "close",
+	"volume": "volume", "vol": "volume", "成交量": "volume",
+	"amount": "amount", "成交额": "amount",
+	"factor": "factor", "adj_factor": "factor", "复权因子": "factor",
+}
+
+var priceDateLayouts = []string{DateLayout, "20060102", "2006/01/02", "2006/1/2"}
+
+// GetPriceChart 返回日期范围（yyyy-MM-dd，为空表示不限）内的日线行情，并叠加实盘交易的买卖标记
+func (ss StockService) GetPriceChart(stockCode string, startDate string, endDate string, adjust string) (*PriceChart, error) {
+	if stockCode == "" {
+		return nil, exception.NewBusiness(400, "stock code is empty")
+	}
+	ctx := ss.gtm.Context()
+	bars, err := ss.priceBars(ctx, stockCode, startDate, endDate, adjust)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := ss.sr.GetStockTransactions(ctx, 0, stockCode)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+
+	markers := make([]TradeMarker, 0)
+	for _, t := range *trans {
+		date := dateOf(t.FinishTime)
+		if (startDate != "" && date < startDate) || (endDate != "" && date > endDate) {
+			continue
+		}
+		markers = append(markers, TradeMarker{
+			TranID:     t.ID,
+			Date:       date,
+			FinishTime: t.FinishTime,
+			Action:     t.Action,
+			Price:      adjustPrice(t.Price, barRatio(bars.raw, date, bars.ratio)),
+			RawPrice:   t.Price,
+			Quantity:   t.Quantity,
+			Amount:     t.Amount,
+		})
+	}
+	return &PriceChart{StockCode: stockCode, Adjust: adjust, Bars: bars.adjusted, Markers: markers}, nil
+}
+
+// 日线行情及其复权结果
+type adjustedBars struct {
+	raw      []PriceBar
+	adjusted []PriceBar
+	ratio    func(factor float64) float64
+}
+
+// priceBars 查询日线行情并按复权方式调整价格，前复权以股票最新的复权因子为基准
+func (ss StockService) priceBars(ctx context.Context, stockCode string, startDate string, endDate string, adjust string) (*adjustedBars, error) {
+	ratio, err := ss.adjustRatio(ctx, stockCode, adjust)
+	if err != nil {
+		return nil, err
+	}
+	bars, err := ss.sr.GetPriceBars(ctx, stockCode, startDate, endDate)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	result := &adjustedBars{raw: *bars, adjusted: make([]PriceBar, len(*bars)), ratio: ratio}
+	for i, bar := range *bars {
+		r := ratio(bar.Factor)
+		bar.Open = adjustPrice(bar.Open, r)
+		bar.High = adjustPrice(bar.High, r)
+		bar.Low = adjustPrice(bar.Low, r)
+		bar.Close = adjustPrice(bar.Close, r)
+		result.adjusted[i] = bar
+	}
+	return result, nil
+}
+
+// adjustRatio 返回复权因子到价格调整比例的换算
+func (ss StockService) adjustRatio(ctx context.Context, stockCode string, adjust string) (func(float64) float64, error) {
+	switch adjust {
+	case AdjustNone:
+		return func(float64) float64 { return 1 }, nil
+	case AdjustBackward:
+		return func(factor float64) float64 { return factor }, nil
+	case AdjustForward:
+		latest, err := ss.sr.GetLatestPriceBar(ctx, stockCode)
+		if err != nil {
+			if isNotFound(err) {
+				return func(float64) float64 { return 1 }, nil
+			}
+			return nil, exception.WrapService(500, "dao error", err)
+		}
+		base := latest.Factor
+		return func(factor float64) float64 { return factor / base }, nil
+	}
+	return nil, exception.NewBusiness(400, "unknown adjust type: "+adjust)
+}
+
+// barRatio 返回日期当天（没有行情时取之前最近一天，早于所有行情时取第一天）的价格调整比例
+func barRatio(bars []PriceBar, date string, ratio func(float64) float64) float64 {
+	if len(bars) == 0 {
+		return 1
+	}
+	i := sort.Search(len(bars), func(i int) bool { return bars[i].Date > date })
+	return ratio(bars[max(i-1, 0)].Factor)
+}
+
+func adjustPrice(price float64, ratio float64) float64 {
+	if ratio == 1 {
+		return price
+	}
+	return decimal.NewFromFloat(price).Mul(decimal.NewFromFloat(ratio)).Round(4).InexactFloat64()
+}
+
+// referencePrice 返回股票的参考价格：最新收盘价，没有行情时为 fallback（如最近成交价）
+func (ss StockService) referencePrice(ctx context.Context, stockCode string, fallback float64) (float64, error) {
+	bar, err := ss.sr.GetLatestPriceBar(ctx, stockCode)
+	if err != nil {
+		if isNotFound(err) {
+			return fallback, nil
+		}
+		return 0, exception.WrapService(500, "dao error", err)
+	}
+	return bar.Close, nil
+}
+
+// ImportPrices 从 CSV 内容导入股票的日线行情，首行为表头，至少包含日期、开盘、最高、最低、收盘列，
+// 成交量、成交额和复权因子（默认为 1）可选；已有日期的行情被覆盖，返回导入的行情数
+func (ss StockService) ImportPrices(stockCode string, data []byte) (int, error) {
+	if stockCode == "" {
+		return 0, exception.NewBusiness(400, "stock code is empty")
+	}
+	bars, err := parsePriceBars(stockCode, data)
+	if err != nil {
+		return 0, err
+	}
+	if len(bars) == 0 {
+		return 0, exception.NewBusiness(400, "no prices found in the file")
+	}
+
+	err = ss.gtm.Execute(func(ctx context.Context) error {
+		if _, err := ss.sr.GetStock(ctx, stockCode); err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "stock not found", err)
+			}
+			return err
+		}
+		if err := ss.sr.SavePriceBars(ctx, &bars); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(bars), nil
+}
+
+func parsePriceBars(stockCode string, data []byte) ([]PriceBar, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\ufeff"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, exception.WrapBusiness(400, "read price header error", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		if column, ok := priceColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			index[column] = i
+		}
+	}
+	for _, column := range []string{"date", "open", "high", "low", "close"} {
+		if _, ok := index[column]; !ok {
+			return nil, exception.NewBusiness(400, "price file has no "+column+" column")
+		}
+	}
+
+	seen := make(map[string]int)
+	var bars []PriceBar
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, exception.WrapBusiness(400, fmt.Sprintf("read prices error at line %d", line), err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		bar, err := parsePriceBar(stockCode, record, index)
+		if err != nil {
+			return nil, exception.WrapBusiness(400, fmt.Sprintf("invalid price at line %d: %v", line, err), err)
+		}
+		// 同一日期重复时以最后一行为准
+		if i, ok := seen[bar.Date]; ok {
+			bars[i] = *bar
+			continue
+		}
+		seen[bar.Date] = len(bars)
+		bars = append(bars, *bar)
+	}
+	sort.Slice(bars, func(i, j int) bool { return bars[i].Date < bars[j].Date })
+	return bars, nil
+}
+
+func parsePriceBar(stockCode string, record []string, index map[string]int) (*PriceBar, error) {
+	field := func(column string) string {
+		i, ok := index[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	number := func(column string, def float64) (float64, error) {
+		text := strings.ReplaceAll(field(column), ",", "")
+		if text == "" {
+			return def, nil
+		}
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s %q is not a number", column, text)
+		}
+		return value, nil
+	}
+
+	bar := &PriceBar{StockCode: stockCode}
+	date := field("date")
+	for _, layout := range priceDateLayouts {
+		if day, err := time.Parse(layout, date); err == nil {
+			bar.Date = day.Format(DateLayout)
+			break
+		}
+	}
+	if bar.Date == "" {
+		return nil, fmt.Errorf("date %q is invalid", date)
+	}
+
+	var err error
+	for _, f := range []struct {
+		column string
+		value  *float64
+		def    float64
+	}{
+		{"open", &bar.Open, 0}, {"high", &bar.High, 0}, {"low", &bar.Low, 0}, {"close", &bar.Close, 0},
+		{"volume", &bar.Volume, 0}, {"amount", &bar.Amount, 0}, {"factor", &bar.Factor, 1},
+	} {
+		if *f.value, err = number(f.column, f.def); err != nil {
+			return nil, err
+		}
+	}
+
+	if bar.Open <= 0 || bar.High <= 0 || bar.Low <= 0 || bar.Close <= 0 {
+		return nil, fmt.Errorf("prices of %s must be positive", bar.Date)
+	}
+	if bar.Low > min(bar.Open, bar.Close) || bar.High < max(bar.Open, bar.Close) {
+		return nil, fmt.Errorf("prices of %s are out of the low-high range", bar.Date)
+	}
+	if bar.Volume < 0 || bar.Amount < 0 {
+		return nil, fmt.Errorf("volume and amount of %s can not be negative", bar.Date)
+	}
+	if bar.Factor <= 0 {
+		return nil, fmt.Errorf("adjust factor of %s must be positive", bar.Date)
+	}
+	return bar, nil
+}
@@ -0,0 +1,123 @@
+package stock
+
+import (
+	"context"
+	"pixiu/backend/pkg/exception"
+	"time"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 500
+)
+
+func normalizePage(p *Page) *Page {
+	if p == nil {
+		p = &Page{}
+	}
+	if p.PageNo < 1 {
+		p.PageNo = 1
+	}
+	if p.PageSize <= 0 {
+		p.PageSize = DefaultPageSize
+	}
+	if p.PageSize > MaxPageSize {
+		p.PageSize = MaxPageSize
+	}
+	return p
+}
+
+func validateCriteria(c *Criteria) (*Criteria, error) {
+	if c == nil {
+		return &Criteria{}, nil
+	}
+	if c.Action != 0 && c.Action != 1 && c.Action != -1 {
+		return nil, exception.NewBusiness(400, "action must be buy(1) or sell(-1)")
+	}
+	if c.MinPrice > 0 && c.MaxPrice > 0 && c.MinPrice > c.MaxPrice {
+		return nil, exception.NewBusiness(400, "min price is greater than max price")
+	}
+	return c, nil
+}
+
+// QueryTransactions 按条件分页查询交易记录，返回当前页记录和总记录数
+func (ss StockService) QueryTransactions(c *Criteria, p *Page) (*[]Transaction, int64, error) {
+	c, err := validateCriteria(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx := ss.gtm.Context()
+	if c, err = ss.resolveCriteria(ctx, c); err != nil {
+		return nil, 0, err
+	}
+	return ss.sr.QueryTransactions(ctx, c, normalizePage(p))
+}
+
+// QueryInvestments 按条件分页查询投资，返回当前页记录和总记录数
+func (ss StockService) QueryInvestments(c *Criteria, p *Page) (*[]Investment, int64, error) {
+	c, err := validateCriteria(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx := ss.gtm.Context()
+	if c, err = ss.resolveCriteria(ctx, c); err != nil {
+		return nil, 0, err
+	}
+	invests, total, err := ss.sr.QueryInvestments(ctx, c, normalizePage(p))
+	if err != nil {
+		return nil, 0, err
+	}
+	calendars := make(map[string]*TradingCalendar)
+	for i := range *invests {
+		invest := &(*invests)[i]
+		tc, ok := calendars[invest.StockCode]
+		if !ok {
+			si, err := ss.stockOf(ctx, invest.StockCode)
+			if err != nil {
+				return nil, 0, err
+			}
+			if tc, err = ss.stockCalendar(ctx, si); err != nil {
+				return nil, 0, err
+			}
+			calendars[invest.StockCode] = tc
+		}
+		fillHoldingDays(invest, tc)
+	}
+	if err := ss.fillDividends(ctx, *invests); err != nil {
+		return nil, 0, err
+	}
+	return invests, total, nil
+}
+
+// fillHoldingDays 计算持仓的自然日数和交易日数，未清仓的投资计算到市场时区的当前日期
+func fillHoldingDays(invest *Investment, tc *TradingCalendar) {
+	openTime := invest.OpenAt.In(tc.Location())
+	closeTime := tc.Now()
+	if invest.CloseAt != nil {
+		closeTime = invest.CloseAt.In(tc.Location())
+	}
+	invest.HoldingDays = daysBetweenDates(openTime, closeTime)
+	invest.TradingDays = tc.TradingDaysBetween(openTime, closeTime)
+}
+
+// resolveCriteria 按原编码（已改名或被合并）查询时改为按新编码查询，并按股票所在市场的时区（未指定股票时为本地时区）解析时间范围
+func (ss StockService) resolveCriteria(ctx context.Context, c *Criteria) (*Criteria, error) {
+	code, err := ss.resolveCode(ctx, c.StockCode)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *c
+	resolved.StockCode = code
+	loc := time.Local
+	if code != "" {
+		si, err := ss.stockOf(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		loc = marketLocation(si)
+	}
+	if resolved.Range, err = parseTimeRange(c.StartTime, c.FinishTime, loc); err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
@@ -0,0 +1,216 @@
+package stock
+
+import (
+	"context"
+	"pixiu/backend/pkg/exception"
+	"strconv"
+	"time"
+)
+
+// 回收站默认保留天数
+const DefaultRetentionDays = 30
+
+func (ss StockService) GetRecycleBin() (*RecycleBin, error) {
+	ctx := ss.gtm.Context()
+	now := time.Now()
+	stocks, err := ss.sr.DeletedStocks(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	invests, err := ss.sr.DeletedInvestments(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := ss.sr.DeletedTransactions(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	return &RecycleBin{Stocks: stocks, Investments: invests, Transactions: trans}, nil
+}
+
+func (ss StockService) DeleteInvestment(operator string, investId int64) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		return ss.deleteInvestment(ctx, operator, investId)
+	})
+}
+
+func (ss StockService) deleteInvestment(ctx context.Context, operator string, investId int64) error {
+	invest, err := ss.sr.GetInvestment(ctx, investId)
+	if err != nil {
+		return err
+	}
+	if invest.Status == -1 {
+		return exception.NewBusiness(400, "investment is already deleted")
+	}
+	before := *invest
+
+	if err := ss.sr.DeleteInvestment(ctx, investId); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	invest.Status = -1
+	return ss.audit(ctx, operator, EntityInvestment, idKey(investId), ActionDelete, &before, invest)
+}
+
+// RestoreDeleted 从回收站恢复数据，恢复投资或交易后重新计算持仓
+func (ss StockService) RestoreDeleted(operator string, entity string, entityKey string) error {
+	if entityKey == "" {
+		return exception.NewBusiness(400, "entity key is required")
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		switch entity {
+		case EntityStock:
+			return ss.restoreStock(ctx, operator, entityKey)
+		case EntityInvestment, EntityTransaction:
+			id, err := strconv.ParseInt(entityKey, 10, 64)
+			if err != nil {
+				return exception.WrapBusiness(400, "invalid entity key", err)
+			}
+			if entity == EntityInvestment {
+				return ss.restoreInvestment(ctx, operator, id)
+			}
+			return ss.restoreTransaction(ctx, operator, id)
+		}
+		return exception.NewBusiness(400, "unknown entity: "+entity)
+	})
+}
+
+func (ss StockService) restoreStock(ctx context.Context, operator string, code string) error {
+	si, err := ss.sr.GetStock(ctx, code)
+	if err != nil {
+		return err
+	}
+	if si.Status != -1 {
+		return exception.NewBusiness(400, "stock is not deleted")
+	}
+	before := *si
+
+	si.Status = 0
+	si.UpdatedAt = time.Now()
+	if err := ss.sr.UpdateStock(ctx, si); err != nil {
+		return err
+	}
+	return ss.audit(ctx, operator, EntityStock, code, ActionRestore, &before, si)
+}
+
+func (ss StockService) restoreInvestment(ctx context.Context, operator string, investId int64) error {
+	invest, err := ss.sr.GetInvestment(ctx, investId)
+	if err != nil {
+		return err
+	}
+	if invest.Status != -1 {
+		return exception.NewBusiness(400, "investment is not deleted")
+	}
+	trans, err := ss.sr.GetTransactions(ctx, investId)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	if len(*trans) == 0 {
+		return exception.NewBusiness(400, "investment has no transactions, restore its transactions instead")
+	}
+	before := *invest
+
+	if err := ss.sr.RestoreInvestment(ctx, investId); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	invest.Status = 0
+	if err := ss.audit(ctx, operator, EntityInvestment, idKey(investId), ActionRestore, &before, invest); err != nil {
+		return err
+	}
+	return ss.rebuildHolding(ctx, operator, invest.PortfolioID, invest.StockCode)
+}
+
+func (ss StockService) restoreTransaction(ctx context.Context, operator string, tranId int64) error {
+	tran, err := ss.sr.GetTransaction(ctx, tranId)
+	if err != nil {
+		return err
+	}
+	if tran.Status != -1 {
+		return exception.NewBusiness(400, "transaction is not deleted")
+	}
+	// 原投资已删除或不存在时，由重建持仓重新分配投资
+	reassign := false
+	invest, err := ss.sr.GetInvestment(ctx, tran.InvestID)
+	if err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		reassign = true
+	} else if invest.Status == -1 {
+		reassign = true
+	}
+	before := *tran
+
+	if err := ss.sr.RestoreTransaction(ctx, tranId); err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	tran.Status = 0
+	if reassign {
+		if err := ss.sr.UpdateTransactionInvest(ctx, tranId, 0); err != nil {
+			return exception.WrapService(500, "dao error", err)
+		}
+		tran.InvestID = 0
+	}
+	if err := ss.audit(ctx, operator, EntityTransaction, idKey(tranId), ActionRestore, &before, tran); err != nil {
+		return err
+	}
+	return ss.rebuildHolding(ctx, operator, tran.PortfolioID, tran.StockCode)
+}
+
+// PurgeDeleted 永久清除回收站中超过保留天数的数据，返回清除的记录数
+func (ss StockService) PurgeDeleted(operator string, retentionDays int) (int, error) {
+	if retentionDays <= 0 {
+		retentionDays = DefaultRetentionDays
+	}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+
+	purged := 0
+	err := ss.gtm.Execute(func(ctx context.Context) error {
+		trans, err := ss.sr.DeletedTransactions(ctx, cutoff)
+		if err != nil {
+			return err
+		}
+		for _, t := range *trans {
+			if err := ss.sr.PurgeTransaction(ctx, t.ID); err != nil {
+				return err
+			}
+			if err := ss.audit(ctx, operator, EntityTransaction, idKey(t.ID), ActionPurge, &t, nil); err != nil {
+				return err
+			}
+			purged++
+		}
+
+		invests, err := ss.sr.DeletedInvestments(ctx, cutoff)
+		if err != nil {
+			return err
+		}
+		for _, i := range *invests {
+			if err := ss.sr.PurgeInvestment(ctx, i.ID); err != nil {
+				return err
+			}
+			if err := ss.audit(ctx, operator, EntityInvestment, idKey(i.ID), ActionPurge, &i, nil); err != nil {
+				return err
+			}
+			purged++
+		}
+
+		stocks, err := ss.sr.DeletedStocks(ctx, cutoff)
+		if err != nil {
+			return err
+		}
+		for _, s := range *stocks {
+			ok, err := ss.sr.PurgeStock(ctx, s.Code)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := ss.audit(ctx, operator, EntityStock, s.Code, ActionPurge, &s, nil); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
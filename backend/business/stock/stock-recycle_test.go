@@ -0,0 +1,31 @@
+package stock
+
+import (
+	"testing"
+)
+
+func TestRebuildRemovesEmptyInvestment(t *testing.T) {
+	ss, repo := newTestService(t, "600000")
+	tran := &Transaction{StockCode: "600000", Action: 1, Price: 10, Quantity: qty("100"), FinishTime: "2025-06-03 10:00:00"}
+	if err := ss.AddTransaction("test", tran); err != nil {
+		t.Fatal(err)
+	}
+	investId := tran.InvestID
+
+	// 删除唯一的交易后投资不进入回收站
+	if err := ss.DeleteTransaction("test", tran.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repo.invests[investId]; ok {
+		t.Fatalf("investment %d is kept after its only transaction is deleted", investId)
+	}
+
+	// 恢复交易时重新建立投资
+	if err := ss.RestoreDeleted("test", EntityTransaction, idKey(tran.ID)); err != nil {
+		t.Fatal(err)
+	}
+	invests := openInvestments(t, repo, "600000")
+	if len(invests) != 1 || !invests[0].Quantity.Equal(qty("100")) || repo.trans[tran.ID].InvestID != invests[0].ID {
+		t.Fatalf("got investments %+v after restoring the transaction, want one holding 100", invests)
+	}
+}
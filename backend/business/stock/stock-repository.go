@@ -2,6 +2,7 @@ package stock
 
 import (
 	"context"
+	"time"
 )
 
 type StockRepository interface {
@@ -19,13 +20,99 @@ type StockRepository interface {
 	UpdateInvestment(ctx context.Context, invest *Investment) error
 	GetInvestment(ctx context.Context, id int64) (*Investment, error)
 	DeleteInvestment(ctx context.Context, id int64) error
+	RestoreInvestment(ctx context.Context, id int64) error
+	// RemoveInvestment 永久删除没有交易的投资，不删除关联的已删除交易
+	RemoveInvestment(ctx context.Context, id int64) error
 
 	CreateTransaction(ctx context.Context, trans *Transaction) error
 	UpdateTransaction(ctx context.Context, trans *Transaction) error
 	GetTransaction(ctx context.Context, id int64) (*Transaction, error)
 	DeleteTransaction(ctx context.Context, id int64) error
+	RestoreTransaction(ctx context.Context, id int64) error
 	GetTransactions(ctx context.Context, investId int64) (*[]Transaction, error)
+	UpdateTransactionInvest(ctx context.Context, id int64, investId int64) error
+	GetUnstampedTransactions(ctx context.Context) (*[]Transaction, error)
+	UpdateTransactionTime(ctx context.Context, tran *Transaction) error
 
-	GetClearList(context context.Context, stime string, ftime string) (*[]ClearStats, error)
-	GetClearInvest(context context.Context, stockCode string, startTime string, finishTime string) (*[]Investment, error)
+	GetStockInvestments(ctx context.Context, portfolioId int64, stockCode string) (*[]Investment, error)
+	GetStockTransactions(ctx context.Context, portfolioId int64, stockCode string) (*[]Transaction, error)
+	GetStockPortfolios(ctx context.Context, stockCode string) ([]int64, error)
+
+	QueryInvestments(ctx context.Context, c *Criteria, p *Page) (*[]Investment, int64, error)
+	QueryTransactions(ctx context.Context, c *Criteria, p *Page) (*[]Transaction, int64, error)
+
+	GetInvestments(ctx context.Context) (*[]Investment, error)
+	GetAllTransactions(ctx context.Context) (*[]Transaction, error)
+
+	GetClearInvest(context context.Context, stockCode string, r TimeRange) (*[]Investment, error)
+
+	DeletedStocks(ctx context.Context, before time.Time) (*[]StockInfo, error)
+	DeletedInvestments(ctx context.Context, before time.Time) (*[]Investment, error)
+	DeletedTransactions(ctx context.Context, before time.Time) (*[]Transaction, error)
+	PurgeStock(ctx context.Context, code string) (bool, error)
+	PurgeInvestment(ctx context.Context, id int64) error
+	PurgeTransaction(ctx context.Context, id int64) error
+
+	SaveMigration(ctx context.Context, m *Migration) error
+	GetMigration(ctx context.Context, name string) (*Migration, error)
+	GetPendingMigrations(ctx context.Context) (*[]Migration, error)
+
+	CreateAuditLog(ctx context.Context, log *AuditLog) error
+	GetAuditLog(ctx context.Context, id int64) (*AuditLog, error)
+	RevertAuditLog(ctx context.Context, id int64) error
+	GetAuditLogs(ctx context.Context, entity string, entityKey string) (*[]AuditLog, error)
+
+	CreatePortfolio(ctx context.Context, p *Portfolio) error
+	UpdatePortfolio(ctx context.Context, p *Portfolio) error
+	GetPortfolio(ctx context.Context, id int64) (*Portfolio, error)
+	GetPortfolios(ctx context.Context) (*[]Portfolio, error)
+	GetPortfolioTransactions(ctx context.Context, portfolioId int64) (*[]Transaction, error)
+	GetPortfolioInvestments(ctx context.Context, portfolioId int64, r TimeRange) (*[]Investment, error)
+
+	CreatePlannedOrder(ctx context.Context, plan *PlannedOrder) error
+	UpdatePlannedOrder(ctx context.Context, plan *PlannedOrder) error
+	GetPlannedOrder(ctx context.Context, id int64) (*PlannedOrder, error)
+	GetPlannedOrders(ctx context.Context) (*[]PlannedOrder, error)
+
+	GetCodeTransactions(ctx context.Context, code string) (*[]Transaction, error)
+	UpdateTransactionCode(ctx context.Context, tran *Transaction) error
+	ChangeInvestmentCode(ctx context.Context, from string, to string) error
+	ChangeStockRefs(ctx context.Context, from string, to string) error
+	ChangeAmountRefs(ctx context.Context, from string, to string) error
+	SaveStockAlias(ctx context.Context, alias *StockAlias) error
+	GetStockAlias(ctx context.Context, code string) (*StockAlias, error)
+	GetStockAliases(ctx context.Context) (*[]StockAlias, error)
+	RetargetStockAliases(ctx context.Context, from string, to string) error
+	DeleteStockAlias(ctx context.Context, code string) error
+
+	CreateGridPlan(ctx context.Context, plan *GridPlan) error
+	UpdateGridPlan(ctx context.Context, plan *GridPlan) error
+	GetGridPlan(ctx context.Context, id int64) (*GridPlan, error)
+	GetGridPlans(ctx context.Context) (*[]GridPlan, error)
+
+	CreateDcaPlan(ctx context.Context, plan *DcaPlan) error
+	UpdateDcaPlan(ctx context.Context, plan *DcaPlan) error
+	GetDcaPlan(ctx context.Context, id int64) (*DcaPlan, error)
+	GetDcaPlans(ctx context.Context) (*[]DcaPlan, error)
+	CreateDcaEntry(ctx context.Context, entry *DcaEntry) error
+	UpdateDcaEntry(ctx context.Context, entry *DcaEntry) error
+	GetDcaEntry(ctx context.Context, id int64) (*DcaEntry, error)
+	GetDcaEntries(ctx context.Context, planId int64) (*[]DcaEntry, error)
+	GetPlanTransactions(ctx context.Context, planId int64) (*[]Transaction, error)
+
+	CreateDividend(ctx context.Context, d *Dividend) error
+	UpdateDividend(ctx context.Context, d *Dividend) error
+	GetDividend(ctx context.Context, id int64) (*Dividend, error)
+	DeleteDividend(ctx context.Context, id int64) error
+	GetDividends(ctx context.Context, stockCode string) (*[]Dividend, error)
+	GetStockDividends(ctx context.Context, portfolioId int64, stockCode string) (*[]Dividend, error)
+	GetPortfolioDividends(ctx context.Context, portfolioId int64) (*[]Dividend, error)
+
+	GetHolidays(ctx context.Context, calendar string) (*[]Holiday, error)
+	DeleteHolidays(ctx context.Context, calendar string) error
+	SaveHolidays(ctx context.Context, holidays *[]Holiday) error
+
+	SavePriceBars(ctx context.Context, bars *[]PriceBar) error
+	GetPriceBars(ctx context.Context, stockCode string, startDate string, endDate string) (*[]PriceBar, error)
+	GetLatestPriceBar(ctx context.Context, stockCode string) (*PriceBar, error)
 }
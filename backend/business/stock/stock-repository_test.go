@@ -0,0 +1,599 @@
+package stock
+
+import (
+	"context"
+	"pixiu/backend/pkg/exception"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// memoryTM 单元测试的事务管理：Execute 失败时恢复执行前的数据
+type memoryTM struct {
+	repo *memoryRepository
+}
+
+func (tm *memoryTM) Context() context.Context {
+	return context.Background()
+}
+
+func (tm *memoryTM) Execute(fc func(ctx context.Context) error) error {
+	saved := tm.repo.snapshot()
+	if err := fc(context.Background()); err != nil {
+		*tm.repo = saved
+		return err
+	}
+	return nil
+}
+
+// memoryRepository 单元测试使用的内存仓库，只实现测试用到的方法
+type memoryRepository struct {
+	StockRepository
+
+	nextID     int64
+	stocks     map[string]StockInfo
+	portfolios map[int64]Portfolio
+	invests    map[int64]Investment
+	trans      map[int64]Transaction
+	logs       []AuditLog
+	plans      map[int64]DcaPlan
+	entries    map[int64]DcaEntry
+	orders     map[int64]PlannedOrder
+	grids      map[int64]GridPlan
+	aliases    map[string]StockAlias
+	holidays   []Holiday
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		stocks:     make(map[string]StockInfo),
+		portfolios: make(map[int64]Portfolio),
+		invests:    make(map[int64]Investment),
+		trans:      make(map[int64]Transaction),
+		plans:      make(map[int64]DcaPlan),
+		entries:    make(map[int64]DcaEntry),
+		orders:     make(map[int64]PlannedOrder),
+		grids:      make(map[int64]GridPlan),
+		aliases:    make(map[string]StockAlias),
+	}
+}
+
+func (r *memoryRepository) snapshot() memoryRepository {
+	saved := *r
+	saved.stocks = make(map[string]StockInfo, len(r.stocks))
+	for k, v := range r.stocks {
+		saved.stocks[k] = v
+	}
+	saved.portfolios = make(map[int64]Portfolio, len(r.portfolios))
+	for k, v := range r.portfolios {
+		saved.portfolios[k] = v
+	}
+	saved.invests = make(map[int64]Investment, len(r.invests))
+	for k, v := range r.invests {
+		saved.invests[k] = v
+	}
+	saved.trans = make(map[int64]Transaction, len(r.trans))
+	for k, v := range r.trans {
+		saved.trans[k] = v
+	}
+	saved.plans = make(map[int64]DcaPlan, len(r.plans))
+	for k, v := range r.plans {
+		saved.plans[k] = v
+	}
+	saved.entries = make(map[int64]DcaEntry, len(r.entries))
+	for k, v := range r.entries {
+		saved.entries[k] = v
+	}
+	saved.orders = make(map[int64]PlannedOrder, len(r.orders))
+	for k, v := range r.orders {
+		saved.orders[k] = v
+	}
+	saved.grids = make(map[int64]GridPlan, len(r.grids))
+	for k, v := range r.grids {
+		saved.grids[k] = v
+	}
+	saved.aliases = make(map[string]StockAlias, len(r.aliases))
+	for k, v := range r.aliases {
+		saved.aliases[k] = v
+	}
+	saved.logs = append([]AuditLog(nil), r.logs...)
+	return saved
+}
+
+func (r *memoryRepository) id() int64 {
+	r.nextID++
+	return r.nextID
+}
+
+func notFound() error {
+	return exception.NewBusiness(404, "record not found")
+}
+
+func (r *memoryRepository) GetStock(ctx context.Context, code string) (*StockInfo, error) {
+	si, ok := r.stocks[code]
+	if !ok || si.Status == -1 {
+		return nil, notFound()
+	}
+	return &si, nil
+}
+
+func (r *memoryRepository) SaveStock(ctx context.Context, si *StockInfo) error {
+	r.stocks[si.Code] = *si
+	return nil
+}
+
+func (r *memoryRepository) DeleteStock(ctx context.Context, code string) error {
+	si := r.stocks[code]
+	si.Status = -1
+	r.stocks[code] = si
+	return nil
+}
+
+func (r *memoryRepository) PurgeStock(ctx context.Context, code string) (bool, error) {
+	for _, invest := range r.invests {
+		if invest.StockCode == code {
+			return false, nil
+		}
+	}
+	if si, ok := r.stocks[code]; !ok || si.Status != -1 {
+		return false, nil
+	}
+	delete(r.stocks, code)
+	return true, nil
+}
+
+func (r *memoryRepository) UpdateStock(ctx context.Context, si *StockInfo) error {
+	r.stocks[si.Code] = *si
+	return nil
+}
+
+func (r *memoryRepository) GetStockPortfolios(ctx context.Context, stockCode string) ([]int64, error) {
+	var portfolios []int64
+	seen := make(map[int64]bool)
+	for _, t := range r.trans {
+		if t.StockCode == stockCode && !seen[t.PortfolioID] {
+			seen[t.PortfolioID] = true
+			portfolios = append(portfolios, t.PortfolioID)
+		}
+	}
+	sort.Slice(portfolios, func(i, j int) bool { return portfolios[i] < portfolios[j] })
+	return portfolios, nil
+}
+
+func (r *memoryRepository) GetStockAlias(ctx context.Context, code string) (*StockAlias, error) {
+	alias, ok := r.aliases[code]
+	if !ok {
+		return nil, notFound()
+	}
+	return &alias, nil
+}
+
+func (r *memoryRepository) SaveStockAlias(ctx context.Context, alias *StockAlias) error {
+	r.aliases[alias.Code] = *alias
+	return nil
+}
+
+func (r *memoryRepository) RetargetStockAliases(ctx context.Context, from string, to string) error {
+	for code, alias := range r.aliases {
+		if alias.StockCode == from {
+			alias.StockCode = to
+			r.aliases[code] = alias
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) DeleteStockAlias(ctx context.Context, code string) error {
+	delete(r.aliases, code)
+	return nil
+}
+
+func (r *memoryRepository) GetCodeTransactions(ctx context.Context, code string) (*[]Transaction, error) {
+	var trans []Transaction
+	for _, t := range r.trans {
+		if t.StockCode == code {
+			trans = append(trans, t)
+		}
+	}
+	sortTransactions(trans)
+	return &trans, nil
+}
+
+func (r *memoryRepository) UpdateTransactionCode(ctx context.Context, tran *Transaction) error {
+	r.trans[tran.ID] = *tran
+	return nil
+}
+
+func (r *memoryRepository) ChangeInvestmentCode(ctx context.Context, from string, to string) error {
+	for id, invest := range r.invests {
+		if invest.StockCode == from {
+			invest.StockCode = to
+			r.invests[id] = invest
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) ChangeStockRefs(ctx context.Context, from string, to string) error {
+	for id, plan := range r.orders {
+		if plan.StockCode == from {
+			plan.StockCode = to
+			r.orders[id] = plan
+		}
+	}
+	for id, plan := range r.grids {
+		if plan.StockCode == from {
+			plan.StockCode = to
+			r.grids[id] = plan
+		}
+	}
+	return r.ChangeAmountRefs(ctx, from, to)
+}
+
+func (r *memoryRepository) ChangeAmountRefs(ctx context.Context, from string, to string) error {
+	for id, plan := range r.plans {
+		if plan.StockCode == from {
+			plan.StockCode = to
+			r.plans[id] = plan
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetPortfolio(ctx context.Context, id int64) (*Portfolio, error) {
+	p, ok := r.portfolios[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &p, nil
+}
+
+func (r *memoryRepository) GetPortfolioDividends(ctx context.Context, portfolioId int64) (*[]Dividend, error) {
+	return &[]Dividend{}, nil
+}
+
+func (r *memoryRepository) GetHolidays(ctx context.Context, calendar string) (*[]Holiday, error) {
+	var holidays []Holiday
+	for _, h := range r.holidays {
+		if h.Calendar == calendar {
+			holidays = append(holidays, h)
+		}
+	}
+	return &holidays, nil
+}
+
+func (r *memoryRepository) CreateInvestment(ctx context.Context, invest *Investment) error {
+	invest.ID = r.id()
+	r.invests[invest.ID] = *invest
+	return nil
+}
+
+func (r *memoryRepository) UpdateInvestment(ctx context.Context, invest *Investment) error {
+	r.invests[invest.ID] = *invest
+	return nil
+}
+
+func (r *memoryRepository) GetInvestment(ctx context.Context, id int64) (*Investment, error) {
+	invest, ok := r.invests[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &invest, nil
+}
+
+func (r *memoryRepository) DeleteInvestment(ctx context.Context, id int64) error {
+	invest := r.invests[id]
+	invest.Status = -1
+	r.invests[id] = invest
+	return nil
+}
+
+func (r *memoryRepository) RemoveInvestment(ctx context.Context, id int64) error {
+	delete(r.invests, id)
+	return nil
+}
+
+func (r *memoryRepository) CreateTransaction(ctx context.Context, tran *Transaction) error {
+	tran.ID = r.id()
+	r.trans[tran.ID] = *tran
+	return nil
+}
+
+func (r *memoryRepository) UpdateTransaction(ctx context.Context, tran *Transaction) error {
+	r.trans[tran.ID] = *tran
+	return nil
+}
+
+func (r *memoryRepository) GetTransaction(ctx context.Context, id int64) (*Transaction, error) {
+	tran, ok := r.trans[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &tran, nil
+}
+
+func (r *memoryRepository) DeleteTransaction(ctx context.Context, id int64) error {
+	tran := r.trans[id]
+	tran.Status = -1
+	r.trans[id] = tran
+	return nil
+}
+
+func (r *memoryRepository) RestoreTransaction(ctx context.Context, id int64) error {
+	tran := r.trans[id]
+	tran.Status = 0
+	r.trans[id] = tran
+	return nil
+}
+
+func (r *memoryRepository) UpdateTransactionInvest(ctx context.Context, id int64, investId int64) error {
+	tran := r.trans[id]
+	tran.InvestID = investId
+	r.trans[id] = tran
+	return nil
+}
+
+func (r *memoryRepository) GetStockInvestments(ctx context.Context, portfolioId int64, stockCode string) (*[]Investment, error) {
+	var invests []Investment
+	for _, invest := range r.invests {
+		if invest.PortfolioID == portfolioId && invest.StockCode == stockCode && invest.Status != -1 {
+			invests = append(invests, invest)
+		}
+	}
+	sort.Slice(invests, func(i, j int) bool {
+		if !invests[i].OpenAt.Equal(invests[j].OpenAt) {
+			return invests[i].OpenAt.Before(invests[j].OpenAt)
+		}
+		return invests[i].ID < invests[j].ID
+	})
+	return &invests, nil
+}
+
+func (r *memoryRepository) GetClearInvest(ctx context.Context, stockCode string, tr TimeRange) (*[]Investment, error) {
+	var invests []Investment
+	for _, invest := range r.invests {
+		if invest.Status == 1 && (stockCode == "" || invest.StockCode == stockCode) && tr.Contains(invest.OpenAt) {
+			invests = append(invests, invest)
+		}
+	}
+	sort.Slice(invests, func(i, j int) bool { return invests[i].ID < invests[j].ID })
+	return &invests, nil
+}
+
+func (r *memoryRepository) GetStockTransactions(ctx context.Context, portfolioId int64, stockCode string) (*[]Transaction, error) {
+	var trans []Transaction
+	for _, t := range r.trans {
+		if t.PortfolioID != portfolioId || t.StockCode != stockCode || t.Status != 0 {
+			continue
+		}
+		if invest, ok := r.invests[t.InvestID]; ok && invest.Status == -1 {
+			continue
+		}
+		trans = append(trans, t)
+	}
+	sortTransactions(trans)
+	return &trans, nil
+}
+
+func (r *memoryRepository) GetPortfolioTransactions(ctx context.Context, portfolioId int64) (*[]Transaction, error) {
+	var trans []Transaction
+	for _, t := range r.trans {
+		if t.PortfolioID == portfolioId && t.Status == 0 {
+			trans = append(trans, t)
+		}
+	}
+	sortTransactions(trans)
+	return &trans, nil
+}
+
+func (r *memoryRepository) GetPlanTransactions(ctx context.Context, planId int64) (*[]Transaction, error) {
+	var trans []Transaction
+	for _, t := range r.trans {
+		if t.PlanID == planId && t.Status == 0 {
+			trans = append(trans, t)
+		}
+	}
+	sortTransactions(trans)
+	return &trans, nil
+}
+
+func sortTransactions(trans []Transaction) {
+	sort.Slice(trans, func(i, j int) bool {
+		if !trans[i].FinishAt.Equal(trans[j].FinishAt) {
+			return trans[i].FinishAt.Before(trans[j].FinishAt)
+		}
+		return trans[i].ID < trans[j].ID
+	})
+}
+
+func (r *memoryRepository) CreateAuditLog(ctx context.Context, log *AuditLog) error {
+	log.ID = r.id()
+	r.logs = append(r.logs, *log)
+	return nil
+}
+
+func (r *memoryRepository) GetAuditLog(ctx context.Context, id int64) (*AuditLog, error) {
+	for _, log := range r.logs {
+		if log.ID == id {
+			return &log, nil
+		}
+	}
+	return nil, notFound()
+}
+
+func (r *memoryRepository) RevertAuditLog(ctx context.Context, id int64) error {
+	for i := range r.logs {
+		if r.logs[i].ID == id {
+			r.logs[i].Reverted = true
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetAuditLogs(ctx context.Context, entity string, entityKey string) (*[]AuditLog, error) {
+	var logs []AuditLog
+	for i := len(r.logs) - 1; i >= 0; i-- {
+		if r.logs[i].Entity == entity && (entityKey == "" || r.logs[i].EntityKey == entityKey) {
+			logs = append(logs, r.logs[i])
+		}
+	}
+	return &logs, nil
+}
+
+func (r *memoryRepository) CreatePlannedOrder(ctx context.Context, plan *PlannedOrder) error {
+	plan.ID = r.id()
+	r.orders[plan.ID] = *plan
+	return nil
+}
+
+func (r *memoryRepository) UpdatePlannedOrder(ctx context.Context, plan *PlannedOrder) error {
+	r.orders[plan.ID] = *plan
+	return nil
+}
+
+func (r *memoryRepository) GetPlannedOrder(ctx context.Context, id int64) (*PlannedOrder, error) {
+	plan, ok := r.orders[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &plan, nil
+}
+
+func (r *memoryRepository) GetPlannedOrders(ctx context.Context) (*[]PlannedOrder, error) {
+	var plans []PlannedOrder
+	for _, plan := range r.orders {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID > plans[j].ID })
+	return &plans, nil
+}
+
+func (r *memoryRepository) CreateGridPlan(ctx context.Context, plan *GridPlan) error {
+	plan.ID = r.id()
+	r.grids[plan.ID] = *plan
+	return nil
+}
+
+func (r *memoryRepository) UpdateGridPlan(ctx context.Context, plan *GridPlan) error {
+	r.grids[plan.ID] = *plan
+	return nil
+}
+
+func (r *memoryRepository) GetGridPlan(ctx context.Context, id int64) (*GridPlan, error) {
+	plan, ok := r.grids[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &plan, nil
+}
+
+func (r *memoryRepository) GetGridPlans(ctx context.Context) (*[]GridPlan, error) {
+	var plans []GridPlan
+	for _, plan := range r.grids {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID > plans[j].ID })
+	return &plans, nil
+}
+
+func (r *memoryRepository) CreateDcaPlan(ctx context.Context, plan *DcaPlan) error {
+	plan.ID = r.id()
+	r.plans[plan.ID] = *plan
+	return nil
+}
+
+func (r *memoryRepository) UpdateDcaPlan(ctx context.Context, plan *DcaPlan) error {
+	r.plans[plan.ID] = *plan
+	return nil
+}
+
+func (r *memoryRepository) GetDcaPlan(ctx context.Context, id int64) (*DcaPlan, error) {
+	plan, ok := r.plans[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &plan, nil
+}
+
+func (r *memoryRepository) GetDcaPlans(ctx context.Context) (*[]DcaPlan, error) {
+	var plans []DcaPlan
+	for _, plan := range r.plans {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID > plans[j].ID })
+	return &plans, nil
+}
+
+func (r *memoryRepository) CreateDcaEntry(ctx context.Context, entry *DcaEntry) error {
+	for _, e := range r.entries {
+		if e.PlanID == entry.PlanID && e.PeriodDate == entry.PeriodDate {
+			return exception.NewBusiness(403, "duplicated key not allowed")
+		}
+	}
+	entry.ID = r.id()
+	r.entries[entry.ID] = *entry
+	return nil
+}
+
+func (r *memoryRepository) UpdateDcaEntry(ctx context.Context, entry *DcaEntry) error {
+	r.entries[entry.ID] = *entry
+	return nil
+}
+
+func (r *memoryRepository) GetDcaEntry(ctx context.Context, id int64) (*DcaEntry, error) {
+	entry, ok := r.entries[id]
+	if !ok {
+		return nil, notFound()
+	}
+	return &entry, nil
+}
+
+func (r *memoryRepository) GetDcaEntries(ctx context.Context, planId int64) (*[]DcaEntry, error) {
+	var entries []DcaEntry
+	for _, e := range r.entries {
+		if planId == 0 || e.PlanID == planId {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].DueDate != entries[j].DueDate {
+			return entries[i].DueDate < entries[j].DueDate
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return &entries, nil
+}
+
+// newTestService 创建使用内存仓库的股票服务，并登记没有市场规则的测试股票
+func newTestService(t *testing.T, codes ...string) (*StockService, *memoryRepository) {
+	t.Helper()
+	repo := newMemoryRepository()
+	for _, code := range codes {
+		repo.stocks[code] = StockInfo{Code: code, Name: code, Type: InstrumentStock}
+	}
+	return NewStockService(&memoryTM{repo}, repo), repo
+}
+
+// openInvestments 返回股票未删除的投资，按建仓时间排列
+func openInvestments(t *testing.T, repo *memoryRepository, code string) []Investment {
+	t.Helper()
+	invests, err := repo.GetStockInvestments(context.Background(), 0, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *invests
+}
+
+func qty(value string) decimal.Decimal {
+	return decimal.RequireFromString(value)
+}
+
+func at(datetime string) time.Time {
+	t, err := time.ParseInLocation(DateTimeLayout, datetime, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t.UTC()
+}
@@ -0,0 +1,217 @@
+package stock
+
+import (
+	"context"
+	"pixiu/backend/pkg/exception"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	RoundTripSellBuy = "sell_buy" // 先卖后买（反T）
+	RoundTripBuySell = "buy_sell" // 先买后卖（正T）
+)
+
+// GetRoundTrips 识别投资中的做T，window 为两笔交易相隔的最大交易日数（0 表示当日）
+func (ss StockService) GetRoundTrips(investId int64, window int) (*RoundTripStats, error) {
+	if window < 0 {
+		return nil, exception.NewBusiness(400, "window can not be negative")
+	}
+	ctx := ss.gtm.Context()
+	invest, err := ss.sr.GetInvestment(ctx, investId)
+	if err != nil {
+		return nil, err
+	}
+	trans, err := ss.sr.GetTransactions(ctx, investId)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	si, err := ss.stockOf(ctx, invest.StockCode)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return nil, err
+	}
+	stats := newRoundTripStats(invest.ID, invest.StockCode, matchRoundTrips(*trans, window, tc))
+	return &stats, nil
+}
+
+// GetRoundTripReport 统计组合（0 为实盘）在期间内（按股票所在市场的时区）完成的做T，按投资汇总
+func (ss StockService) GetRoundTripReport(portfolioId int64, startTime string, finishTime string, window int) (*RoundTripReport, error) {
+	if window < 0 {
+		return nil, exception.NewBusiness(400, "window can not be negative")
+	}
+	ctx := ss.gtm.Context()
+	trans, err := ss.sr.GetPortfolioTransactions(ctx, portfolioId)
+	if err != nil {
+		return nil, exception.WrapService(500, "dao error", err)
+	}
+	var investIds []int64
+	grouped := make(map[int64][]Transaction)
+	for _, t := range *trans {
+		if _, ok := grouped[t.InvestID]; !ok {
+			investIds = append(investIds, t.InvestID)
+		}
+		grouped[t.InvestID] = append(grouped[t.InvestID], t)
+	}
+
+	mr, err := ss.newMarketRanges(startTime, finishTime)
+	if err != nil {
+		return nil, err
+	}
+	report := &RoundTripReport{PortfolioID: portfolioId, StartTime: startTime, FinishTime: finishTime, Window: window, Investments: []RoundTripStats{}}
+	calendars := make(map[string]*TradingCalendar)
+	profit, taxFee := decimal.Zero, decimal.Zero
+	for _, investId := range investIds {
+		investTrans := grouped[investId]
+		code := investTrans[0].StockCode
+		tc, err := ss.codeCalendar(ctx, code, calendars)
+		if err != nil {
+			return nil, err
+		}
+		var trips []RoundTrip
+		for _, trip := range matchRoundTrips(investTrans, window, tc) {
+			in, err := mr.contains(ctx, code, trip.closeAt)
+			if err != nil {
+				return nil, err
+			}
+			if in {
+				trips = append(trips, trip)
+			}
+		}
+		if len(trips) == 0 {
+			continue
+		}
+		stats := newRoundTripStats(investId, code, trips)
+		report.Count += stats.Count
+		profit = profit.Add(decimal.NewFromFloat(stats.Profit))
+		taxFee = taxFee.Add(decimal.NewFromFloat(stats.TaxFee))
+		report.Investments = append(report.Investments, stats)
+	}
+	report.Profit = profit.RoundBank(2).InexactFloat64()
+	report.TaxFee = taxFee.RoundBank(2).InexactFloat64()
+	return report, nil
+}
+
+// codeCalendar 按股票编码加载交易日历并缓存
+func (ss StockService) codeCalendar(ctx context.Context, code string, cache map[string]*TradingCalendar) (*TradingCalendar, error) {
+	if tc, ok := cache[code]; ok {
+		return tc, nil
+	}
+	si, err := ss.stockOf(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return nil, err
+	}
+	cache[code] = tc
+	return tc, nil
+}
+
+func newRoundTripStats(investId int64, code string, trips []RoundTrip) RoundTripStats {
+	stats := RoundTripStats{InvestID: investId, StockCode: code, Quantity: decimal.Zero, Trips: trips}
+	if stats.Trips == nil {
+		stats.Trips = []RoundTrip{}
+	}
+	profit, taxFee := decimal.Zero, decimal.Zero
+	for _, trip := range trips {
+		stats.Count++
+		stats.Quantity = stats.Quantity.Add(trip.Quantity)
+		profit = profit.Add(decimal.NewFromFloat(trip.Profit))
+		taxFee = taxFee.Add(decimal.NewFromFloat(trip.TaxFee))
+	}
+	stats.Profit = profit.RoundBank(2).InexactFloat64()
+	stats.TaxFee = taxFee.RoundBank(2).InexactFloat64()
+	return stats
+}
+
+// 等待配对的交易
+type roundTripLeg struct {
+	tran      Transaction
+	day       time.Time
+	remaining decimal.Decimal
+}
+
+// matchRoundTrips 按成交时间将交易与窗口期内先成交、方向相反且尚未配对的交易按先进先出配对；
+// 只有保留底仓时的交易才能作为做T的第一笔：买入前已有持仓，或卖出后仍有持仓
+func matchRoundTrips(trans []Transaction, window int, tc *TradingCalendar) []RoundTrip {
+	sorted := append([]Transaction{}, trans...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].FinishAt.Equal(sorted[j].FinishAt) {
+			return sorted[i].FinishAt.Before(sorted[j].FinishAt)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	var trips []RoundTrip
+	var legs []*roundTripLeg
+	holding := decimal.Zero
+	for _, t := range sorted {
+		day, _ := time.Parse(DateLayout, dateOf(t.FinishTime))
+		remaining := t.Quantity
+		before := holding
+		holding = holding.Add(signedQuantity(t))
+
+		var kept []*roundTripLeg
+		for _, leg := range legs {
+			if tc.TradingDaysBetween(leg.day, day) > window {
+				// 超出窗口期的交易不再配对
+				continue
+			}
+			if leg.tran.Action != t.Action && remaining.IsPositive() {
+				quantity := decimal.Min(leg.remaining, remaining)
+				trips = append(trips, newRoundTrip(leg.tran, t, quantity, holding))
+				leg.remaining = leg.remaining.Sub(quantity)
+				remaining = remaining.Sub(quantity)
+			}
+			if leg.remaining.IsPositive() {
+				kept = append(kept, leg)
+			}
+		}
+		legs = kept
+
+		if remaining.IsPositive() && ((t.Action == 1 && before.IsPositive()) || (t.Action == -1 && holding.IsPositive())) {
+			legs = append(legs, &roundTripLeg{tran: t, day: day, remaining: remaining})
+		}
+	}
+	return trips
+}
+
+// newRoundTrip 计算配对数量的收益，税费按数量分摊，每股降低的成本按完成后的持仓计算
+func newRoundTrip(first Transaction, second Transaction, quantity decimal.Decimal, holding decimal.Decimal) RoundTrip {
+	trip := RoundTrip{
+		InvestID:    second.InvestID,
+		StockCode:   second.StockCode,
+		OpenTranID:  first.ID,
+		CloseTranID: second.ID,
+		OpenTime:    first.FinishTime,
+		CloseTime:   second.FinishTime,
+		Quantity:    quantity,
+		closeAt:     second.FinishAt,
+	}
+	sell, buy := first, second
+	trip.Kind = RoundTripSellBuy
+	if first.Action == 1 {
+		sell, buy = second, first
+		trip.Kind = RoundTripBuySell
+	}
+	trip.SellPrice, trip.BuyPrice = sell.Price, buy.Price
+
+	share := func(t Transaction) decimal.Decimal {
+		return decimal.NewFromFloat(t.TaxFee).Mul(quantity).Div(t.Quantity)
+	}
+	taxFee := share(sell).Add(share(buy))
+	profit := decimal.NewFromFloat(sell.Price).Sub(decimal.NewFromFloat(buy.Price)).Mul(quantity).Sub(taxFee)
+	trip.TaxFee = taxFee.RoundBank(2).InexactFloat64()
+	trip.Profit = profit.RoundBank(2).InexactFloat64()
+	if holding.IsPositive() {
+		trip.CostReduction = profit.Div(holding).Round(4).InexactFloat64()
+	}
+	return trip
+}
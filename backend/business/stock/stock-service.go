@@ -1,8 +1,12 @@
 package stock
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"pixiu/backend/pkg/exception"
 	"pixiu/backend/pkg/gormer"
+	"sort"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -19,43 +23,89 @@ func NewStockService(gtm gormer.GormTM, sr StockRepository) *StockService {
 	return &StockService{gtm, sr}
 }
 
-func (ss *StockService) GetClearList(stime string, ftime string) (*[]ClearStats, error) {
-	return ss.sr.GetClearList(ss.gtm.Context(), stime, ftime)
+// GetClearList 按股票统计清仓盈亏，默认按净盈亏统计，gross 为 true 时按毛盈亏统计；
+// 期间按股票所在市场的时区判断建仓时间
+func (ss *StockService) GetClearList(stime string, ftime string, gross bool) (*[]ClearStats, error) {
+	ctx := ss.gtm.Context()
+	mr, err := ss.newMarketRanges(stime, ftime)
+	if err != nil {
+		return nil, err
+	}
+	invests, err := ss.sr.GetClearInvest(ctx, "", mr.span())
+	if err != nil {
+		return nil, err
+	}
+	var codes []string
+	byCode := make(map[string]*ClearStats)
+	for i := range *invests {
+		invest := &(*invests)[i]
+		in, err := mr.contains(ctx, invest.StockCode, invest.OpenAt)
+		if err != nil {
+			return nil, err
+		}
+		if !in {
+			continue
+		}
+		stats, ok := byCode[invest.StockCode]
+		if !ok {
+			si, err := mr.stock(ctx, invest.StockCode)
+			if err != nil {
+				return nil, err
+			}
+			stats = &ClearStats{StockCode: si.Code, StockName: si.Name, Gross: gross, StartTime: stime, FinishTime: ftime}
+			byCode[invest.StockCode] = stats
+			codes = append(codes, invest.StockCode)
+		}
+		stats.add(invest)
+	}
+	sort.Strings(codes)
+	clears := make([]ClearStats, 0, len(codes))
+	for _, code := range codes {
+		byCode[code].round()
+		clears = append(clears, *byCode[code])
+	}
+	return &clears, nil
 }
 
-func (ss *StockService) GetStockClear(stockCode string, startTime string, finishTime string) (*ClearInvest, error) {
+func (ss *StockService) GetStockClear(stockCode string, startTime string, finishTime string, gross bool) (*ClearInvest, error) {
 	if stockCode == "" {
 		return nil, exception.NewBusiness(400, "stock code is required")
 	}
+	stockCode, err := ss.resolveCode(ss.gtm.Context(), stockCode)
+	if err != nil {
+		return nil, err
+	}
 	sinfo, err := ss.sr.GetStock(ss.gtm.Context(), stockCode)
 	if err != nil {
 		return nil, err
 	}
-	cinvests, err := ss.sr.GetClearInvest(ss.gtm.Context(), stockCode, startTime, finishTime)
+	r, err := parseTimeRange(startTime, finishTime, marketLocation(sinfo))
+	if err != nil {
+		return nil, err
+	}
+	cinvests, err := ss.sr.GetClearInvest(ss.gtm.Context(), stockCode, r)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := ss.stockCalendar(ss.gtm.Context(), sinfo)
 	if err != nil {
 		return nil, err
 	}
 
-	var totalCount int
-	var profitLoss float64
-	var totalAmount float64
+	stats := &ClearStats{StockCode: sinfo.Code, StockName: sinfo.Name, Gross: gross, StartTime: startTime, FinishTime: finishTime}
 	var invests []Investment
 	for _, ci := range *cinvests {
-		totalCount++
-		profitLoss += ci.ProfitLoss
-		totalAmount += ci.Amount
-		openTime, _ := time.Parse(DateTimeLayout, ci.OpenTime)
-		closeTime, _ := time.Parse(DateTimeLayout, ci.CloseTime)
-		ci.HoldingDays = daysBetweenDates(openTime, closeTime)
+		stats.add(&ci)
+		fillHoldingDays(&ci, tc)
 		invests = append(invests, ci)
 	}
-	roi := 0.00
-	if totalAmount != 0 {
-		roi = round2Decimal((profitLoss / totalAmount) * 100)
+	stats.round()
+	if err := ss.fillDividends(ss.gtm.Context(), invests); err != nil {
+		return nil, err
 	}
 	return &ClearInvest{
 		Stock:   sinfo,
-		Stats:   &ClearStats{TotalCount: totalCount, ProfitLoss: profitLoss, Roi: roi, StartTime: startTime, FinishTime: finishTime},
+		Stats:   stats,
 		Invests: &invests}, nil
 }
 
@@ -70,57 +120,131 @@ func (ss StockService) GetStockList() (*[]StockInfo, error) {
 	return ss.sr.AliveStocks(ss.gtm.Context())
 }
 
+// GetStock 查询股票信息，原编码已改名或被合并时返回新编码的股票
 func (ss StockService) GetStock(code string) (*StockInfo, error) {
 	if code == "" {
 		return nil, exception.NewBusiness(400, "code is required")
 	}
-	return ss.sr.GetStock(ss.gtm.Context(), code)
+	ctx := ss.gtm.Context()
+	code, err := ss.resolveCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return ss.sr.GetStock(ctx, code)
 }
 
-func (ss StockService) SaveStock(si *StockInfo) error {
-	if si.Code == "" {
-		return exception.NewBusiness(400, "code is required")
-	}
-	if si.Name == "" {
-		return exception.NewBusiness(400, "name is required")
-	}
-	if si.Currency == "" {
-		si.Currency = "人民币"
+func (ss StockService) SaveStock(operator string, si *StockInfo) error {
+	if err := validateStock(si); err != nil {
+		return err
 	}
 
 	si.Status = 0
 	si.CreatedAt = time.Now()
 	si.UpdatedAt = time.Now()
-	return ss.sr.SaveStock(ss.gtm.Context(), si)
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		if err := ss.sr.SaveStock(ctx, si); err != nil {
+			return err
+		}
+		return ss.audit(ctx, operator, EntityStock, si.Code, ActionCreate, nil, si)
+	})
+}
+
+func (ss StockService) UpdateStock(operator string, si *StockInfo) error {
+	if err := validateStock(si); err != nil {
+		return err
+	}
+
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		osi, err := ss.sr.GetStock(ctx, si.Code)
+		if err != nil {
+			return err
+		}
+		before := *osi
+
+		osi.UpdatedAt = time.Now()
+		osi.Currency = si.Currency
+		osi.Market = si.Market
+		osi.Name = si.Name
+		osi.Type = si.Type
+		osi.QuantityPrecision = si.QuantityPrecision
+		osi.LotSize = si.LotSize
+		osi.Status = 0
+
+		if err := ss.sr.UpdateStock(ctx, osi); err != nil {
+			return err
+		}
+		if err := ss.audit(ctx, operator, EntityStock, osi.Code, ActionUpdate, &before, osi); err != nil {
+			return err
+		}
+		if before.Type != osi.Type || before.Market != osi.Market {
+			return ss.rebuildStock(ctx, operator, osi.Code)
+		}
+		return nil
+	})
 }
 
-func (ss StockService) UpdateStock(si *StockInfo) error {
+// rebuildStock 品种或市场变化后按新的交易规则重建股票在所有组合的持仓
+func (ss StockService) rebuildStock(ctx context.Context, operator string, code string) error {
+	portfolios, err := ss.sr.GetStockPortfolios(ctx, code)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	for _, portfolioId := range portfolios {
+		if err := ss.rebuildHolding(ctx, operator, portfolioId, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStock 校验股票信息：股市须为已登记的市场（名称或市场代码，保存为名称），未填币种时取市场的默认币种
+func validateStock(si *StockInfo) error {
 	if si.Code == "" {
 		return exception.NewBusiness(400, "code is required")
 	}
 	if si.Name == "" {
 		return exception.NewBusiness(400, "name is required")
 	}
-
-	osi, err := ss.sr.GetStock(ss.gtm.Context(), si.Code)
-	if err != nil {
+	if si.Market == "" {
+		return exception.NewBusiness(400, "market is required")
+	}
+	rule := FindMarketRule(si.Market)
+	if rule == nil {
+		return exception.NewBusiness(400, "unknown market: "+si.Market)
+	}
+	si.Market = rule.Market
+	if si.Currency == "" {
+		si.Currency = rule.Currency
+	}
+	if si.Type == "" {
+		si.Type = InstrumentStock
+	}
+	if _, err := GetInstrumentSpec(si.Type); err != nil {
 		return err
 	}
-
-	osi.UpdatedAt = time.Now()
-	osi.Currency = si.Currency
-	osi.Market = si.Market
-	osi.Name = si.Name
-	osi.Status = 0
-
-	return ss.sr.UpdateStock(ss.gtm.Context(), osi)
+	if si.LotSize < 0 {
+		return exception.NewBusiness(400, "lot size can not be negative")
+	}
+	return nil
 }
 
-func (ss StockService) DeleteStock(code string) error {
+func (ss StockService) DeleteStock(operator string, code string) error {
 	if code == "" {
 		return exception.NewBusiness(400, "code is required")
 	}
-	return ss.sr.DeleteStock(ss.gtm.Context(), code)
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		osi, err := ss.sr.GetStock(ctx, code)
+		if err != nil {
+			return err
+		}
+		before := *osi
+
+		if err := ss.sr.DeleteStock(ctx, code); err != nil {
+			return err
+		}
+		osi.Status = -1
+		return ss.audit(ctx, operator, EntityStock, code, ActionDelete, &before, osi)
+	})
 }
 
 func (ss StockService) GetHolding(code string) (*Investment, error) {
@@ -128,67 +252,173 @@ func (ss StockService) GetHolding(code string) (*Investment, error) {
 		return nil, exception.NewBusiness(400, "code is required")
 	}
 
-	invest, err := ss.sr.GetHolding(ss.gtm.Context(), code)
+	ctx := ss.gtm.Context()
+	code, err := ss.resolveCode(ctx, code)
 	if err != nil {
 		return nil, err
 	}
-
-	openTime, _ := time.Parse(DateTimeLayout, invest.OpenTime)
-	var closeTime time.Time
-	if invest.CloseTime == "" {
-		closeTime = time.Now()
-	} else {
-		closeTime, _ = time.Parse(DateTimeLayout, invest.CloseTime)
+	invest, err := ss.sr.GetHolding(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	si, err := ss.stockOf(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return nil, err
+	}
+	fillHoldingDays(invest, tc)
+	holding := []Investment{*invest}
+	if err := ss.fillDividends(ctx, holding); err != nil {
+		return nil, err
 	}
-	invest.HoldingDays = int(closeTime.Sub(openTime).Hours() / 24)
 
-	return invest, nil
+	return &holding[0], nil
 }
 
-func (ss StockService) DeleteTransaction(tranId int64) error {
-	tran, err := ss.sr.GetTransaction(ss.gtm.Context(), tranId)
+func (ss StockService) DeleteTransaction(operator string, tranId int64) error {
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		return ss.deleteTransaction(ctx, operator, tranId)
+	})
+}
+
+func (ss StockService) deleteTransaction(ctx context.Context, operator string, tranId int64) error {
+	tran, err := ss.sr.GetTransaction(ctx, tranId)
 	if err != nil {
-		return exception.WrapService(500, "dao error", err)
+		return err
 	}
-	err = ss.sr.DeleteTransaction(ss.gtm.Context(), tranId)
+	if tran.Status == -1 {
+		return exception.NewBusiness(400, "transaction is already deleted")
+	}
+	before := *tran
+
+	err = ss.sr.DeleteTransaction(ctx, tranId)
 	if err != nil {
 		return exception.WrapService(500, "dao error", err)
 	}
-	return ss.computeHolding(tran.InvestID)
+	tran.Status = -1
+	if err := ss.audit(ctx, operator, EntityTransaction, idKey(tran.ID), ActionDelete, &before, tran); err != nil {
+		return err
+	}
+	return ss.rebuildHolding(ctx, operator, tran.PortfolioID, tran.StockCode)
 }
 
-func (ss StockService) UpdateTransaction(tran *Transaction) error {
+func (ss StockService) UpdateTransaction(operator string, tran *Transaction) error {
 	if tran.ID == 0 {
 		return exception.NewService(400, "transaction id is required")
 	}
-	otran, err := ss.sr.GetTransaction(ss.gtm.Context(), tran.ID)
+	if err := validateTransaction(tran, false); err != nil {
+		return err
+	}
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		return ss.updateTransaction(ctx, operator, tran)
+	})
+}
+
+func (ss StockService) updateTransaction(ctx context.Context, operator string, tran *Transaction) error {
+	otran, err := ss.sr.GetTransaction(ctx, tran.ID)
 	if err != nil {
-		return exception.WrapService(500, "dao error", err)
+		return err
 	}
-	if otran == nil {
+	if otran.Status == -1 {
 		return exception.NewBusiness(404, "transaction not found")
 	}
+	si, err := ss.stockOf(ctx, otran.StockCode)
+	if err != nil {
+		return err
+	}
+	spec, err := stockSpec(si)
+	if err != nil {
+		return err
+	}
+	// 换股折算的交易不修改价格和数量时保留原成交金额，折算的价格和数量不按新股票的精度、价位和每手数量校验
+	tran.Converted = otran.Converted && tran.Price == otran.Price && tran.Quantity.Equal(otran.Quantity)
+	if !tran.Converted {
+		if err := spec.Validate(tran); err != nil {
+			return err
+		}
+	}
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return err
+	}
+	if err := stampTransaction(tran, tc.Location()); err != nil {
+		return err
+	}
+	// 回测交易修改价格或成交日期后按实盘交易校验；成交日期不变时不重新校验交易日，日历更新后仍可修改历史交易
+	sameDate := dateOf(tran.FinishTime) == dateOf(otran.FinishTime)
+	tran.Backtest = otran.Backtest && tran.Price == otran.Price && sameDate
+	if !sameDate {
+		if err := checkTradeDate(si, tc, tran); err != nil {
+			return err
+		}
+	}
+	if err := ss.validateMarket(ctx, si, spec, tran); err != nil {
+		return err
+	}
+	before := *otran
 
 	otran.Action = tran.Action
 	otran.Price = tran.Price
 	otran.Quantity = tran.Quantity
 	otran.TaxFee = tran.TaxFee
-	otran.Amount = floatMulInt(tran.Price, tran.Quantity)
+	if !tran.Converted {
+		otran.Amount = floatMulDecimal(tran.Price, tran.Quantity)
+	}
+	otran.Converted = tran.Converted
+	otran.Backtest = tran.Backtest
 	otran.FinishTime = tran.FinishTime
+	otran.FinishAt = tran.FinishAt
+	otran.SettleDate = spec.settleDate(tran.FinishTime, tc)
 	otran.UpdatedAt = time.Now()
-	err = ss.sr.UpdateTransaction(ss.gtm.Context(), otran)
+	err = ss.sr.UpdateTransaction(ctx, otran)
 	if err != nil {
 		return exception.WrapService(500, "dao error", err)
 	}
+	if err := ss.audit(ctx, operator, EntityTransaction, idKey(otran.ID), ActionUpdate, &before, otran); err != nil {
+		return err
+	}
 
-	return ss.computeHolding(otran.InvestID)
+	if err := ss.rebuildHolding(ctx, operator, otran.PortfolioID, otran.StockCode); err != nil {
+		return err
+	}
+	return ss.checkCash(ctx, otran.PortfolioID)
 }
 
-func floatMulInt(p float64, q int) float64 {
+func floatMulDecimal(p float64, q decimal.Decimal) float64 {
 	pd := decimal.NewFromFloat(p)
-	qd := decimal.NewFromInt(int64(q))
 	// 转换为 float64 存储到结构体字段
-	return pd.Mul(qd).RoundBank(2).InexactFloat64()
+	return pd.Mul(q).RoundBank(2).InexactFloat64()
+}
+
+// add 累计清仓投资的盈亏、税费、投资金额和盈亏次数
+func (cs *ClearStats) add(invest *Investment) {
+	profit := invest.ProfitLoss
+	if cs.Gross {
+		profit = invest.GrossProfit
+	}
+	cs.TotalCount++
+	if profit >= 0 {
+		cs.ProfitCount++
+	} else {
+		cs.LossCount++
+	}
+	cs.ProfitLoss += profit
+	cs.TotalTaxFee += invest.TotalTaxFee
+	cs.Amount += invest.Amount
+}
+
+// round 累计完成后保留两位小数并计算收益率
+func (cs *ClearStats) round() {
+	cs.ProfitLoss = round2Decimal(cs.ProfitLoss)
+	cs.TotalTaxFee = round2Decimal(cs.TotalTaxFee)
+	cs.Amount = round2Decimal(cs.Amount)
+	cs.Roi = 0
+	if cs.Amount != 0 {
+		cs.Roi = round2Decimal(cs.ProfitLoss / cs.Amount * 100)
+	}
 }
 
 func round2Decimal(value float64) float64 {
@@ -196,108 +426,406 @@ func round2Decimal(value float64) float64 {
 	return d.RoundBank(2).InexactFloat64()
 }
 
-func (ss StockService) AddTransaction(tran *Transaction) error {
+// AddTransaction 新增交易，买入数量为 0 且填写了金额时按金额买入，以成交价格（净值）计算份额
+func (ss StockService) AddTransaction(operator string, tran *Transaction) error {
+	tran.Backtest = false
+	return ss.gtm.Execute(func(ctx context.Context) error {
+		return ss.addTransaction(ctx, operator, tran)
+	})
+}
+
+func (ss StockService) addTransaction(ctx context.Context, operator string, tran *Transaction) error {
+	if err := ss.insertTransaction(ctx, operator, tran); err != nil {
+		return err
+	}
+
+	// 根据股票的交易记录重建持仓信息
+	if err := ss.rebuildHolding(ctx, operator, tran.PortfolioID, tran.StockCode); err != nil {
+		return err
+	}
+	if err := ss.checkCash(ctx, tran.PortfolioID); err != nil {
+		return err
+	}
+	created, err := ss.sr.GetTransaction(ctx, tran.ID)
+	if err != nil {
+		return err
+	}
+	tran.InvestID = created.InvestID
+	return nil
+}
+
+// insertTransaction 校验并保存交易，不重建持仓
+func (ss StockService) insertTransaction(ctx context.Context, operator string, tran *Transaction) error {
 	if tran.StockCode == "" {
 		return exception.NewBusiness(400, "stock code is empty")
 	}
-	if tran.Action == 0 {
-		return exception.NewBusiness(400, "action is empty")
+	byAmount := tran.Action == 1 && tran.Quantity.IsZero() && tran.Amount > 0
+	if err := validateTransaction(tran, byAmount); err != nil {
+		return err
 	}
 
-	nowTime := time.Now()
-
-	invest, err := ss.sr.GetHolding(ss.gtm.Context(), tran.StockCode)
-	if err != nil {
-		// no holding investment
-		if tran.Action == -1 {
-			return exception.NewBusiness(400, "action is sell but holding is closed")
+	if tran.PortfolioID != 0 {
+		if _, err := ss.sr.GetPortfolio(ctx, tran.PortfolioID); err != nil {
+			if isNotFound(err) {
+				return exception.WrapBusiness(404, "portfolio not found", err)
+			}
+			return err
 		}
-		// add holding investment for opening
-		invest = &Investment{StockCode: tran.StockCode, Status: 0,
-			CreatedAt: nowTime, UpdatedAt: nowTime, OpenTime: nowTime.Format(DateTimeLayout)}
-		err := ss.sr.CreateInvestment(ss.gtm.Context(), invest)
-		if err != nil {
-			return exception.WrapService(500, "create holding error", err)
+	}
+	si, err := ss.sr.GetStock(ctx, tran.StockCode)
+	if err != nil {
+		if isNotFound(err) {
+			return exception.WrapBusiness(404, "stock not found", err)
 		}
-	} else {
-		if tran.Action == -1 && invest.Quantity < tran.Quantity {
-			return exception.NewBusiness(400, "holding quantity is less than sell quantity")
+		return err
+	}
+	spec, err := stockSpec(si)
+	if err != nil {
+		return err
+	}
+	if byAmount {
+		tran.Quantity, tran.TaxFee = spec.UnitsByAmount(tran.Amount, tran.Price, tran.TaxFee)
+		if !tran.Quantity.IsPositive() {
+			return exception.NewBusiness(400, "amount is not enough to buy any quantity")
 		}
 	}
+	if err := spec.Validate(tran); err != nil {
+		return err
+	}
+
+	nowTime := time.Now()
 
-	tran.InvestID = invest.ID
+	// 投资由重建持仓时按成交时间分配
+	tran.InvestID = 0
+	tran.Converted = false
 	tran.CreatedAt = nowTime
 	tran.UpdatedAt = nowTime
-	tran.Amount = floatMulInt(tran.Price, tran.Quantity)
+	tc, err := ss.stockCalendar(ctx, si)
+	if err != nil {
+		return err
+	}
+	if tran.FinishTime == "" {
+		// 成交时间为市场时区的时间
+		tran.FinishTime = tc.Now().Format(DateTimeLayout)
+	}
+	if err := stampTransaction(tran, tc.Location()); err != nil {
+		return err
+	}
+	if err := checkTradeDate(si, tc, tran); err != nil {
+		return err
+	}
+	if err := ss.validateMarket(ctx, si, spec, tran); err != nil {
+		return err
+	}
+	tran.SettleDate = spec.settleDate(tran.FinishTime, tc)
+	tran.Amount = floatMulDecimal(tran.Price, tran.Quantity)
 	if tran.TaxFee == 0 {
-		tran.TaxFee = round2Decimal(tran.Amount * 0.00137)
+		tran.TaxFee = spec.Fee.EstimateFee(tran.Action, tran.Amount)
 	}
 
-	err = ss.sr.CreateTransaction(ss.gtm.Context(), tran)
+	err = ss.sr.CreateTransaction(ctx, tran)
 	if err != nil {
 		return err
 	}
+	return ss.audit(ctx, operator, EntityTransaction, idKey(tran.ID), ActionCreate, nil, tran)
+}
 
-	// 根据持仓的交易记录计算持仓信息
-	return ss.computeHolding(tran.InvestID)
+// instrumentSpec 返回股票品种的交易规则，股票信息不存在时按股票处理
+func (ss StockService) instrumentSpec(ctx context.Context, code string) (*InstrumentSpec, error) {
+	si, err := ss.stockOf(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return stockSpec(si)
 }
 
-func (ss StockService) computeHolding(investId int64) error {
-	invest, err := ss.sr.GetInvestment(ss.gtm.Context(), investId)
+// stockOf 返回股票信息，股票信息不存在时返回只有编码的股票
+func (ss StockService) stockOf(ctx context.Context, code string) (*StockInfo, error) {
+	si, err := ss.sr.GetStock(ctx, code)
+	if err != nil {
+		if isNotFound(err) {
+			return &StockInfo{Code: code, Type: InstrumentStock}, nil
+		}
+		return nil, err
+	}
+	return si, nil
+}
+
+// checkTradeDate 按股票所在市场的交易日历校验成交日期，未登记市场的股票和回测交易（成交日期以行情为准）不校验
+func checkTradeDate(si *StockInfo, tc *TradingCalendar, tran *Transaction) error {
+	if GetMarketRule(si.Market) == nil || tran.Backtest {
+		return nil
+	}
+	return tc.CheckDate(tran.FinishTime)
+}
+
+// validateMarket 按品种和股票所在市场的交易规则校验交易，
+// 持仓按该笔交易成交之前的交易累计，只校验该笔交易，不重新校验历史交易
+func (ss StockService) validateMarket(ctx context.Context, si *StockInfo, spec *InstrumentSpec, tran *Transaction) error {
+	rule := GetMarketRule(si.Market)
+	trans, err := ss.sr.GetStockTransactions(ctx, tran.PortfolioID, si.Code)
 	if err != nil {
 		return exception.WrapService(500, "dao error", err)
 	}
+	holding, dayBought := decimal.Zero, decimal.Zero
+	day := dateOf(tran.FinishTime)
+	for _, t := range *trans {
+		if t.ID == tran.ID {
+			continue
+		}
+		if t.FinishAt.After(tran.FinishAt) || (t.FinishAt.Equal(tran.FinishAt) && tran.ID != 0 && t.ID > tran.ID) {
+			break
+		}
+		holding = holding.Add(signedQuantity(t))
+		if t.Action == 1 && dateOf(t.FinishTime) == day {
+			dayBought = dayBought.Add(t.Quantity)
+		}
+	}
+	if err := spec.CheckSellable(tran, holding, dayBought); err != nil {
+		return err
+	}
+	if rule == nil || tran.Converted {
+		return nil
+	}
+	return rule.Validate(si, spec, tran, holding)
+}
 
-	trans, err := ss.sr.GetTransactions(ss.gtm.Context(), investId)
+func isNotFound(err error) bool {
+	var appErr exception.AppError
+	return errors.As(err, &appErr) && appErr.Code() == 404
+}
+
+// isBusiness 判断是否为业务错误（如校验失败），其他错误为服务错误
+func isBusiness(err error) bool {
+	var appErr exception.AppError
+	return errors.As(err, &appErr) && appErr.Type() == exception.ErrorTypeBusiness
+}
+
+// validateTransaction 校验交易的基本字段，按金额买入时数量由净值计算，不校验数量
+func validateTransaction(tran *Transaction, byAmount bool) error {
+	if tran.Action == 0 {
+		return exception.NewBusiness(400, "action is empty")
+	}
+	if tran.Action != 1 && tran.Action != -1 {
+		return exception.NewBusiness(400, "action must be buy(1) or sell(-1)")
+	}
+	if !byAmount && !tran.Quantity.IsPositive() {
+		return exception.NewBusiness(400, "quantity must be positive")
+	}
+	if tran.Price <= 0 {
+		return exception.NewBusiness(400, "price must be positive")
+	}
+	return nil
+}
+
+// rebuildHolding 按成交时间重建投资组合中股票的所有投资：持仓数量每次归零即结束一笔投资，
+// 之后的买入开始新的投资。新增、修改、删除或恢复任何交易后都需要重建。
+// 投资的变更记录为派生的审计日志，不能单独撤销，撤销引起重建的交易修改即可还原
+func (ss StockService) rebuildHolding(ctx context.Context, operator string, portfolioId int64, stockCode string) error {
+	trans, err := ss.sr.GetStockTransactions(ctx, portfolioId, stockCode)
 	if err != nil {
 		return exception.WrapService(500, "dao error", err)
 	}
+	invests, err := ss.sr.GetStockInvestments(ctx, portfolioId, stockCode)
+	if err != nil {
+		return exception.WrapService(500, "dao error", err)
+	}
+	positions, err := splitPositions(*trans)
+	if err != nil {
+		return err
+	}
+	spec, err := ss.instrumentSpec(ctx, stockCode)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[int64]*Investment)
+	for i := range *invests {
+		existing[(*invests)[i].ID] = &(*invests)[i]
+	}
+
+	nowTime := time.Now()
+	for _, position := range positions {
+		invest := matchInvestment(position, existing)
+		if invest == nil {
+			invest = &Investment{PortfolioID: portfolioId, StockCode: stockCode, CreatedAt: nowTime}
+			calcHolding(invest, position, spec)
+			invest.UpdatedAt = nowTime
+			if err := ss.sr.CreateInvestment(ctx, invest); err != nil {
+				return exception.WrapService(500, "create holding error", err)
+			}
+			if err := ss.auditDerived(ctx, operator, invest.ID, ActionCreate, nil, invest); err != nil {
+				return err
+			}
+		} else {
+			delete(existing, invest.ID)
+			before := *invest
+			calcHolding(invest, position, spec)
+			if len(diffInvestment(&before, invest)) > 0 {
+				invest.UpdatedAt = nowTime
+				if err := ss.sr.UpdateInvestment(ctx, invest); err != nil {
+					return exception.WrapService(500, "update invest error", err)
+				}
+				if err := ss.auditDerived(ctx, operator, invest.ID, ActionUpdate, &before, invest); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, t := range position {
+			if t.InvestID == invest.ID {
+				continue
+			}
+			if err := ss.sr.UpdateTransactionInvest(ctx, t.ID, invest.ID); err != nil {
+				return exception.WrapService(500, "dao error", err)
+			}
+		}
+	}
+
+	// 没有交易的投资永久删除，不进入回收站：恢复它的交易时重建持仓会重新建立投资
+	for _, invest := range *invests {
+		if _, ok := existing[invest.ID]; ok {
+			if err := ss.sr.RemoveInvestment(ctx, invest.ID); err != nil {
+				return exception.WrapService(500, "dao error", err)
+			}
+			if err := ss.auditDerived(ctx, operator, invest.ID, ActionPurge, &invest, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitPositions 按成交时间累计持仓数量，数量归零时拆分为独立的投资，卖出数量不能超过当时的持仓
+func splitPositions(trans []Transaction) ([][]Transaction, error) {
+	var positions [][]Transaction
+	var position []Transaction
+	running := decimal.Zero
+	for _, t := range trans {
+		running = running.Add(signedQuantity(t))
+		if running.IsNegative() {
+			return nil, exception.NewBusiness(400, fmt.Sprintf("sell quantity exceeds holding at %s", t.FinishTime))
+		}
+		position = append(position, t)
+		if running.IsZero() {
+			positions = append(positions, position)
+			position = nil
+		}
+	}
+	if len(position) > 0 {
+		positions = append(positions, position)
+	}
+	return positions, nil
+}
 
-	inQuantity := 0
-	ouQuantity := 0
+// matchInvestment 选择持有该投资最多交易记录的已有投资，保持投资标识稳定
+func matchInvestment(position []Transaction, existing map[int64]*Investment) *Investment {
+	counts := make(map[int64]int)
+	var best *Investment
+	for _, t := range position {
+		invest, ok := existing[t.InvestID]
+		if !ok {
+			continue
+		}
+		counts[t.InvestID]++
+		if best == nil || counts[t.InvestID] > counts[best.ID] {
+			best = invest
+		}
+	}
+	return best
+}
+
+// calcHolding 根据按成交时间排序的交易记录计算持仓信息
+func calcHolding(invest *Investment, trans []Transaction, spec *InstrumentSpec) {
+	if len(trans) == 0 {
+		return
+	}
+	inQuantity := decimal.Zero
+	ouQuantity := decimal.Zero
 
 	inAmount := decimal.NewFromFloat(0)
 	ouAmount := decimal.NewFromFloat(0)
 	totalTaxFee := decimal.NewFromFloat(0)
-
-	for _, t := range *trans {
+	inTaxFee := decimal.Zero
+	ouTaxFee := decimal.Zero
+	// 持仓成本按移动平均计算：买入增加金额和税费，卖出按平均成本转出
+	holding := decimal.Zero
+	basis := decimal.Zero
+
+	for _, t := range trans {
+		amount := decimal.NewFromFloat(t.Price).Mul(t.Quantity)
+		if t.Converted {
+			// 折算价格有舍入，按原成交金额计算
+			amount = decimal.NewFromFloat(t.Amount)
+		}
+		fee := decimal.NewFromFloat(t.TaxFee)
 		switch t.Action {
 		case 1:
-			inQuantity += t.Quantity
-			inAmount = inAmount.Add(decimal.NewFromFloat(t.Price).Mul(decimal.NewFromInt(int64(t.Quantity))))
+			inQuantity = inQuantity.Add(t.Quantity)
+			inAmount = inAmount.Add(amount)
+			inTaxFee = inTaxFee.Add(fee)
+			basis = basis.Add(amount).Add(fee)
+			holding = holding.Add(t.Quantity)
 		case -1:
-			ouQuantity += t.Quantity
-			ouAmount = ouAmount.Add(decimal.NewFromFloat(t.Price).Mul(decimal.NewFromInt(int64(t.Quantity))))
+			ouQuantity = ouQuantity.Add(t.Quantity)
+			ouAmount = ouAmount.Add(amount)
+			ouTaxFee = ouTaxFee.Add(fee)
+			if holding.IsPositive() {
+				basis = basis.Sub(basis.Mul(t.Quantity).Div(holding))
+			}
+			holding = holding.Sub(t.Quantity)
 		}
-		totalTaxFee = totalTaxFee.Add(decimal.NewFromFloat(t.TaxFee))
+		totalTaxFee = totalTaxFee.Add(fee)
 	}
 
 	invest.TotalTaxFee = totalTaxFee.InexactFloat64()
-	invest.CostPrice = inAmount.Div(decimal.NewFromInt(int64(inQuantity))).RoundBank(3).InexactFloat64()
+	invest.CostPrice = 0
+	if inQuantity.IsPositive() {
+		invest.CostPrice = inAmount.Div(inQuantity).RoundBank(int32(spec.PricePrecision + 1)).InexactFloat64()
+	}
 
-	invest.Quantity = inQuantity - ouQuantity
+	invest.Quantity = inQuantity.Sub(ouQuantity)
 	invest.Amount = inAmount.RoundBank(2).InexactFloat64()
-	invest.ProfitLoss = ouAmount.Sub(inAmount).Add(decimal.NewFromFloat(invest.Amount)).InexactFloat64()
+	// 已实现的毛盈亏：卖出金额减去卖出数量按平均买入价计算的成本，清仓时即卖出金额减买入金额；
+	// 净盈亏再减去卖出的税费和卖出数量按比例分摊的买入税费，持有部分的买入税费计入持仓成本
+	gross, net := decimal.Zero, decimal.Zero
+	if inQuantity.IsPositive() {
+		gross = ouAmount.Sub(inAmount.Mul(ouQuantity).Div(inQuantity))
+		net = gross.Sub(ouTaxFee).Sub(inTaxFee.Mul(ouQuantity).Div(inQuantity))
+	}
+	invest.GrossProfit = gross.RoundBank(2).InexactFloat64()
+	invest.ProfitLoss = net.RoundBank(2).InexactFloat64()
+
+	// 清仓后没有持仓成本、摊薄成本和保本价
+	invest.HoldingCost, invest.DilutedCost, invest.BreakEven = 0, 0, 0
+	if invest.Quantity.IsPositive() {
+		precision := int32(spec.PricePrecision + 1)
+		invest.HoldingCost = basis.Div(invest.Quantity).RoundBank(precision).InexactFloat64()
+		// 尚未收回的净投入，摊薄成本可能为负（已收回全部投入且有盈利）
+		outlay := inAmount.Add(totalTaxFee).Sub(ouAmount)
+		invest.DilutedCost = outlay.Div(invest.Quantity).RoundBank(precision).InexactFloat64()
+		if outlay.IsPositive() {
+			invest.BreakEven = spec.Fee.SellAmountFor(outlay).Div(invest.Quantity).RoundCeil(int32(spec.PricePrecision)).InexactFloat64()
+		}
+	}
 
 	// 第一个元素
-	firstElement := (*trans)[0]
+	firstElement := trans[0]
 	invest.OpenTime = firstElement.FinishTime
-	if invest.Quantity == 0 {
+	invest.OpenAt = firstElement.FinishAt
+	if invest.Quantity.IsZero() {
 		// 清仓
 		invest.Status = 1
 		// 最后一个元素
-		lastElement := (*trans)[len(*trans)-1]
+		lastElement := trans[len(trans)-1]
 		invest.CloseTime = lastElement.FinishTime
+		closeAt := lastElement.FinishAt
+		invest.CloseAt = &closeAt
+	} else {
+		invest.Status = 0
+		invest.CloseTime = ""
+		invest.CloseAt = nil
 	}
-
-	invest.UpdatedAt = time.Now()
-
-	err = ss.sr.UpdateInvestment(ss.gtm.Context(), invest)
-	if err != nil {
-		return exception.WrapService(500, "update invest error", err)
-	}
-
-	return nil
 }
 
 func (ss StockService) GetTransactions(investId int64) (*[]Transaction, error) {
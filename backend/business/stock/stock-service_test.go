@@ -0,0 +1,276 @@
+package stock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 重建持仓的一步操作：新增买入（1）或卖出（-1）交易，action 为 0 时删除第 del 笔新增的交易（从 1 开始）
+type rebuildStep struct {
+	action   int8
+	quantity string
+	price    float64
+	time     string
+	del      int
+}
+
+// 重建后期望的投资（按建仓时间排列）
+type wantInvest struct {
+	status    int
+	quantity  string
+	costPrice float64
+	openTime  string
+	closeTime string
+	trans     int
+}
+
+func TestRebuildHolding(t *testing.T) {
+	cases := []struct {
+		name    string
+		steps   []rebuildStep
+		wantErr string // 最后一步的错误
+		invests []wantInvest
+	}{
+		{
+			name: "out of order insert",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: 1, quantity: "100", price: 12, time: "2025-06-05 10:00:00"},
+				{action: 1, quantity: "100", price: 11, time: "2025-06-04 10:00:00"},
+			},
+			invests: []wantInvest{
+				{status: 0, quantity: "300", costPrice: 11, openTime: "2025-06-03 10:00:00", trans: 3},
+			},
+		},
+		{
+			name: "out of order sell before the first buy",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: -1, quantity: "100", price: 11, time: "2025-06-02 10:00:00"},
+			},
+			wantErr: "sell quantity exceeds holding at 2025-06-02 10:00:00",
+			invests: []wantInvest{
+				{status: 0, quantity: "100", costPrice: 10, openTime: "2025-06-03 10:00:00", trans: 1},
+			},
+		},
+		{
+			name: "sell out and rebuy",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: -1, quantity: "100", price: 11, time: "2025-06-05 10:00:00"},
+				{action: 1, quantity: "200", price: 9, time: "2025-06-09 10:00:00"},
+			},
+			invests: []wantInvest{
+				{status: 1, quantity: "0", costPrice: 10, openTime: "2025-06-03 10:00:00", closeTime: "2025-06-05 10:00:00", trans: 2},
+				{status: 0, quantity: "200", costPrice: 9, openTime: "2025-06-09 10:00:00", trans: 1},
+			},
+		},
+		{
+			name: "rebuy inserted before the sell out",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: -1, quantity: "100", price: 11, time: "2025-06-05 10:00:00"},
+				{action: 1, quantity: "200", price: 9, time: "2025-06-09 10:00:00"},
+				{action: 1, quantity: "100", price: 12, time: "2025-06-04 10:00:00"},
+			},
+			invests: []wantInvest{
+				{status: 0, quantity: "300", costPrice: 10, openTime: "2025-06-03 10:00:00", trans: 4},
+			},
+		},
+		{
+			name: "delete a trade in the middle",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: -1, quantity: "100", price: 11, time: "2025-06-05 10:00:00"},
+				{action: 1, quantity: "200", price: 13, time: "2025-06-09 10:00:00"},
+				{del: 2},
+			},
+			invests: []wantInvest{
+				{status: 0, quantity: "300", costPrice: 12, openTime: "2025-06-03 10:00:00", trans: 2},
+			},
+		},
+		{
+			name: "delete a buy that a later sell depends on",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: 1, quantity: "100", price: 12, time: "2025-06-04 10:00:00"},
+				{action: -1, quantity: "150", price: 11, time: "2025-06-05 10:00:00"},
+				{del: 2},
+			},
+			wantErr: "sell quantity exceeds holding at 2025-06-05 10:00:00",
+			invests: []wantInvest{
+				{status: 0, quantity: "50", costPrice: 11, openTime: "2025-06-03 10:00:00", trans: 3},
+			},
+		},
+		{
+			name: "sell more than the holding",
+			steps: []rebuildStep{
+				{action: 1, quantity: "100", price: 10, time: "2025-06-03 10:00:00"},
+				{action: -1, quantity: "200", price: 11, time: "2025-06-05 10:00:00"},
+			},
+			wantErr: "sell quantity exceeds holding at 2025-06-05 10:00:00",
+			invests: []wantInvest{
+				{status: 0, quantity: "100", costPrice: 10, openTime: "2025-06-03 10:00:00", trans: 1},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ss, repo := newTestService(t, "600000")
+			var added []int64
+			for i, step := range c.steps {
+				var err error
+				if step.action == 0 {
+					err = ss.DeleteTransaction("test", added[step.del-1])
+				} else {
+					tran := &Transaction{StockCode: "600000", Action: step.action, Price: step.price, Quantity: qty(step.quantity), FinishTime: step.time}
+					if err = ss.AddTransaction("test", tran); err == nil {
+						added = append(added, tran.ID)
+					}
+				}
+				if i < len(c.steps)-1 || c.wantErr == "" {
+					if err != nil {
+						t.Fatalf("step %d: %v", i+1, err)
+					}
+				} else if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("step %d: got error %v, want %q", i+1, err, c.wantErr)
+				}
+			}
+
+			invests := openInvestments(t, repo, "600000")
+			if len(invests) != len(c.invests) {
+				t.Fatalf("got %d investments, want %d", len(invests), len(c.invests))
+			}
+			for i, want := range c.invests {
+				got := invests[i]
+				if got.Status != want.status || !got.Quantity.Equal(qty(want.quantity)) || got.CostPrice != want.costPrice ||
+					got.OpenTime != want.openTime || got.CloseTime != want.closeTime {
+					t.Errorf("investment %d: got status %d quantity %s cost %v open %q close %q, want %+v",
+						i+1, got.Status, got.Quantity, got.CostPrice, got.OpenTime, got.CloseTime, want)
+				}
+				count := 0
+				for _, tran := range repo.trans {
+					if tran.InvestID == got.ID && tran.Status == 0 {
+						count++
+					}
+				}
+				if count != want.trans {
+					t.Errorf("investment %d: got %d transactions, want %d", i+1, count, want.trans)
+				}
+			}
+			for _, tran := range repo.trans {
+				if invest, ok := repo.invests[tran.InvestID]; tran.Status == 0 && (!ok || invest.Status == -1) {
+					t.Errorf("transaction %d belongs to missing or deleted investment %d", tran.ID, tran.InvestID)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitPositions(t *testing.T) {
+	trans := []Transaction{
+		{ID: 1, Action: 1, Quantity: qty("100"), FinishTime: "2025-06-03 10:00:00"},
+		{ID: 2, Action: -1, Quantity: qty("40"), FinishTime: "2025-06-04 10:00:00"},
+		{ID: 3, Action: -1, Quantity: qty("60"), FinishTime: "2025-06-05 10:00:00"},
+		{ID: 4, Action: 1, Quantity: qty("0.5"), FinishTime: "2025-06-06 10:00:00"},
+	}
+	positions, err := splitPositions(trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 2 || len(positions[0]) != 3 || len(positions[1]) != 1 || positions[1][0].ID != 4 {
+		t.Fatalf("got positions %v", positions)
+	}
+
+	trans[2].Quantity = qty("60.01")
+	if _, err := splitPositions(trans); err == nil || !strings.Contains(err.Error(), "2025-06-05 10:00:00") {
+		t.Fatalf("got error %v, want oversell at 2025-06-05", err)
+	}
+}
+
+func TestGetClearList(t *testing.T) {
+	ss, repo := newTestService(t)
+	repo.stocks["600000"] = StockInfo{Code: "600000", Name: "浦发银行", Market: MarketA, Type: InstrumentStock}
+	repo.stocks["AAPL"] = StockInfo{Code: "AAPL", Name: "Apple", Market: MarketUS, Type: InstrumentStock}
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	newYork, _ := time.LoadLocation("America/New_York")
+	opens := []struct {
+		code   string
+		openAt time.Time
+		profit float64
+	}{
+		{"600000", time.Date(2025, 6, 30, 10, 0, 0, 0, shanghai), 100},
+		// 上海时间 7 月 1 日，UTC 为 6 月 30 日
+		{"600000", time.Date(2025, 7, 1, 7, 30, 0, 0, shanghai), 200},
+		// 纽约时间 6 月 30 日晚，UTC 和上海时间已是 7 月 1 日
+		{"AAPL", time.Date(2025, 6, 30, 22, 0, 0, 0, newYork), -50},
+		{"AAPL", time.Date(2025, 7, 1, 10, 0, 0, 0, newYork), 80},
+	}
+	for _, o := range opens {
+		invest := &Investment{StockCode: o.code, Status: 1, ProfitLoss: o.profit, Amount: 1000, OpenAt: o.openAt.UTC()}
+		if err := repo.CreateInvestment(context.Background(), invest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clears, err := ss.GetClearList("2025-06-01", "2025-06-30", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"600000": 100, "AAPL": -50}
+	if len(*clears) != len(want) {
+		t.Fatalf("got %+v, want %v", *clears, want)
+	}
+	for _, c := range *clears {
+		if c.TotalCount != 1 || c.ProfitLoss != want[c.StockCode] {
+			t.Errorf("%s: got count %d profit %v, want 1 and %v", c.StockCode, c.TotalCount, c.ProfitLoss, want[c.StockCode])
+		}
+	}
+}
+
+func TestCalcHoldingProfit(t *testing.T) {
+	cases := []struct {
+		name  string
+		trans []Transaction
+		gross float64
+		net   float64
+	}{
+		{
+			name: "open position shares the buy fee by the sold quantity",
+			trans: []Transaction{
+				{Action: 1, Price: 10, Quantity: qty("1000"), TaxFee: 5},
+				{Action: -1, Price: 11, Quantity: qty("100"), TaxFee: 5},
+			},
+			gross: 100, net: 94.5,
+		},
+		{
+			name: "closed position subtracts all fees",
+			trans: []Transaction{
+				{Action: 1, Price: 10, Quantity: qty("1000"), TaxFee: 5},
+				{Action: -1, Price: 11, Quantity: qty("400"), TaxFee: 5},
+				{Action: -1, Price: 12, Quantity: qty("600"), TaxFee: 6},
+			},
+			gross: 1600, net: 1584,
+		},
+		{
+			name:  "nothing sold has no realized profit",
+			trans: []Transaction{{Action: 1, Price: 10, Quantity: qty("1000"), TaxFee: 5}},
+		},
+	}
+	spec, err := GetInstrumentSpec(InstrumentStock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			invest := &Investment{}
+			calcHolding(invest, c.trans, spec)
+			if invest.GrossProfit != c.gross || invest.ProfitLoss != c.net {
+				t.Fatalf("got gross %v net %v, want %v and %v", invest.GrossProfit, invest.ProfitLoss, c.gross, c.net)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package stock
+
+import (
+	"context"
+	"fmt"
+	"pixiu/backend/pkg/exception"
+	"time"
+)
+
+// 时间范围 [Start, End)，零值表示不限
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Contains 判断时刻是否在范围内
+func (r TimeRange) Contains(t time.Time) bool {
+	return (r.Start.IsZero() || !t.Before(r.Start)) && (r.End.IsZero() || t.Before(r.End))
+}
+
+// ParseMarketTime 严格解析成交时间：市场时区的 yyyy-MM-dd HH:mm:ss，或带时区偏移的 RFC 3339 时间，返回 UTC 时刻
+func ParseMarketTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation(DateTimeLayout, value, loc); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, exception.WrapBusiness(400, fmt.Sprintf("invalid time %q, expected yyyy-MM-dd HH:mm:ss", value), err)
+	}
+	return t.UTC(), nil
+}
+
+// stampTransaction 按市场时区解析交易的成交时间，设置成交时刻并规范成交时间的格式
+func stampTransaction(tran *Transaction, loc *time.Location) error {
+	finishAt, err := ParseMarketTime(tran.FinishTime, loc)
+	if err != nil {
+		return exception.WrapBusiness(400, fmt.Sprintf("invalid finish time %q, expected yyyy-MM-dd HH:mm:ss", tran.FinishTime), err)
+	}
+	tran.FinishAt = finishAt
+	tran.FinishTime = marketTime(finishAt, loc)
+	return nil
+}
+
+// marketTime 返回时刻在市场时区的 yyyy-MM-dd HH:mm:ss
+func marketTime(t time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(loc).Format(DateTimeLayout)
+}
+
+// parseTimeRange 解析查询的开始和结束时间（为空表示不限），可以是日期（结束日期包含当天）或时间
+func parseTimeRange(startTime string, finishTime string, loc *time.Location) (TimeRange, error) {
+	var r TimeRange
+	bound := func(value string, end bool) (time.Time, error) {
+		if day, err := time.ParseInLocation(DateLayout, value, loc); err == nil {
+			if end {
+				day = day.AddDate(0, 0, 1)
+			}
+			return day.UTC(), nil
+		}
+		t, err := ParseMarketTime(value, loc)
+		if err != nil {
+			return t, err
+		}
+		if end {
+			// 结束时间包含该时刻
+			t = t.Add(time.Second)
+		}
+		return t, nil
+	}
+	var err error
+	if startTime != "" {
+		if r.Start, err = bound(startTime, false); err != nil {
+			return r, err
+		}
+	}
+	if finishTime != "" {
+		if r.End, err = bound(finishTime, true); err != nil {
+			return r, err
+		}
+	}
+	if !r.Start.IsZero() && !r.End.IsZero() && !r.Start.Before(r.End) {
+		return r, exception.NewBusiness(400, "start time is after finish time")
+	}
+	return r, nil
+}
+
+// marketRanges 按股票所在市场的时区解析同一个查询期间：组合可能包含不同市场的股票，
+// 期间内的日期按各自市场的日期判断
+type marketRanges struct {
+	ss         StockService
+	startTime  string
+	finishTime string
+	stocks     map[string]*StockInfo
+	ranges     map[*time.Location]TimeRange
+}
+
+func (ss StockService) newMarketRanges(startTime string, finishTime string) (*marketRanges, error) {
+	// 先按本地时区校验开始和结束时间的格式
+	if _, err := parseTimeRange(startTime, finishTime, time.Local); err != nil {
+		return nil, err
+	}
+	return &marketRanges{ss: ss, startTime: startTime, finishTime: finishTime,
+		stocks: make(map[string]*StockInfo), ranges: make(map[*time.Location]TimeRange)}, nil
+}
+
+// span 返回包含所有市场期间的范围，用于查询时预先过滤：各时区与本地时区相差不超过两天
+func (mr *marketRanges) span() TimeRange {
+	r, _ := parseTimeRange(mr.startTime, mr.finishTime, time.Local)
+	if !r.Start.IsZero() {
+		r.Start = r.Start.AddDate(0, 0, -2)
+	}
+	if !r.End.IsZero() {
+		r.End = r.End.AddDate(0, 0, 2)
+	}
+	return r
+}
+
+// stock 返回股票信息并缓存，股票信息不存在时返回只有编码的股票
+func (mr *marketRanges) stock(ctx context.Context, code string) (*StockInfo, error) {
+	if si, ok := mr.stocks[code]; ok {
+		return si, nil
+	}
+	si, err := mr.ss.stockOf(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	mr.stocks[code] = si
+	return si, nil
+}
+
+// contains 判断时刻是否在股票所在市场时区的期间内
+func (mr *marketRanges) contains(ctx context.Context, code string, t time.Time) (bool, error) {
+	si, err := mr.stock(ctx, code)
+	if err != nil {
+		return false, err
+	}
+	loc := marketLocation(si)
+	r, ok := mr.ranges[loc]
+	if !ok {
+		if r, err = parseTimeRange(mr.startTime, mr.finishTime, loc); err != nil {
+			return false, err
+		}
+		mr.ranges[loc] = r
+	}
+	return r.Contains(t), nil
+}
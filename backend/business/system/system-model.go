@@ -1,7 +1,12 @@
 package system
 
 type Preferences struct {
-	Theme Theme `json:"theme" yaml:"theme"`
+	Theme   Theme   `json:"theme" yaml:"theme"`
+	Recycle Recycle `json:"recycle" yaml:"recycle"`
+}
+
+type Recycle struct {
+	RetentionDays int `json:"retentionDays" yaml:"retentionDays"` // 回收站保留天数，0 表示默认值
 }
 
 type Theme struct {
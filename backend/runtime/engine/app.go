@@ -61,7 +61,8 @@ func NewAppEngine() *AppEngine {
 	uapi := ipc.NewUaacApi(ae)
 	sapi := ipc.NewStockApi(ae)
 	papi := ipc.NewSystemApi(ae)
-	ae.lcs = append(ae.lcs, uapi, sapi, papi)
+	mapi := ipc.NewMaintainApi(ae)
+	ae.lcs = append(ae.lcs, uapi, sapi, papi, mapi)
 
 	return ae
 }
@@ -130,17 +131,19 @@ func (a *AppEngine) Startup(ctx context.Context) {
 	}
 	a.gdb = gdb
 
-	// 检查表是否存在
-	exists := gdb.Migrator().HasTable(&uaac.Account{})
-	if !exists {
-		err := gdb.AutoMigrate(
-			uaac.Account{}, uaac.Profile{}, stock.StockInfo{}, stock.Investment{}, stock.Transaction{},
-		)
-		if err != nil {
-			logger.Warn("注册数据库表失败: %v\n", err)
-			panic(err)
-		}
+	gormer := gormer.NewGormer(gdb)
+	a.ncmap["UaacService"] = uaac.NewUaacService(gormer, dao.NewUaacDao(gormer))
+	stockService := stock.NewStockService(gormer, dao.NewStockDao(gormer))
+	a.ncmap["StockService"] = stockService
+	maintainService := stock.NewMaintainService(stockService)
+	a.ncmap["MaintainService"] = maintainService
 
+	exists, err := syncSchema(gdb, maintainService)
+	if err != nil {
+		logger.Warn("注册数据库表失败: %v\n", err)
+		panic(err)
+	}
+	if !exists {
 		// init admin user account
 		pwd := utils.BcryptHash("admin@123")
 		gdb.Save(&uaac.Account{Username: "admin", Password: pwd, Disabled: false})
@@ -149,12 +152,37 @@ func (a *AppEngine) Startup(ctx context.Context) {
 		logger.Info("数据库表创建成功")
 	}
 
-	gormer := gormer.NewGormer(gdb)
-	a.ncmap["UaacService"] = uaac.NewUaacService(gormer, dao.NewUaacDao(gormer))
-	a.ncmap["StockService"] = stock.NewStockService(gormer, dao.NewStockDao(gormer))
+	// 加载市场交易规则配置（可选），覆盖内置规则，重新计算投资前加载
+	if data, err := storage.NewLocalStorage(a.acd, "markets.json").Load(); err == nil {
+		if err := stock.LoadMarketRules(data); err != nil {
+			logger.Warn("加载市场交易规则失败: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		logger.Warn("读取市场交易规则失败: %v", err)
+	}
+
+	if migrations, err := maintainService.RunMigrations(); err != nil {
+		logger.Warn("执行数据迁移失败，下次启动时重试: %v", err)
+	} else {
+		for _, m := range *migrations {
+			if m.Pending {
+				logger.Warn("数据迁移 %s 未完成，下次启动时重试: %s", m.Name, m.Message)
+			} else {
+				logger.Info("数据迁移 %s 完成: %s", m.Name, m.Message)
+			}
+		}
+	}
 
 	pls := storage.NewLocalStorage(a.acd, "preferences.json")
-	a.ncmap["SystemService"] = system.NewSystemService(pls)
+	systemService := system.NewSystemService(pls)
+	a.ncmap["SystemService"] = systemService
+
+	// 清除回收站中过期的数据
+	if count, err := stockService.PurgeDeleted("system", systemService.GetPreferences().Recycle.RetentionDays); err != nil {
+		logger.Warn("清除回收站失败: %v", err)
+	} else if count > 0 {
+		logger.Info("清除回收站过期数据 %d 条", count)
+	}
 
 	err = a.aah.Startup(a.acd)
 	if err != nil {
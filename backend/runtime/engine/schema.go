@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"pixiu/backend/business/stock"
+	"pixiu/backend/business/uaac"
+
+	"gorm.io/gorm"
+)
+
+// 按投资组合划分的表，旧版本的记录属于默认实盘组合（标识 0）
+var portfolioModels = []any{
+	&stock.Investment{}, &stock.Transaction{}, &stock.PlannedOrder{}, &stock.GridPlan{}, &stock.Dividend{}, &stock.DcaPlan{},
+}
+
+// syncSchema 同步表结构：先登记旧版本数据需要的数据迁移并补齐已有字段的空值，再新增表和字段，返回数据库是否已存在
+func syncSchema(gdb *gorm.DB, maintainService *stock.MaintainService) (bool, error) {
+	// 检查表是否存在
+	exists := gdb.Migrator().HasTable(&uaac.Account{})
+	// 旧版本的投资没有毛盈亏（且盈亏未扣除税费）、持仓成本、摊薄成本和保本价，同步表结构后需要重新计算
+	recompute := false
+	for _, field := range []string{"GrossProfit", "HoldingCost", "DilutedCost", "BreakEven"} {
+		recompute = recompute || (exists && !gdb.Migrator().HasColumn(&stock.Investment{}, field))
+	}
+	// 旧版本的成交时间为不带时区的文本，同步表结构后按市场时区解析为成交时刻，并重新计算投资的建仓和清仓时刻
+	stamp := exists && !gdb.Migrator().HasColumn(&stock.Transaction{}, "FinishAt")
+	// 数据迁移在同步表结构前登记，执行成功前每次启动都会重试
+	if err := gdb.AutoMigrate(stock.Migration{}); err != nil {
+		return exists, err
+	}
+	if stamp {
+		if err := maintainService.PlanMigrations(stock.MigrationStampTime); err != nil {
+			return exists, err
+		}
+	}
+	if recompute {
+		if err := maintainService.PlanMigrations(stock.MigrationRecompute); err != nil {
+			return exists, err
+		}
+	}
+	if err := backfillPortfolio(gdb); err != nil {
+		return exists, err
+	}
+	// 同步表结构（新增的表和字段）
+	err := gdb.AutoMigrate(
+		uaac.Account{}, uaac.Profile{}, stock.StockInfo{}, stock.Investment{}, stock.Transaction{},
+		stock.AuditLog{}, stock.Holiday{}, stock.PlannedOrder{}, stock.Portfolio{}, stock.PriceBar{}, stock.GridPlan{}, stock.StockAlias{},
+		stock.DcaPlan{}, stock.DcaEntry{}, stock.Dividend{}, stock.Migration{},
+	)
+	return exists, err
+}
+
+// backfillPortfolio 没有默认值时新增的投资组合字段在已有记录上为空，按组合查询不到这些记录，
+// 同步表结构（改为非空并默认 0）之前归入默认实盘组合
+func backfillPortfolio(gdb *gorm.DB) error {
+	for _, model := range portfolioModels {
+		if !gdb.Migrator().HasColumn(model, "PortfolioID") {
+			continue
+		}
+		if err := gdb.Model(model).Where("portfolio_id IS NULL").UpdateColumn("portfolio_id", 0).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"pixiu/backend/adapter/dao"
+	"pixiu/backend/business/stock"
+	"pixiu/backend/business/uaac"
+	"pixiu/backend/pkg/gormer"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// 旧版本的表结构
+type baselineStockInfo struct {
+	Code      string `gorm:"primaryKey"`
+	Name      string
+	Market    string
+	Currency  string
+	Status    int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (baselineStockInfo) TableName() string { return "t_stock_info" }
+
+type baselineInvestment struct {
+	ID          int64 `gorm:"primaryKey"`
+	StockCode   string
+	ProfitLoss  float64
+	TotalTaxFee float64
+	CostPrice   float64
+	Quantity    int
+	Amount      float64
+	Status      int
+	OpenTime    string
+	CloseTime   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (baselineInvestment) TableName() string { return "t_investment" }
+
+type baselineTransaction struct {
+	ID         int64 `gorm:"primaryKey"`
+	InvestID   int64
+	StockCode  string
+	Action     int8
+	TaxFee     float64
+	Price      float64
+	Quantity   int
+	Amount     float64
+	FinishTime string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (baselineTransaction) TableName() string { return "t_transaction" }
+
+func TestSyncSchemaFromBaseline(t *testing.T) {
+	// 旧版本的表结构，或之前的版本已新增了可为空的投资组合字段
+	for _, nullable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("nullable portfolio %v", nullable), func(t *testing.T) {
+			testSyncSchema(t, nullable)
+		})
+	}
+}
+
+func testSyncSchema(t *testing.T, nullable bool) {
+	gdb, err := dao.NewGormDB(&dao.SqliteConfig{Dsn: filepath.Join(t.TempDir(), "pixiu.db"), LogMode: "silent",
+		Prefix: "t_", Singular: true, MaxIdleConns: 1, MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db, err := gdb.DB(); err == nil {
+			db.Close()
+		}
+	})
+	if err := gdb.AutoMigrate(uaac.Account{}, baselineStockInfo{}, baselineInvestment{}, baselineTransaction{}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rows := []any{
+		&baselineStockInfo{Code: "600000", Name: "浦发银行", Market: stock.MarketA, Currency: "人民币", CreatedAt: now, UpdatedAt: now},
+		&baselineInvestment{ID: 1, StockCode: "600000", CostPrice: 10, Quantity: 100, Amount: 1000, TotalTaxFee: 5, OpenTime: "2025-06-03 10:00:00", CreatedAt: now, UpdatedAt: now},
+		&baselineTransaction{ID: 1, InvestID: 1, StockCode: "600000", Action: 1, TaxFee: 5, Price: 10, Quantity: 100, Amount: 1000, FinishTime: "2025-06-03 10:00:00", CreatedAt: now, UpdatedAt: now},
+	}
+	for _, row := range rows {
+		if err := gdb.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if nullable {
+		for _, table := range []string{"t_investment", "t_transaction"} {
+			if err := gdb.Exec("ALTER TABLE " + table + " ADD COLUMN portfolio_id integer").Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	gm := gormer.NewGormer(gdb)
+	ss := stock.NewStockService(gm, dao.NewStockDao(gm))
+	ms := stock.NewMaintainService(ss)
+	exists, err := syncSchema(gdb, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("baseline database is reported as new")
+	}
+	// 再次启动时表结构已同步
+	if _, err := syncSchema(gdb, ms); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := ms.RunMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range *migrations {
+		if m.Pending {
+			t.Errorf("migration %s is pending: %s", m.Name, m.Message)
+		}
+	}
+
+	for _, table := range []string{"t_investment", "t_transaction"} {
+		var count int64
+		if err := gdb.Table(table).Where("portfolio_id IS NULL").Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			t.Errorf("%s: %d rows without portfolio", table, count)
+		}
+	}
+	invests, _, err := ss.QueryInvestments(&stock.Criteria{StockCode: "600000"}, &stock.Page{PageNo: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*invests) != 1 || (*invests)[0].OpenAt.IsZero() || (*invests)[0].HoldingDays > 10000 {
+		t.Fatalf("got investments %+v after recompute, want the baseline investment with its open time", *invests)
+	}
+
+	// 旧版本的持仓可以继续买入和卖出
+	buy := &stock.Transaction{StockCode: "600000", Action: 1, Price: 11, Quantity: decimal.NewFromInt(100), FinishTime: "2025-06-04 10:00:00"}
+	if err := ss.AddTransaction("test", buy); err != nil {
+		t.Fatal(err)
+	}
+	sell := &stock.Transaction{StockCode: "600000", Action: -1, Price: 12, Quantity: decimal.NewFromInt(200), FinishTime: "2025-06-05 10:00:00"}
+	if err := ss.AddTransaction("test", sell); err != nil {
+		t.Fatal(err)
+	}
+	if buy.InvestID != 1 || sell.InvestID != 1 {
+		t.Fatalf("got buy in investment %d and sell in %d, want both in the baseline investment 1", buy.InvestID, sell.InvestID)
+	}
+}
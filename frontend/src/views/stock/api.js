@@ -1,16 +1,89 @@
-import { AddStock, AddTransaction, DeleteStock, DeleteTransaction, GetClearList, GetHolding, GetStockClear, GetStockList, GetTransactions, UpdateStock, UpdateTransaction } from 'wailsjs/go/ipc/StockApi.js'
+import { useAuthStore } from '@/store'
+import { ActivatePlannedOrder, AddDcaPlan, AddGridPlan, AddPlannedOrder, AddPortfolio, AddStock, AddTransaction, AddTransactions, CancelPlannedOrder, CloseGridPlan, ComparePortfolios, ConfirmDcaEntry, DeleteDividend, DeleteInvestment, DeleteStock, DeleteTransaction, EndDcaPlan, ExecutePlannedOrder, GetAuditLogs, GetClearList, GetDcaEntries, GetDcaPlans, GetDcaStatus, GetDividends, GetGridPlans, GetGridStatus, GetHolding, GetHolidays, GetIndicators, GetInstrumentSpecs, GetMarketRules, GetPlannedOrders, GetPortfolios, GetPriceChart, GetRecycleBin, GetRoundTripReport, GetRoundTrips, GetSlippageReport, GetStockAliases, GetStockClear, GetStockList, GetTransactions, ImportHolidays, ImportPrices, MergeStock, NextTradingDay, PauseDcaPlan, PrevTradingDay, PurgeRecycleBin, QueryInvestments, QueryTransactions, RecordDividend, RenameStock, RestoreDeleted, ResumeDcaPlan, RunBacktest, ScheduleDcaPlans, SkipDcaEntry, UndoChange, UpdateDcaPlan, UpdateGridPlan, UpdatePlannedOrder, UpdatePortfolio, UpdateStock, UpdateTransaction } from 'wailsjs/go/ipc/StockApi.js'
+import { CheckIntegrity, RecomputeAll, RepairIntegrity } from 'wailsjs/go/ipc/MaintainApi.js'
 
 export default {
   getStocks: () => GetStockList(),
-  addStock: data => AddStock(data),
-  saveStock: data => UpdateStock(data),
-  deleteStock: code => DeleteStock(code),
+  addStock: data => AddStock(useAuthStore().accessToken, data),
+  saveStock: data => UpdateStock(useAuthStore().accessToken, data),
+  deleteStock: code => DeleteStock(useAuthStore().accessToken, code),
+  getInstrumentSpecs: () => GetInstrumentSpecs(),
+  getMarketRules: () => GetMarketRules(),
+  getHolidays: calendar => GetHolidays(calendar),
+  importHolidays: calendar => ImportHolidays(useAuthStore().accessToken, calendar),
+  nextTradingDay: (calendar, date) => NextTradingDay(calendar, date),
+  prevTradingDay: (calendar, date) => PrevTradingDay(calendar, date),
   getHolding: stockCode => GetHolding(stockCode),
   getTrades: holdingId => GetTransactions(holdingId),
-  addTrade: data => AddTransaction(data),
-  saveTrade: data => UpdateTransaction(data),
-  deleteTrade: id => DeleteTransaction(id),
+  addTrade: data => AddTransaction(useAuthStore().accessToken, data),
+  addTrades: list => AddTransactions(useAuthStore().accessToken, list),
+  saveTrade: data => UpdateTransaction(useAuthStore().accessToken, data),
+  deleteTrade: id => DeleteTransaction(useAuthStore().accessToken, id),
+
+  queryTrades: (criteria, page) => QueryTransactions(criteria, page),
+  queryHoldings: (criteria, page) => QueryInvestments(criteria, page),
 
   getClearList: params => GetClearList(params),
-  getStockClear: (code, st, ft) => GetStockClear(code, st, ft),
+  getStockClear: (code, st, ft, gross = false) => GetStockClear(code, st, ft, gross),
+
+  getAuditLogs: (entity, key) => GetAuditLogs(entity, key),
+  undoChange: logId => UndoChange(useAuthStore().accessToken, logId),
+
+  deleteHolding: id => DeleteInvestment(useAuthStore().accessToken, id),
+  getRecycleBin: () => GetRecycleBin(),
+  restoreDeleted: (entity, key) => RestoreDeleted(useAuthStore().accessToken, entity, key),
+  purgeRecycleBin: () => PurgeRecycleBin(useAuthStore().accessToken),
+
+  checkIntegrity: () => CheckIntegrity(),
+  repairIntegrity: () => RepairIntegrity(useAuthStore().accessToken),
+  recomputeAll: () => RecomputeAll(useAuthStore().accessToken),
+
+  getPlans: status => GetPlannedOrders(status),
+  addPlan: data => AddPlannedOrder(useAuthStore().accessToken, data),
+  savePlan: data => UpdatePlannedOrder(useAuthStore().accessToken, data),
+  activatePlan: id => ActivatePlannedOrder(useAuthStore().accessToken, id),
+  cancelPlan: id => CancelPlannedOrder(useAuthStore().accessToken, id),
+  executePlan: (planId, fills) => ExecutePlannedOrder(useAuthStore().accessToken, planId, fills),
+  getSlippageReport: planId => GetSlippageReport(planId),
+
+  getPortfolios: () => GetPortfolios(),
+  addPortfolio: data => AddPortfolio(useAuthStore().accessToken, data),
+  savePortfolio: data => UpdatePortfolio(useAuthStore().accessToken, data),
+  comparePortfolios: (startTime, finishTime, gross = false) => ComparePortfolios(startTime, finishTime, gross),
+
+  importPrices: stockCode => ImportPrices(useAuthStore().accessToken, stockCode),
+  getPriceChart: (stockCode, startDate, endDate, adjust) => GetPriceChart(stockCode, startDate, endDate, adjust),
+
+  getIndicators: (stockCode, startDate, endDate, adjust, specs) => GetIndicators(stockCode, startDate, endDate, adjust, specs),
+
+  runBacktest: config => RunBacktest(useAuthStore().accessToken, config),
+
+  getRoundTrips: (investId, window = 1) => GetRoundTrips(investId, window),
+  getRoundTripReport: (portfolioId, startTime, finishTime, window = 1) => GetRoundTripReport(portfolioId, startTime, finishTime, window),
+
+  getGridPlans: status => GetGridPlans(status),
+  addGridPlan: data => AddGridPlan(useAuthStore().accessToken, data),
+  saveGridPlan: data => UpdateGridPlan(useAuthStore().accessToken, data),
+  closeGridPlan: id => CloseGridPlan(useAuthStore().accessToken, id),
+  getGridStatus: id => GetGridStatus(id),
+
+  renameStock: (from, to) => RenameStock(useAuthStore().accessToken, from, to),
+  mergeStock: (from, to, ratio) => MergeStock(useAuthStore().accessToken, from, to, ratio),
+  getStockAliases: () => GetStockAliases(),
+
+  getDcaPlans: status => GetDcaPlans(status),
+  addDcaPlan: data => AddDcaPlan(useAuthStore().accessToken, data),
+  saveDcaPlan: data => UpdateDcaPlan(useAuthStore().accessToken, data),
+  pauseDcaPlan: id => PauseDcaPlan(useAuthStore().accessToken, id),
+  resumeDcaPlan: id => ResumeDcaPlan(useAuthStore().accessToken, id),
+  endDcaPlan: id => EndDcaPlan(useAuthStore().accessToken, id),
+  scheduleDcaPlans: () => ScheduleDcaPlans(useAuthStore().accessToken),
+  getDcaEntries: (planId, status) => GetDcaEntries(planId, status),
+  confirmDcaEntry: (id, fill) => ConfirmDcaEntry(useAuthStore().accessToken, id, fill),
+  skipDcaEntry: id => SkipDcaEntry(useAuthStore().accessToken, id),
+  getDcaStatus: id => GetDcaStatus(id),
+
+  getDividends: stockCode => GetDividends(stockCode),
+  recordDividend: data => RecordDividend(useAuthStore().accessToken, data),
+  deleteDividend: id => DeleteDividend(useAuthStore().accessToken, id),
 }